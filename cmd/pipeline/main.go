@@ -0,0 +1,410 @@
+// Command pipeline runs pipelines described by spec files, using a set of
+// built-in stages that work on lines of text. Each line of input becomes a value,
+// and each value output by the pipeline is written as a line of output.
+//
+//	pipeline run [-in file]... [-out file] [-progress interval] spec.json
+//	pipeline validate spec.json
+//	pipeline graph [-format text|dot|mermaid] spec.json
+//	pipeline dry-run [-in file]... [-n lines] spec.json
+//
+// See pipeline.Spec for the format of spec files. The built-in stages are
+//
+//	map      upper, lower, trim, prefix {text}, replace {pattern, with}
+//	flatmap  split {separator}
+//	filter   match {pattern, invert}, nonempty
+//	reduce   count, join {separator}
+//	sink     stdout, stderr, file {path, append}
+//
+// Run exits with status 1 if the pipeline sent any errors, after printing a
+// summary of them
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bernos/go-pipeline/pipeline"
+	"github.com/bernos/go-pipeline/pipeline/stream"
+	"golang.org/x/net/context"
+)
+
+const usage = `Usage:
+  pipeline run [-in file]... [-out file] [-progress interval] spec.json
+  pipeline validate spec.json
+  pipeline graph [-format text|dot|mermaid] spec.json
+  pipeline dry-run [-in file]... [-n lines] spec.json
+`
+
+// Exit statuses
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+// maxErrorSummary is the number of distinct errors listed in the summary
+const maxErrorSummary = 10
+
+func main() {
+	os.Exit(command(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// command runs the subcommand in args, returning the exit status
+func command(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return exitUsage
+	}
+
+	env := &environment{
+		stdout: stdout,
+		stderr: stderr,
+	}
+
+	defer env.close()
+
+	switch args[0] {
+	case "run":
+		return runCommand(args[1:], stdin, env)
+	case "dry-run":
+		env.dryRun = true
+		return runCommand(args[1:], stdin, env)
+	case "validate":
+		return validateCommand(args[1:], env)
+	case "graph":
+		return graphCommand(args[1:], env)
+	}
+
+	fmt.Fprintf(stderr, "Unknown command %q\n%s", args[0], usage)
+
+	return exitUsage
+}
+
+// files is a flag that can be repeated
+type files []string
+
+func (f *files) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *files) Set(path string) error {
+	*f = append(*f, path)
+	return nil
+}
+
+// newFlagSet creates a flag set for a subcommand that takes a spec file
+func newFlagSet(name string, env *environment) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(env.stderr)
+	fs.Usage = func() {
+		fmt.Fprint(env.stderr, usage)
+	}
+
+	return fs
+}
+
+// parse parses the flags of a subcommand, returning the spec file
+func parse(fs *flag.FlagSet, args []string) (string, bool) {
+	if err := fs.Parse(args); err != nil {
+		return "", false
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return "", false
+	}
+
+	return fs.Arg(0), true
+}
+
+// load builds the pipeline in the spec file at path, using the built-in stages
+func load(path string, env *environment) (pipeline.Pipeline, error) {
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	spec, err := pipeline.ParseSpec(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	r := pipeline.NewRegistry()
+	registerStages(r, env)
+
+	return r.Build(spec)
+}
+
+func validateCommand(args []string, env *environment) int {
+	path, ok := parse(newFlagSet("validate", env), args)
+
+	if !ok {
+		return exitUsage
+	}
+
+	if _, err := load(path, env); err != nil {
+		fmt.Fprintf(env.stderr, "%s:\n%s\n", path, err.Error())
+		return exitError
+	}
+
+	fmt.Fprintf(env.stdout, "%s is valid\n", path)
+
+	return exitOK
+}
+
+func graphCommand(args []string, env *environment) int {
+	fs := newFlagSet("graph", env)
+	format := fs.String("format", "text", "Graph format: text, dot or mermaid")
+	path, ok := parse(fs, args)
+
+	if !ok {
+		return exitUsage
+	}
+
+	p, err := load(path, env)
+
+	if err != nil {
+		fmt.Fprintf(env.stderr, "%s:\n%s\n", path, err.Error())
+		return exitError
+	}
+
+	g := pipeline.Describe(p)
+
+	switch *format {
+	case "text":
+		fmt.Fprint(env.stdout, g.String())
+	case "dot":
+		fmt.Fprint(env.stdout, g.DOT())
+	case "mermaid":
+		fmt.Fprint(env.stdout, g.Mermaid())
+	default:
+		fmt.Fprintf(env.stderr, "Unknown graph format %q\n", *format)
+		return exitUsage
+	}
+
+	return exitOK
+}
+
+// runCommand runs the run and dry-run subcommands. A dry run reads at most n
+// lines of input, always writes its output to stdout, and its sinks print what
+// they would have done instead of doing it
+func runCommand(args []string, stdin io.Reader, env *environment) int {
+	var (
+		inputs files
+		fs     = newFlagSet("run", env)
+	)
+
+	fs.Var(&inputs, "in", "Input file, which may be repeated. Defaults to stdin")
+	output := fs.String("out", "", "Output file. Defaults to stdout")
+	progress := fs.Duration("progress", time.Second, "Interval between progress reports, or 0 for none")
+	limit := fs.Int("n", 10, "Number of lines of input to read in a dry run")
+
+	path, ok := parse(fs, args)
+
+	if !ok {
+		return exitUsage
+	}
+
+	p, err := load(path, env)
+
+	if err != nil {
+		fmt.Fprintf(env.stderr, "%s:\n%s\n", path, err.Error())
+		return exitError
+	}
+
+	var readers []io.Reader
+
+	for _, in := range inputs {
+		if in == "-" {
+			readers = append(readers, stdin)
+			continue
+		}
+
+		f, err := os.Open(in)
+
+		if err != nil {
+			fmt.Fprintln(env.stderr, err.Error())
+			return exitError
+		}
+
+		defer f.Close()
+		readers = append(readers, f)
+	}
+
+	if len(readers) == 0 {
+		readers = append(readers, stdin)
+	}
+
+	out := env.stdout
+
+	if *output != "" && !env.dryRun {
+		f, err := os.Create(*output)
+
+		if err != nil {
+			fmt.Fprintln(env.stderr, err.Error())
+			return exitError
+		}
+
+		defer f.Close()
+		out = f
+	}
+
+	n := -1
+
+	if env.dryRun {
+		n = *limit
+	}
+
+	e := lines(io.MultiReader(readers...), n).
+		Compose(p).
+		Compose(pipeline.ToWriter(out, formatText)).
+		Start(context.Background())
+
+	defer e.Cancel()
+
+	return wait(e, *progress, env)
+}
+
+// lines creates a pipeline that reads up to n lines from r, or every line if n
+// is negative. Lines are derived from the first value of the input stream, which
+// is otherwise ignored. The output stream is closed once r has been read
+func lines(r io.Reader, n int) pipeline.Pipeline {
+	return func(in stream.Stream) stream.Stream {
+		out, cls := in.WithValues(make(chan context.Context))
+
+		go func() {
+			defer cls()
+
+			parent, ok := <-in.Values()
+
+			if !ok {
+				return
+			}
+
+			scanner := bufio.NewScanner(r)
+
+			for i := 0; i != n && scanner.Scan(); i++ {
+				out.Value(withText(parent, scanner.Text()))
+			}
+
+			if err := scanner.Err(); err != nil {
+				out.Error(err)
+			}
+		}()
+
+		return out
+	}
+}
+
+func formatText(ctx context.Context) ([]byte, error) {
+	return []byte(textFromContext(ctx) + "\n"), nil
+}
+
+// wait waits for the execution to finish, reporting progress at the given
+// interval, and then prints a summary of any errors
+func wait(e *pipeline.Execution, interval time.Duration, env *environment) int {
+	var (
+		counts = make(map[string]int)
+		total  int
+		done   = make(chan struct{})
+		tick   <-chan time.Time
+	)
+
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	go func() {
+		defer close(done)
+
+		for range e.Values() {
+		}
+	}()
+
+	errs := e.Errors()
+
+	for errs != nil {
+		select {
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+
+			counts[err.Error()]++
+			total++
+
+		case <-tick:
+			report(e, env.stderr)
+		}
+	}
+
+	<-done
+
+	if interval > 0 {
+		report(e, env.stderr)
+	}
+
+	if total == 0 {
+		return exitOK
+	}
+
+	summarise(counts, total, env.stderr)
+
+	return exitError
+}
+
+// report prints the number of values processed by each stage
+func report(e *pipeline.Execution, w io.Writer) {
+	stats := e.Stats()
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "%s elapsed\n", time.Since(stats.Started).Round(time.Millisecond))
+	fmt.Fprintln(tw, "STAGE\tITEMS\tERRORS\tIN FLIGHT")
+
+	for _, s := range stats.Stages {
+		fmt.Fprintf(tw, "%s%s\t%d\t%d\t%d\n", strings.Repeat("  ", s.Depth), s.Name, s.Items, s.Errors, s.InFlight)
+	}
+
+	tw.Flush()
+}
+
+// summarise prints the most common errors
+func summarise(counts map[string]int, total int, w io.Writer) {
+	msgs := make([]string, 0, len(counts))
+
+	for msg := range counts {
+		msgs = append(msgs, msg)
+	}
+
+	sort.Slice(msgs, func(i, j int) bool {
+		if counts[msgs[i]] != counts[msgs[j]] {
+			return counts[msgs[i]] > counts[msgs[j]]
+		}
+
+		return msgs[i] < msgs[j]
+	})
+
+	fmt.Fprintf(w, "%d errors:\n", total)
+
+	for i, msg := range msgs {
+		if i == maxErrorSummary {
+			fmt.Fprintf(w, "  ... and %d more\n", len(msgs)-i)
+			break
+		}
+
+		fmt.Fprintf(w, "  %5d  %s\n", counts[msg], msg)
+	}
+}
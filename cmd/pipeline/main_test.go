@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// writeSpec writes a spec to a temporary file, returning its path
+func writeSpec(t *testing.T, spec string) string {
+	path := filepath.Join(t.TempDir(), "spec.json")
+
+	if err := ioutil.WriteFile(path, []byte(spec), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func execute(args []string, stdin string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	status := command(args, strings.NewReader(stdin), &stdout, &stderr)
+	return status, stdout.String(), stderr.String()
+}
+
+const testSpec = `{
+  "name": "shout",
+  "stages": [
+    {"type": "filter", "use": "nonempty"},
+    {"type": "map", "use": "upper", "workers": 2, "name": "upper"},
+    {"type": "tee", "stages": [{"type": "sink", "use": "stderr"}]}
+  ]
+}`
+
+func TestRun(t *testing.T) {
+	spec := writeSpec(t, testSpec)
+	status, stdout, stderr := execute([]string{"run", "-progress", "0", spec}, "a\n\nb\n")
+
+	if status != exitOK {
+		t.Fatalf("Want exit status %d, got %d: %s", exitOK, status, stderr)
+	}
+
+	if got := sortedLines(stdout); got != "A,B" {
+		t.Errorf("Want output A,B, got %s", got)
+	}
+
+	if got := sortedLines(stderr); got != "A,B" {
+		t.Errorf("Want A,B sunk to stderr, got %s", got)
+	}
+}
+
+func TestRunFiles(t *testing.T) {
+	var (
+		dir  = t.TempDir()
+		in   = filepath.Join(dir, "in.txt")
+		out  = filepath.Join(dir, "out.txt")
+		spec = writeSpec(t, `{"stages": [{"type": "map", "use": "prefix", "params": {"text": "> "}}]}`)
+	)
+
+	ioutil.WriteFile(in, []byte("one\ntwo\n"), 0644)
+
+	if status, _, stderr := execute([]string{"run", "-in", in, "-out", out, spec}, ""); status != exitOK {
+		t.Fatalf("Want exit status %d, got %d: %s", exitOK, status, stderr)
+	}
+
+	data, _ := ioutil.ReadFile(out)
+
+	if string(data) != "> one\n> two\n" {
+		t.Errorf("Unexpected output %q", data)
+	}
+}
+
+func TestCheckCommandsLeaveSinkFiles(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out.txt")
+	spec := writeSpec(t, `{"stages": [{"type": "sink", "use": "file", "params": {"path": "`+out+`"}}]}`)
+
+	ioutil.WriteFile(out, []byte("keep me\n"), 0644)
+
+	for _, args := range [][]string{{"validate", spec}, {"graph", spec}} {
+		if status, _, stderr := execute(args, ""); status != exitOK {
+			t.Fatalf("%v: want exit status %d, got %d: %s", args, exitOK, status, stderr)
+		}
+
+		if data, _ := ioutil.ReadFile(out); string(data) != "keep me\n" {
+			t.Errorf("%v: want output file unchanged, got %q", args, data)
+		}
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	spec := writeSpec(t, `{"stages": [{"type": "sink", "use": "file", "params": {"path": "`+
+		filepath.Join(t.TempDir(), "missing", "out.txt")+`"}}]}`)
+
+	status, _, stderr := execute([]string{"run", spec}, "a\n")
+
+	if status != exitError || !strings.Contains(stderr, "no such file") {
+		t.Errorf("Want build error, got %d: %s", status, stderr)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out.txt")
+	spec := writeSpec(t, `{"stages": [{"type": "sink", "use": "file", "params": {"path": "`+out+`"}}]}`)
+
+	status, _, stderr := execute([]string{"dry-run", "-n", "2", "-progress", "0", spec}, "a\nb\nc\n")
+
+	if status != exitOK {
+		t.Fatalf("Want exit status %d, got %d: %s", exitOK, status, stderr)
+	}
+
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Error("Want dry run not to create the sink's file")
+	}
+
+	if !strings.Contains(stderr, "sink file "+out+": a\n") || !strings.Contains(stderr, ": b\n") || strings.Contains(stderr, ": c\n") {
+		t.Errorf("Want the first 2 lines to be sunk, got %s", stderr)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if status, stdout, _ := execute([]string{"validate", writeSpec(t, testSpec)}, ""); status != exitOK || !strings.Contains(stdout, "is valid") {
+		t.Errorf("Want spec to be valid, got %d: %s", status, stdout)
+	}
+
+	spec := writeSpec(t, "{\n  \"stages\": [\n    {\"type\": \"map\", \"use\": \"shout\"}\n  ]\n}")
+	status, _, stderr := execute([]string{"validate", spec}, "")
+
+	if status != exitError || !strings.Contains(stderr, "line 3: stages[0].use: No Mapper registered as \"shout\"") {
+		t.Errorf("Want validation error, got %d: %s", status, stderr)
+	}
+}
+
+func TestGraph(t *testing.T) {
+	spec := writeSpec(t, testSpec)
+
+	if status, stdout, _ := execute([]string{"graph", spec}, ""); status != exitOK || !strings.Contains(stdout, "upper") {
+		t.Errorf("Want graph, got %d: %s", status, stdout)
+	}
+
+	if status, stdout, _ := execute([]string{"graph", "-format", "mermaid", spec}, ""); status != exitOK || !strings.Contains(stdout, "title: shout") || !strings.Contains(stdout, "flowchart LR") {
+		t.Errorf("Want mermaid graph, got %d: %s", status, stdout)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	for _, args := range [][]string{nil, {"explode"}, {"run"}, {"graph", "-format", "x"}} {
+		if status, _, _ := execute(args, ""); status != exitUsage {
+			t.Errorf("%v: want exit status %d, got %d", args, exitUsage, status)
+		}
+	}
+}
+
+func sortedLines(s string) string {
+	lines := strings.Fields(s)
+	sort.Strings(lines)
+	return strings.Join(lines, ",")
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/bernos/go-pipeline/pipeline"
+	"golang.org/x/net/context"
+)
+
+type textKey int
+
+const (
+	textContextKey textKey = iota
+	countContextKey
+)
+
+// withText returns a copy of ctx carrying a line of text. Every value handled by
+// the built-in stages is a line of text
+func withText(ctx context.Context, text string) context.Context {
+	return context.WithValue(ctx, textContextKey, text)
+}
+
+func textFromContext(ctx context.Context) string {
+	text, _ := ctx.Value(textContextKey).(string)
+	return text
+}
+
+// textMapper adapts a func on text to a pipeline.Mapper
+func textMapper(fn func(string) string) pipeline.Mapper {
+	return pipeline.MapperFunc(func(ctx context.Context) (context.Context, error) {
+		return withText(ctx, fn(textFromContext(ctx))), nil
+	})
+}
+
+// environment holds the resources used by the built-in stages while a command
+// runs
+type environment struct {
+	stdout io.Writer
+	stderr io.Writer
+
+	// If dryRun is true, sinks print what they would have done to stderr
+	dryRun bool
+
+	mu      sync.Mutex
+	closers []io.Closer
+}
+
+// close closes any files opened by sinks
+func (env *environment) close() {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+
+	for _, c := range env.closers {
+		c.Close()
+	}
+
+	env.closers = nil
+}
+
+// writer returns a sink func that writes each line to w
+func (env *environment) writer(name string, w io.Writer) func(context.Context) error {
+	var mu sync.Mutex
+
+	return func(ctx context.Context) error {
+		if env.dryRun {
+			mu.Lock()
+			defer mu.Unlock()
+
+			_, err := fmt.Fprintf(env.stderr, "sink %s: %s\n", name, textFromContext(ctx))
+			return err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		_, err := fmt.Fprintln(w, textFromContext(ctx))
+		return err
+	}
+}
+
+// registerStages adds the built-in text stages to r
+func registerStages(r *pipeline.Registry, env *environment) {
+	r.RegisterMapper("upper", func(pipeline.Params) (pipeline.Mapper, error) {
+		return textMapper(strings.ToUpper), nil
+	})
+
+	r.RegisterMapper("lower", func(pipeline.Params) (pipeline.Mapper, error) {
+		return textMapper(strings.ToLower), nil
+	})
+
+	r.RegisterMapper("trim", func(pipeline.Params) (pipeline.Mapper, error) {
+		return textMapper(strings.TrimSpace), nil
+	})
+
+	r.RegisterMapper("prefix", func(p pipeline.Params) (pipeline.Mapper, error) {
+		var params struct {
+			Text string `json:"text"`
+		}
+
+		if err := p.Decode(&params); err != nil {
+			return nil, err
+		}
+
+		return textMapper(func(s string) string { return params.Text + s }), nil
+	})
+
+	r.RegisterMapper("replace", func(p pipeline.Params) (pipeline.Mapper, error) {
+		var params struct {
+			Pattern string `json:"pattern"`
+			With    string `json:"with"`
+		}
+
+		if err := p.Decode(&params); err != nil {
+			return nil, err
+		}
+
+		re, err := regexp.Compile(params.Pattern)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return textMapper(func(s string) string { return re.ReplaceAllString(s, params.With) }), nil
+	})
+
+	r.RegisterFlatMapper("split", func(p pipeline.Params) (pipeline.FlatMapper, error) {
+		var params struct {
+			Separator string `json:"separator"`
+		}
+
+		if err := p.Decode(&params); err != nil {
+			return nil, err
+		}
+
+		return pipeline.FlatMapperFunc(func(ctx context.Context) ([]context.Context, error) {
+			var parts []string
+
+			if params.Separator == "" {
+				parts = strings.Fields(textFromContext(ctx))
+			} else {
+				parts = strings.Split(textFromContext(ctx), params.Separator)
+			}
+
+			values := make([]context.Context, len(parts))
+
+			for i, part := range parts {
+				values[i] = withText(ctx, part)
+			}
+
+			return values, nil
+		}), nil
+	})
+
+	r.RegisterPredicate("match", func(p pipeline.Params) (pipeline.Predicate, error) {
+		var params struct {
+			Pattern string `json:"pattern"`
+			Invert  bool   `json:"invert"`
+		}
+
+		if err := p.Decode(&params); err != nil {
+			return nil, err
+		}
+
+		re, err := regexp.Compile(params.Pattern)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return func(ctx context.Context) bool {
+			return re.MatchString(textFromContext(ctx)) != params.Invert
+		}, nil
+	})
+
+	r.RegisterPredicate("nonempty", func(pipeline.Params) (pipeline.Predicate, error) {
+		return func(ctx context.Context) bool {
+			return strings.TrimSpace(textFromContext(ctx)) != ""
+		}, nil
+	})
+
+	// As a lone value is never reduced, count only counts two or more values
+	r.RegisterReducer("count", func(pipeline.Params) (pipeline.Reducer, error) {
+		return pipeline.ReducerFunc(func(ctx, acc context.Context) (context.Context, error) {
+			// The first value becomes the accumulator without being reduced,
+			// so counts one value
+			n, ok := acc.Value(countContextKey).(int)
+
+			if !ok {
+				n = 1
+			}
+
+			ctx = context.WithValue(ctx, countContextKey, n+1)
+
+			return withText(ctx, fmt.Sprint(n+1)), nil
+		}), nil
+	})
+
+	r.RegisterReducer("join", func(p pipeline.Params) (pipeline.Reducer, error) {
+		var params struct {
+			Separator string `json:"separator"`
+		}
+
+		if err := p.Decode(&params); err != nil {
+			return nil, err
+		}
+
+		return pipeline.ReducerFunc(func(ctx, acc context.Context) (context.Context, error) {
+			return withText(ctx, textFromContext(acc)+params.Separator+textFromContext(ctx)), nil
+		}), nil
+	})
+
+	r.RegisterSink("stdout", func(pipeline.Params) (func(context.Context) error, error) {
+		return env.writer("stdout", env.stdout), nil
+	})
+
+	r.RegisterSink("stderr", func(pipeline.Params) (func(context.Context) error, error) {
+		return env.writer("stderr", env.stderr), nil
+	})
+
+	r.RegisterSink("file", func(p pipeline.Params) (func(context.Context) error, error) {
+		var params struct {
+			Path   string `json:"path"`
+			Append bool   `json:"append"`
+		}
+
+		if err := p.Decode(&params); err != nil {
+			return nil, err
+		}
+
+		if params.Path == "" {
+			return nil, fmt.Errorf("A file sink needs a path")
+		}
+
+		if env.dryRun {
+			return env.writer("file "+params.Path, nil), nil
+		}
+
+		flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+
+		if params.Append {
+			flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		}
+
+		return env.writer("file "+params.Path, &lazyFile{env: env, path: params.Path, flags: flags}), nil
+	})
+}
+
+// lazyFile opens a file the first time it is written to, so that commands that
+// only build a pipeline, such as validate and graph, leave the file untouched
+type lazyFile struct {
+	env   *environment
+	path  string
+	flags int
+
+	once sync.Once
+	f    *os.File
+	err  error
+}
+
+func (l *lazyFile) Write(p []byte) (int, error) {
+	l.once.Do(func() {
+		if l.f, l.err = os.OpenFile(l.path, l.flags, 0644); l.err != nil {
+			return
+		}
+
+		l.env.mu.Lock()
+		l.env.closers = append(l.env.closers, l.f)
+		l.env.mu.Unlock()
+	})
+
+	if l.err != nil {
+		return 0, l.err
+	}
+
+	return l.f.Write(p)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bernos/go-pipeline/pipeline"
+	"github.com/bernos/go-pipeline/pipeline/stream"
+	"golang.org/x/net/context"
+)
+
+func testRegistry(env *environment) *pipeline.Registry {
+	r := pipeline.NewRegistry()
+	registerStages(r, env)
+	return r
+}
+
+func TestTextStages(t *testing.T) {
+	r := testRegistry(&environment{})
+
+	tests := []struct {
+		spec string
+		in   []string
+		want []string
+	}{
+		{`{"type": "map", "use": "replace", "params": {"pattern": "[0-9]+", "with": "#"}}`, []string{"a1b22"}, []string{"a#b#"}},
+		{`{"type": "map", "use": "trim"}`, []string{"  x "}, []string{"x"}},
+		{`{"type": "flatmap", "use": "split", "params": {"separator": ","}}`, []string{"a,b"}, []string{"a", "b"}},
+		{`{"type": "filter", "use": "match", "params": {"pattern": "^#", "invert": true}}`, []string{"#x", "y"}, []string{"y"}},
+		{`{"type": "reduce", "use": "count"}`, []string{"a", "b", "c"}, []string{"3"}},
+		{`{"type": "reduce", "use": "join", "params": {"separator": "+"}}`, []string{"a", "b", "c"}, []string{"a+b+c"}},
+	}
+
+	for _, test := range tests {
+		p, err := r.Load([]byte(`{"stages": [` + test.spec + `]}`))
+
+		if err != nil {
+			t.Errorf("%s: %s", test.spec, err.Error())
+			continue
+		}
+
+		var got []string
+
+		for ctx := range runText(p, test.in) {
+			got = append(got, textFromContext(ctx))
+		}
+
+		if len(got) != len(test.want) {
+			t.Errorf("%s: want %v, got %v", test.spec, test.want, got)
+			continue
+		}
+
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%s: want %v, got %v", test.spec, test.want, got)
+				break
+			}
+		}
+	}
+}
+
+func TestStdoutSink(t *testing.T) {
+	var buf bytes.Buffer
+
+	p, err := testRegistry(&environment{stdout: &buf}).Load([]byte(`{"stages": [{"type": "sink", "use": "stdout"}]}`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range runText(p, []string{"a", "b"}) {
+	}
+
+	if buf.String() != "a\nb\n" {
+		t.Errorf("Want a and b written to stdout, got %q", buf.String())
+	}
+}
+
+// runText sends lines through p, returning a channel of its output values
+func runText(p pipeline.Pipeline, lines []string) <-chan context.Context {
+	in, cls := stream.New()
+	out := p(in)
+
+	go func() {
+		defer cls()
+
+		for _, line := range lines {
+			in.Value(withText(context.Background(), line))
+		}
+	}()
+
+	go func() {
+		for range out.Errors() {
+		}
+	}()
+
+	return out.Values()
+}
@@ -1,6 +1,7 @@
 package job
 
 import (
+	"github.com/bernos/go-pipeline/pipeline"
 	"golang.org/x/net/context"
 )
 
@@ -8,9 +9,16 @@ type key int
 
 const jobKey key = 0
 
+func init() {
+	// Allow jobs to be checkpointed and sent between processes
+	pipeline.RegisterCodec("crawler.job", jobKey, pipeline.JSON(Job{}))
+}
+
 type Job struct {
-	URL  string
-	Body string
+	URL string `json:"url"`
+
+	// Body is not serialised, as it is downloaded again when a job is resumed
+	Body string `json:"-"`
 }
 
 func FromContext(ctx context.Context) (Job, bool) {
@@ -3,12 +3,14 @@ package main
 import (
 	"github.com/bernos/go-pipeline/examples/crawler/job"
 	"github.com/bernos/go-pipeline/pipeline"
-	"github.com/bernos/go-pipeline/pipeline/stream"
+	"github.com/bernos/go-pipeline/pipeline/httpstage"
 	// "github.com/bernos/go-pipeline/pipeline/stream"
-	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"regexp"
+	"syscall"
 	"time"
 
 	"golang.org/x/net/context"
@@ -19,22 +21,88 @@ var (
 )
 
 func main() {
+	// Checkpoint the crawl to disk, so that a restarted crawler carries on from
+	// where it left off rather than starting from scratch
+	checkpointer := pipeline.NewCheckpointer(pipeline.NewFileStore("checkpoints"), pipeline.DefaultCodecs)
+	dedupe := pipeline.NewDeduper(jobURL)
+
+	if err := checkpointer.Register("dedupe", dedupe); err != nil {
+		log.Fatal(err)
+	}
 
 	// A webcrawler pipeline that will recursively crawl a website, downloading content
 	// in parallel, and removing duplicate urls
 	crawler := pipeline.
-		PMap(fetchURL(&http.Client{}), 10).
-		Map(saveFile()).
-		FlatMap(findURLS()).
-		Filter(dedupe()).
-		Loop()
+		PMap(fetchURL(httpstage.NewMemoryCache()), 10).Named("fetch").
+		Map(saveFile()).Named("save").
+		FlatMap(findURLS()).Named("find-urls").
+		Filter(dedupe.Predicate()).Named("dedupe").
+		Loop().Named("crawl").
+		// Turn panics in any of our mappers into errors on the pipeline
+		// error channel
+		WithMiddleware(pipeline.Middlewares{
+			Mappers:     []pipeline.Middleware{pipeline.Recover()},
+			FlatMappers: []pipeline.FlatMapperMiddleware{pipeline.RecoverFlatMapper()},
+		})
+
+	log.Printf("Crawler pipeline:\n%s", pipeline.Describe(crawler))
+
+	// Configure a timeout using the context. The pipeline will be stopped when
+	// the context times out
+	metrics := pipeline.NewMetrics()
+	ctx, cancel := context.WithTimeout(pipeline.WithCheckpointer(pipeline.WithMetrics(context.Background(), metrics), checkpointer), time.Second*15)
+
+	// Resume from the last checkpoint, or point the crawler at wikipedia if
+	// there isn't one
+	out := crawler.StartWith(ctx, func(ctx context.Context) []context.Context {
+		jobs, err := checkpointer.Restore(ctx)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if len(jobs) == 0 {
+			jobs = append(jobs, job.NewContext(ctx, job.Job{URL: "http://www.wikipedia.com"}))
+		}
+
+		log.Printf("Starting crawl with %d jobs\n", len(jobs))
+
+		return jobs
+	})
+
+	go func() {
+		for err := range checkpointer.SaveEvery(ctx, time.Second*5) {
+			log.Printf("Error saving checkpoint: %s\n", err.Error())
+		}
+	}()
+
+	// Expose per-stage metrics for prometheus to scrape, and an admin page
+	// for monitoring and controlling the crawler while it runs
+	http.Handle("/metrics", pipeline.PrometheusHandler(metrics))
+	http.Handle("/admin/", http.StripPrefix("/admin", pipeline.AdminHandler(out)))
+
+	go func() {
+		log.Println(http.ListenAndServe(":8080", nil))
+	}()
+
+	// On SIGTERM or interrupt, save the links still to be crawled, then stop
+	// crawling new links, but give fetches that are already in progress a
+	// chance to finish
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+		<-sigs
 
-	// Point the crawler at wikipedia, and configure a timeout using the context
-	ctx, cancel := context.WithTimeout(job.NewContext(context.Background(), job.Job{URL: "http://www.wikipedia.com"}), time.Second*15)
+		out.Pause()
 
-	in, cls := stream.New()
-	out := crawler(in)
-	in.Value(ctx)
+		if err := checkpointer.Save(); err != nil {
+			log.Printf("Error saving checkpoint: %s\n", err.Error())
+		}
+
+		if abandoned, err := out.Drain(time.Second * 5); err != nil {
+			log.Printf("Error: %s, abandoned %d jobs\n", err.Error(), len(abandoned))
+		}
+	}()
 
 	// Start a go routine to monitor for errors on the pipeline error channel.
 	// For now we will just stop the pipeline, using the cancel func for our
@@ -46,12 +114,6 @@ func main() {
 		}
 	}()
 
-	// Close the input stream when the context times out
-	go func() {
-		<-ctx.Done()
-		cls()
-	}()
-
 	// Print out the pipeline output
 	for ctx := range out.Values() {
 		j, _ := job.FromContext(ctx)
@@ -61,46 +123,40 @@ func main() {
 	log.Println("Done!")
 }
 
-// dedupe returns a pipeline Predicate that returns false if we have seen the
-// URL to be crawled before
-func dedupe() pipeline.Predicate {
-	history := make(map[string]bool)
-
-	return func(ctx context.Context) bool {
-		seen := false
-
-		if j, ok := job.FromContext(ctx); ok {
-			seen = history[j.URL]
-			// log.Printf("Seen %s - %t", j.URL, seen)
-			history[j.URL] = true
-		}
-
-		return !seen
-	}
+// jobURL identifies jobs by their URL, so that we don't crawl the same URL twice
+func jobURL(ctx context.Context) string {
+	j, _ := job.FromContext(ctx)
+	return j.URL
 }
 
 // fetchURL returns a pipeline Mapper that fetches the content for a URL and
-// adds it to the job in the context
-func fetchURL(client *http.Client) pipeline.Mapper {
-	return job.Mapper(func(j job.Job) (job.Job, error) {
-		log.Printf("fetching %s\n", j.URL)
-
-		resp, err := client.Get(j.URL)
-
-		if err != nil {
-			return j, err
-		}
+// adds it to the job in the context. No more than 2 requests are made to a
+// single host at once, and pages that haven't changed since they were last
+// fetched are read from the cache
+func fetchURL(cache httpstage.Cache) pipeline.Mapper {
+	fetch := httpstage.Fetch(httpstage.Options{
+		Request: func(ctx context.Context) (*http.Request, error) {
+			j, _ := job.FromContext(ctx)
+			log.Printf("fetching %s\n", j.URL)
+			return http.NewRequest("GET", j.URL, nil)
+		},
+		MaxPerHost:  2,
+		MaxBodySize: 5 << 20,
+		Cache:       cache,
+	})
 
-		defer resp.Body.Close()
-		body, err := ioutil.ReadAll(resp.Body)
+	return pipeline.MapperFunc(func(ctx context.Context) (context.Context, error) {
+		ctx, err := fetch.Map(ctx)
 
 		if err != nil {
-			return j, err
+			return nil, err
 		}
 
-		j.Body = string(body)
+		j, _ := job.FromContext(ctx)
+		resp, _ := httpstage.ResponseFromContext(ctx)
+		j.Body = string(resp.Body)
 
-		return j, nil
+		return job.NewContext(ctx, j), nil
 	})
 }
 
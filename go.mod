@@ -0,0 +1,8 @@
+module github.com/bernos/go-pipeline
+
+go 1.23.0
+
+require (
+	golang.org/x/net v0.40.0
+	gopkg.in/yaml.v3 v3.0.1
+)
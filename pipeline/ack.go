@@ -0,0 +1,142 @@
+package pipeline
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+type ackKey int
+
+const ackContextKey ackKey = 0
+
+// acker holds the acknowledgement callbacks of a value. Only the first call to
+// ack or nack has any effect
+type acker struct {
+	once sync.Once
+	ack  func()
+	nack func(error)
+}
+
+func (a *acker) done(err error, nacked bool) {
+	a.once.Do(func() {
+		if !nacked {
+			if a.ack != nil {
+				a.ack()
+			}
+		} else if a.nack != nil {
+			a.nack(err)
+		}
+	})
+}
+
+// WithAck returns a copy of ctx carrying acknowledgement callbacks. Sources that
+// need to know whether their values have been processed, such as Durable or a
+// source that commits offsets, add callbacks to the context of each value they
+// send. Built-in stages pass the callbacks on to the values they produce:
+//
+//	Map     the output value acks or nacks the input value. If the Mapper
+//	        fails, the input value is nacked
+//	FlatMap the input value is acked once all of the output values are acked,
+//	        or nacked as soon as any of them is nacked. If the FlatMapper
+//	        fails or returns no values, the input value is nacked or acked
+//	Filter  values that are filtered out are acked
+//	Batch   acking or nacking a batch acks or nacks each value in it
+//	Sink    values are acked once the sink func succeeds, or nacked if it
+//	        fails
+//	Durable values are acked once they have been persisted, or nacked if
+//	        they could not be
+//
+// Either of ack or nack may be nil. Only the first call to Ack or Nack for a
+// value has any effect
+func WithAck(ctx context.Context, ack func(), nack func(error)) context.Context {
+	return withAcker(ctx, &acker{ack: ack, nack: nack})
+}
+
+// Ack acknowledges that the value carried by ctx has been fully processed. Ack
+// does nothing if ctx carries no callbacks
+func Ack(ctx context.Context) {
+	if a := ackerFromContext(ctx); a != nil {
+		a.done(nil, false)
+	}
+}
+
+// Nack reports that the value carried by ctx could not be processed. Nack does
+// nothing if ctx carries no callbacks
+func Nack(ctx context.Context, err error) {
+	if a := ackerFromContext(ctx); a != nil {
+		a.done(err, true)
+	}
+}
+
+func withAcker(ctx context.Context, a *acker) context.Context {
+	return context.WithValue(ctx, ackContextKey, a)
+}
+
+func ackerFromContext(ctx context.Context) *acker {
+	a, _ := ctx.Value(ackContextKey).(*acker)
+	return a
+}
+
+// inheritAck returns a copy of to that acks or nacks from, unless it already
+// does so. Values created from scratch by a Mapper do not carry the callbacks
+// of the value they were mapped from
+func inheritAck(from, to context.Context) context.Context {
+	if a := ackerFromContext(from); a != nil && ackerFromContext(to) != a {
+		return withAcker(to, a)
+	}
+
+	return to
+}
+
+// ackAll returns copies of values which together ack parent once all of them
+// have been acked, or nack it as soon as any of them is nacked. If there are no
+// values, parent is acked straight away
+func ackAll(parent context.Context, values []context.Context) []context.Context {
+	a := ackerFromContext(parent)
+
+	if a == nil {
+		return values
+	}
+
+	if len(values) == 0 {
+		a.done(nil, false)
+		return values
+	}
+
+	var (
+		mu        sync.Mutex
+		remaining = len(values)
+		children  = make([]context.Context, len(values))
+	)
+
+	for i, v := range values {
+		children[i] = WithAck(v, func() {
+			mu.Lock()
+			remaining--
+			last := remaining == 0
+			mu.Unlock()
+
+			if last {
+				a.done(nil, false)
+			}
+		}, func(err error) {
+			a.done(err, true)
+		})
+	}
+
+	return children
+}
+
+// ackEach returns a copy of ctx that acks or nacks each of values
+func ackEach(ctx context.Context, values []context.Context) context.Context {
+	return WithAck(ctx, func() {
+		for _, v := range values {
+			Ack(v)
+		}
+	}, func(err error) {
+		for _, v := range values {
+			Nack(v, err)
+		}
+	})
+}
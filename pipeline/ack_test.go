@@ -0,0 +1,175 @@
+package pipeline
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/bernos/go-pipeline/pipeline/stream"
+	"golang.org/x/net/context"
+)
+
+// ackRecorder records the acks and nacks of values
+type ackRecorder struct {
+	mu     sync.Mutex
+	acked  []int
+	nacked []int
+}
+
+func (r *ackRecorder) value(x int) context.Context {
+	return WithAck(NewContext(context.Background(), x), func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.acked = append(r.acked, x)
+	}, func(error) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.nacked = append(r.nacked, x)
+	})
+}
+
+func (r *ackRecorder) counts() (int, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.acked), len(r.nacked)
+}
+
+// runAck sends values through pl, and returns its output values once the
+// pipeline has finished
+func runAck(pl Pipeline, values ...context.Context) []context.Context {
+	in, cls := stream.New()
+	out := pl(in)
+
+	go func() {
+		defer cls()
+		for _, v := range values {
+			in.Value(v)
+		}
+	}()
+
+	go func() {
+		for range out.Errors() {
+		}
+	}()
+
+	var got []context.Context
+
+	for ctx := range out.Values() {
+		got = append(got, ctx)
+	}
+
+	return got
+}
+
+func TestAckOnlyOnce(t *testing.T) {
+	r := &ackRecorder{}
+	ctx := r.value(1)
+
+	Ack(ctx)
+	Ack(ctx)
+	Nack(ctx, errors.New("Failed"))
+
+	if acked, nacked := r.counts(); acked != 1 || nacked != 0 {
+		t.Errorf("Want 1 ack and 0 nacks, got %d and %d", acked, nacked)
+	}
+
+	// Contexts without callbacks are ignored
+	Ack(context.Background())
+	Nack(context.Background(), errors.New("Failed"))
+}
+
+func TestMapAck(t *testing.T) {
+	r := &ackRecorder{}
+
+	// Values created from scratch still ack their input
+	fresh := MapperFunc(func(ctx context.Context) (context.Context, error) {
+		if FromContext(ctx) == 2 {
+			return nil, errors.New("Failed")
+		}
+		return NewContext(context.Background(), FromContext(ctx)), nil
+	})
+
+	got := runAck(Map(fresh), r.value(1), r.value(2))
+
+	if len(got) != 1 {
+		t.Fatalf("Want %d values, got %d", 1, len(got))
+	}
+
+	Ack(got[0])
+
+	if acked, nacked := r.counts(); acked != 1 || nacked != 1 {
+		t.Errorf("Want 1 ack and 1 nack, got %d and %d", acked, nacked)
+	}
+}
+
+func TestFlatMapAck(t *testing.T) {
+	r := &ackRecorder{}
+
+	split := FlatMapperFunc(func(ctx context.Context) ([]context.Context, error) {
+		var values []context.Context
+
+		for i := 0; i < FromContext(ctx); i++ {
+			values = append(values, NewContext(ctx, i))
+		}
+
+		return values, nil
+	})
+
+	got := runAck(FlatMap(split), r.value(0), r.value(2), r.value(3))
+
+	// Values with no children are acked straight away
+	if acked, nacked := r.counts(); acked != 1 || nacked != 0 {
+		t.Errorf("Want 1 ack and 0 nacks, got %d and %d", acked, nacked)
+	}
+
+	Ack(got[0])
+
+	if acked, _ := r.counts(); acked != 1 {
+		t.Errorf("Want value to be acked only once all children are acked")
+	}
+
+	Ack(got[1])
+	Ack(got[2])
+	Nack(got[3], errors.New("Failed"))
+
+	if acked, nacked := r.counts(); acked != 2 || nacked != 1 {
+		t.Errorf("Want 2 acks and 1 nack, got %d and %d", acked, nacked)
+	}
+}
+
+func TestFilterAck(t *testing.T) {
+	r := &ackRecorder{}
+
+	odd := func(ctx context.Context) bool {
+		return FromContext(ctx)%2 == 1
+	}
+
+	got := runAck(Filter(odd), r.value(1), r.value(2))
+
+	if acked, _ := r.counts(); acked != 1 || r.acked[0] != 2 {
+		t.Errorf("Want the filtered value to be acked, got %v", r.acked)
+	}
+
+	Ack(got[0])
+
+	if acked, _ := r.counts(); acked != 2 {
+		t.Errorf("Want %d acks, got %d", 2, acked)
+	}
+}
+
+func TestSinkAck(t *testing.T) {
+	r := &ackRecorder{}
+
+	sink := Sink(func(ctx context.Context) error {
+		if FromContext(ctx) == 2 {
+			return errors.New("Failed")
+		}
+		return nil
+	})
+
+	runAck(sink, r.value(1), r.value(2))
+
+	if acked, nacked := r.counts(); acked != 1 || nacked != 1 {
+		t.Errorf("Want 1 ack and 1 nack, got %d and %d", acked, nacked)
+	}
+}
@@ -0,0 +1,129 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+)
+
+// AdminHandler creates an http.Handler that serves the state of e, along with
+// actions to control it. Paths are matched exactly, so the handler should be
+// mounted on a path ending in a slash, with that path stripped from requests,
+// for example
+//
+//	http.Handle("/admin/", http.StripPrefix("/admin", pipeline.AdminHandler(e)))
+//
+// It serves the following paths
+//
+//	GET  /        the stages and state of the execution as an HTML page
+//	GET  /stats   the stages and state of the execution as JSON
+//	POST /pause   pause the execution
+//	POST /resume  resume the execution
+//	POST /cancel  cancel the execution
+func AdminHandler(e *Execution) http.Handler {
+	return &admin{e}
+}
+
+type admin struct {
+	execution *Execution
+}
+
+func (a *admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/stats":
+		a.stats(w, r)
+	case "/pause":
+		a.action(w, r, a.execution.Pause)
+	case "/resume":
+		a.action(w, r, a.execution.Resume)
+	case "/cancel":
+		a.action(w, r, a.execution.Cancel)
+	case "/":
+		a.index(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (a *admin) stats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(a.execution.Stats()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// action performs fn in response to a POST, then redirects back to the index
+func (a *admin) action(w http.ResponseWriter, r *http.Request, fn func()) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fn()
+
+	http.Redirect(w, r, "./", http.StatusSeeOther)
+}
+
+func (a *admin) index(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	if err := adminTemplate.Execute(w, a.execution.Stats()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+var adminTemplate = template.Must(template.New("admin").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>Pipeline</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 0.25em 0.5em; text-align: left; vertical-align: top; }
+form { display: inline; }
+pre { margin: 0; white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>Pipeline</h1>
+<p>
+Started {{.Started.Format "2006-01-02 15:04:05"}}.
+{{if .Finished}}Finished.{{else if .Cancelled}}Cancelling.{{else if .Draining}}Draining.{{else if .Paused}}Paused.{{else}}Running.{{end}}
+{{.Goroutines}} goroutines.
+</p>
+<p>
+<form method="post" action="pause"><button>Pause</button></form>
+<form method="post" action="resume"><button>Resume</button></form>
+<form method="post" action="cancel"><button>Cancel</button></form>
+<a href="stats">JSON</a>
+</p>
+<h2>Stages</h2>
+<table>
+<tr><th>Stage</th><th>Type</th><th>Workers</th><th>Items</th><th>Errors</th><th>In flight</th><th>Sample</th></tr>
+{{range .Stages}}
+<tr>
+<td style="padding-left: calc({{.Depth}} * 1.5em + 0.5em)">{{.Name}}</td>
+<td>{{.Type}}</td>
+<td>{{.Workers}}</td>
+<td>{{.Items}}</td>
+<td>{{.Errors}}</td>
+<td>{{.InFlight}}</td>
+<td>{{range .Samples}}<pre>{{.}}</pre>{{end}}</td>
+</tr>
+{{end}}
+</table>
+<h2>Recent errors</h2>
+{{if .Errors}}
+<table>
+<tr><th>Time</th><th>Error</th></tr>
+{{range .Errors}}<tr><td>{{.Time.Format "15:04:05.000"}}</td><td>{{.Error}}</td></tr>
+{{end}}
+</table>
+{{else}}
+<p>None</p>
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,109 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestAdminHandler(t *testing.T) {
+	identity := MapperFunc(func(ctx context.Context) (context.Context, error) {
+		return ctx, nil
+	})
+
+	e := Map(identity).Named("identity").Start(context.Background())
+	defer e.Cancel()
+
+	<-e.Values()
+
+	mux := http.NewServeMux()
+	mux.Handle("/admin/", http.StripPrefix("/admin", AdminHandler(e)))
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/admin/stats")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stats ExecutionStats
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	resp.Body.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stats.Stages) != 1 || stats.Stages[0].Name != "identity" || stats.Stages[0].Items != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	resp, err = http.Get(server.URL + "/admin/")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if !strings.Contains(string(body), ">identity</td>") {
+		t.Errorf("Expected HTML to show stage, got\n%s", body)
+	}
+
+	resp, err = http.Post(server.URL+"/admin/cancel", "", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	select {
+	case <-e.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for execution to be cancelled")
+	}
+}
+
+func TestAdminHandlerRequiresPost(t *testing.T) {
+	e := Map(MapperFunc(func(ctx context.Context) (context.Context, error) {
+		return ctx, nil
+	})).Start(context.Background())
+	defer e.Cancel()
+
+	rec := httptest.NewRecorder()
+	AdminHandler(e).ServeHTTP(rec, httptest.NewRequest("GET", "/cancel", nil))
+
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Want %d, got %d", http.StatusMethodNotAllowed, rec.Code)
+	}
+}
+
+func TestAdminHandlerMatchesExactPaths(t *testing.T) {
+	e := Map(MapperFunc(func(ctx context.Context) (context.Context, error) {
+		return ctx, nil
+	})).Start(context.Background())
+	defer e.Cancel()
+
+	for _, path := range []string{"/jobs/cancel", "/cancel/", "/other/"} {
+		rec := httptest.NewRecorder()
+		AdminHandler(e).ServeHTTP(rec, httptest.NewRequest("POST", path, nil))
+
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s: want %d, got %d", path, http.StatusNotFound, rec.Code)
+		}
+	}
+
+	if e.Stats().Cancelled {
+		t.Error("Expected execution not to be cancelled")
+	}
+}
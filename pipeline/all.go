@@ -0,0 +1,49 @@
+//go:build go1.23
+
+package pipeline
+
+import (
+	"iter"
+
+	"github.com/bernos/go-pipeline/pipeline/stream"
+	"golang.org/x/net/context"
+)
+
+// All returns an iterator over the values and errors sent on out, so that the
+// output of a pipeline can be consumed with a single range loop
+//
+//	for ctx, err := range pipeline.All(p.Run(ctx)) {
+//		if err != nil {
+//			log.Println(err)
+//			continue
+//		}
+//		...
+//	}
+//
+// Each iteration yields either a value with a nil error, or a nil value with an
+// error. Iteration ends once out is closed. Breaking out of the loop early stops
+// reading from out, so the pipeline should then be stopped, for example by
+// cancelling its context
+func All(out stream.Stream) iter.Seq2[context.Context, error] {
+	return func(yield func(context.Context, error) bool) {
+		values, errs := out.Values(), out.Errors()
+
+		for values != nil || errs != nil {
+			select {
+			case ctx, ok := <-values:
+				if !ok {
+					values = nil
+				} else if !yield(ctx, nil) {
+					return
+				}
+
+			case err, ok := <-errs:
+				if !ok {
+					errs = nil
+				} else if !yield(nil, err) {
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,45 @@
+//go:build go1.23
+
+package pipeline
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/bernos/go-pipeline/pipeline/stream"
+	"golang.org/x/net/context"
+)
+
+func TestAll(t *testing.T) {
+	odd := MapperFunc(func(ctx context.Context) (context.Context, error) {
+		if FromContext(ctx)%2 == 0 {
+			return nil, errors.New("Even")
+		}
+		return ctx, nil
+	})
+
+	in, cls := stream.New()
+	out := Map(odd)(in)
+
+	go func() {
+		defer cls()
+		for i := 1; i <= 4; i++ {
+			in.Value(NewContext(context.Background(), i))
+		}
+	}()
+
+	sum, failures := 0, 0
+
+	for ctx, err := range All(out) {
+		if err != nil {
+			failures++
+			continue
+		}
+
+		sum += FromContext(ctx)
+	}
+
+	if sum != 4 || failures != 2 {
+		t.Errorf("Want sum %d and %d errors, got %d and %d", 4, 2, sum, failures)
+	}
+}
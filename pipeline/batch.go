@@ -0,0 +1,94 @@
+package pipeline
+
+import (
+	"time"
+
+	"github.com/bernos/go-pipeline/pipeline/stream"
+	"golang.org/x/net/context"
+)
+
+type batchKey int
+
+const batchContextKey batchKey = 0
+
+// Batch creates a Pipeline that groups values from its input stream in to
+// batches of up to n values. A batch is sent once it is full, once d has passed
+// since its first value was received, or once the input stream is closed. If d
+// is zero, batches are only sent when full or when the input stream is closed.
+// Each batch is sent as a context derived from its first value, from which the
+// values in the batch can be retrieved using BatchFromContext. Acking or nacking
+// the batch acks or nacks each of its values
+func Batch(n int, d time.Duration) Pipeline {
+	return newStage("Batch", 1, nil, func(s *stage, in stream.Stream) stream.Stream {
+		out, cls := in.WithValues(make(chan context.Context))
+
+		go func() {
+			defer cls()
+
+			var (
+				info       = s.info(0)
+				batch      []context.Context
+				activities []*activity
+				timer      *time.Timer
+				timeout    <-chan time.Time
+			)
+
+			flush := func() {
+				if timer != nil {
+					timer.Stop()
+					timer, timeout = nil, nil
+				}
+
+				joinHandOff(batch)
+
+				ctx := context.WithValue(batch[0], batchContextKey, batch)
+				out.Value(ackEach(ctx, batch))
+
+				for _, a := range activities {
+					a.end()
+				}
+
+				batch, activities = nil, nil
+			}
+
+			for {
+				select {
+				case ctx, ok := <-in.Values():
+					if !ok {
+						if len(batch) > 0 {
+							flush()
+						}
+
+						return
+					}
+
+					ctx, a := begin(ctx, info)
+					a.processed(nil)
+
+					batch = append(batch, ctx)
+					activities = append(activities, a)
+
+					if len(batch) == 1 && d > 0 {
+						timer = time.NewTimer(d)
+						timeout = timer.C
+					}
+
+					if len(batch) >= n {
+						flush()
+					}
+
+				case <-timeout:
+					flush()
+				}
+			}
+		}()
+
+		return out
+	})
+}
+
+// BatchFromContext retrieves the values in a batch created by Batch
+func BatchFromContext(ctx context.Context) ([]context.Context, bool) {
+	values, ok := ctx.Value(batchContextKey).([]context.Context)
+	return values, ok
+}
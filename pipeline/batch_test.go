@@ -0,0 +1,70 @@
+package pipeline
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bernos/go-pipeline/pipeline/stream"
+	"golang.org/x/net/context"
+)
+
+func batchValues(ctx context.Context) []int {
+	values, _ := BatchFromContext(ctx)
+	ints := make([]int, len(values))
+
+	for i, v := range values {
+		ints[i] = FromContext(v)
+	}
+
+	return ints
+}
+
+func TestBatch(t *testing.T) {
+	var values []context.Context
+
+	for i := 1; i <= 5; i++ {
+		values = append(values, NewContext(context.Background(), i))
+	}
+
+	var got [][]int
+
+	for _, ctx := range runAck(Batch(2, 0), values...) {
+		got = append(got, batchValues(ctx))
+	}
+
+	if want := fmt.Sprint([][]int{{1, 2}, {3, 4}, {5}}); fmt.Sprint(got) != want {
+		t.Errorf("Want %s, got %v", want, got)
+	}
+}
+
+func TestBatchTimeout(t *testing.T) {
+	in, cls := stream.New()
+	out := Batch(10, time.Millisecond*10)(in)
+
+	defer cls()
+
+	go func() {
+		in.Value(NewContext(context.Background(), 1))
+	}()
+
+	select {
+	case ctx := <-out.Values():
+		if want := fmt.Sprint([]int{1}); fmt.Sprint(batchValues(ctx)) != want {
+			t.Errorf("Want %s, got %v", want, batchValues(ctx))
+		}
+	case <-time.After(time.Second):
+		t.Error("Timed out waiting for batch")
+	}
+}
+
+func TestBatchAck(t *testing.T) {
+	r := &ackRecorder{}
+	got := runAck(Batch(3, 0), r.value(1), r.value(2), r.value(3))
+
+	Ack(got[0])
+
+	if acked, nacked := r.counts(); acked != 3 || nacked != 0 {
+		t.Errorf("Want 3 acks and 0 nacks, got %d and %d", acked, nacked)
+	}
+}
@@ -0,0 +1,451 @@
+package pipeline
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// BreakerState is the state of a circuit breaker
+type BreakerState int
+
+const (
+	// BreakerClosed lets values through, while counting failures
+	BreakerClosed BreakerState = iota
+
+	// BreakerOpen fails values straight away, without mapping them
+	BreakerOpen
+
+	// BreakerHalfOpen lets a limited number of values through to probe
+	// whether the Mapper has recovered
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+
+	return fmt.Sprintf("BreakerState(%d)", int(s))
+}
+
+// Defaults used by CircuitBreaker for fields of BreakerConfig that are not set
+const (
+	DefaultBreakerWindow       = 10 * time.Second
+	DefaultBreakerBuckets      = 10
+	DefaultBreakerMinRequests  = 10
+	DefaultBreakerFailureRate  = 0.5
+	DefaultBreakerOpenTimeout  = 30 * time.Second
+	DefaultBreakerProbes       = 1
+	DefaultBreakerProbeTimeout = 30 * time.Second
+	DefaultBreakerIdleTimeout  = 10 * time.Minute
+)
+
+// BreakerConfig configures a circuit breaker
+type BreakerConfig struct {
+	// Window is the period over which failures are counted. It is split in
+	// to Buckets, and the oldest bucket is discarded as the window rolls
+	// forward
+	Window  time.Duration
+	Buckets int
+
+	// MinRequests is the number of values that must be mapped within the
+	// window before the breaker can open
+	MinRequests int
+
+	// FailureRate is the fraction of values within the window, between 0 and
+	// 1, that must fail for the breaker to open
+	FailureRate float64
+
+	// OpenTimeout is how long the breaker stays open before half-opening
+	OpenTimeout time.Duration
+
+	// Probes is the number of values let through while half-open. If they
+	// all succeed the breaker closes, and if any fails it opens again
+	Probes int
+
+	// ProbeTimeout is how long a probe can go without a result before it
+	// counts as failed, opening the breaker again. Its result is ignored if
+	// it returns later
+	ProbeTimeout time.Duration
+
+	// IsFailure reports whether an error counts as a failure. By default
+	// every error does
+	IsFailure func(error) bool
+
+	// Key, if set, groups values so that each group has its own breaker, one
+	// per host for example. Breakers are created as keys are first seen
+	Key func(context.Context) string
+
+	// IdleTimeout is how long the breaker for a key can go unused before it
+	// is discarded, starting again closed if the key is seen again. Open
+	// breakers are kept until they could half-open
+	IdleTimeout time.Duration
+
+	// OnStateChange, if set, is called each time a breaker changes state.
+	// Changes to the breaker for a key are reported one at a time, in the
+	// order they happened
+	OnStateChange func(key string, from, to BreakerState)
+}
+
+// CircuitOpenError is returned by a circuit breaker for values that are not
+// mapped because the breaker is open
+type CircuitOpenError struct {
+	Key string
+}
+
+func (e *CircuitOpenError) Error() string {
+	if e.Key == "" {
+		return "Circuit breaker is open"
+	}
+
+	return fmt.Sprintf("Circuit breaker %s is open", e.Key)
+}
+
+// Breaker is a Mapper that stops calling a failing Mapper for a while. See
+// CircuitBreaker
+type Breaker struct {
+	m   Mapper
+	cfg BreakerConfig
+	now func() time.Time
+
+	mu       sync.Mutex
+	breakers map[string]*breaker
+	swept    time.Time
+}
+
+// CircuitBreaker creates a Mapper that maps values with m, unless m has been
+// failing. Failures are counted over a rolling window, and once at least
+// cfg.MinRequests values have been mapped within it and the fraction of them
+// that failed reaches cfg.FailureRate, the breaker opens. While open, values fail
+// straight away with a *CircuitOpenError. After cfg.OpenTimeout the breaker
+// half-opens, letting cfg.Probes values through to test whether m has recovered.
+// The breaker closes if they all succeed, or opens again if any fails
+func CircuitBreaker(m Mapper, cfg BreakerConfig) *Breaker {
+	if cfg.Window <= 0 {
+		cfg.Window = DefaultBreakerWindow
+	}
+
+	if cfg.Buckets <= 0 || time.Duration(cfg.Buckets) > cfg.Window {
+		cfg.Buckets = DefaultBreakerBuckets
+	}
+
+	if cfg.MinRequests <= 0 {
+		cfg.MinRequests = DefaultBreakerMinRequests
+	}
+
+	if cfg.FailureRate <= 0 {
+		cfg.FailureRate = DefaultBreakerFailureRate
+	}
+
+	if cfg.OpenTimeout <= 0 {
+		cfg.OpenTimeout = DefaultBreakerOpenTimeout
+	}
+
+	if cfg.Probes <= 0 {
+		cfg.Probes = DefaultBreakerProbes
+	}
+
+	if cfg.ProbeTimeout <= 0 {
+		cfg.ProbeTimeout = DefaultBreakerProbeTimeout
+	}
+
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = DefaultBreakerIdleTimeout
+	}
+
+	if cfg.IsFailure == nil {
+		cfg.IsFailure = func(error) bool { return true }
+	}
+
+	return &Breaker{
+		m:        m,
+		cfg:      cfg,
+		now:      time.Now,
+		breakers: make(map[string]*breaker),
+	}
+}
+
+// Map satisfies the Mapper interface
+func (b *Breaker) Map(ctx context.Context) (context.Context, error) {
+	var key string
+
+	if b.cfg.Key != nil {
+		key = b.cfg.Key(ctx)
+	}
+
+	br := b.acquire(key)
+	defer b.release(br)
+
+	gen, slot, err := b.allow(br, key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := b.m.Map(ctx)
+	b.record(br, key, gen, slot, err != nil && b.cfg.IsFailure(err))
+
+	return value, err
+}
+
+// State returns the state of the breaker for key. Use an empty key if the
+// breaker is not keyed
+func (b *Breaker) State(key string) BreakerState {
+	br := b.acquire(key)
+	defer b.release(br)
+
+	br.mu.Lock()
+	defer br.mu.Unlock()
+
+	return br.state
+}
+
+// acquire returns the breaker for key, creating it if need be. The breaker is
+// not discarded until it is released
+func (b *Breaker) acquire(key string) *breaker {
+	now := b.now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.cfg.Key != nil && now.Sub(b.swept) >= b.cfg.IdleTimeout {
+		b.sweep(now)
+	}
+
+	br, ok := b.breakers[key]
+
+	if !ok {
+		br = &breaker{
+			buckets: make([]breakerBucket, b.cfg.Buckets),
+			probes:  make([]time.Time, b.cfg.Probes),
+		}
+		b.breakers[key] = br
+	}
+
+	br.mu.Lock()
+	br.users++
+	br.mu.Unlock()
+
+	return br
+}
+
+// release marks the end of a use of a breaker returned by acquire
+func (b *Breaker) release(br *breaker) {
+	now := b.now()
+
+	br.mu.Lock()
+	br.users--
+	br.used = now
+	br.mu.Unlock()
+}
+
+// sweep discards the breakers that have been idle for IdleTimeout. It is called
+// with the lock held
+func (b *Breaker) sweep(now time.Time) {
+	b.swept = now
+
+	for key, br := range b.breakers {
+		br.mu.Lock()
+
+		idle := br.users == 0 && now.Sub(br.used) >= b.cfg.IdleTimeout &&
+			(br.state != BreakerOpen || now.Sub(br.openedAt) >= b.cfg.OpenTimeout)
+
+		br.mu.Unlock()
+
+		if idle {
+			delete(b.breakers, key)
+		}
+	}
+}
+
+// breaker is the state of a single breaker
+type breaker struct {
+	mu       sync.Mutex
+	state    BreakerState
+	buckets  []breakerBucket
+	openedAt time.Time
+
+	// Incremented on every change of state, so that results of values let
+	// through in an earlier state are ignored
+	gen int
+
+	// When each probe slot was taken while half-open, or zero if the slot is
+	// free or its probe has returned, and the number of probes that succeeded
+	probes    []time.Time
+	taken     int
+	successes int
+
+	// Values using the breaker, and when it was last used
+	users int
+	used  time.Time
+
+	// Changes of state waiting to be reported, and a lock held while they are
+	// so that they are reported in order
+	changes  []breakerChange
+	notifyMu sync.Mutex
+}
+
+// breakerChange is a change of state of a breaker
+type breakerChange struct {
+	from, to BreakerState
+}
+
+// breakerBucket counts the results within one slot of the rolling window
+type breakerBucket struct {
+	slot      int64
+	successes int
+	failures  int
+}
+
+// allow reports whether a value can be mapped, returning the breaker's
+// generation and the probe slot taken by the value if so
+func (b *Breaker) allow(br *breaker, key string) (int, int, error) {
+	defer b.notify(br, key)
+
+	br.mu.Lock()
+	defer br.mu.Unlock()
+
+	now := b.now()
+
+	if br.state == BreakerOpen && now.Sub(br.openedAt) >= b.cfg.OpenTimeout {
+		br.transition(BreakerHalfOpen)
+	}
+
+	if br.state == BreakerHalfOpen && br.taken == len(br.probes) {
+		// A probe that has not returned in time counts as failed, so
+		// that it can't hold the breaker half-open forever
+		for _, at := range br.probes {
+			if !at.IsZero() && now.Sub(at) >= b.cfg.ProbeTimeout {
+				br.transition(BreakerOpen)
+				br.openedAt = now
+				break
+			}
+		}
+	}
+
+	switch br.state {
+	case BreakerOpen:
+		return 0, 0, &CircuitOpenError{key}
+	case BreakerHalfOpen:
+		if br.taken == len(br.probes) {
+			return 0, 0, &CircuitOpenError{key}
+		}
+
+		slot := br.taken
+		br.probes[slot] = now
+		br.taken++
+
+		return br.gen, slot, nil
+	}
+
+	return br.gen, 0, nil
+}
+
+// record records the result of mapping a value let through by allow
+func (b *Breaker) record(br *breaker, key string, gen, slot int, failed bool) {
+	defer b.notify(br, key)
+
+	br.mu.Lock()
+	defer br.mu.Unlock()
+
+	if gen != br.gen {
+		return
+	}
+
+	switch br.state {
+	case BreakerClosed:
+		var (
+			now  = b.now()
+			size = int64(b.cfg.Window) / int64(b.cfg.Buckets)
+			slot = now.UnixNano() / size
+			bkt  = &br.buckets[slot%int64(len(br.buckets))]
+		)
+
+		if bkt.slot != slot {
+			*bkt = breakerBucket{slot: slot}
+		}
+
+		if failed {
+			bkt.failures++
+		} else {
+			bkt.successes++
+		}
+
+		var total, failures int
+
+		for _, bk := range br.buckets {
+			if bk.slot > slot-int64(len(br.buckets)) {
+				total += bk.successes + bk.failures
+				failures += bk.failures
+			}
+		}
+
+		if total >= b.cfg.MinRequests && float64(failures)/float64(total) >= b.cfg.FailureRate {
+			br.transition(BreakerOpen)
+			br.openedAt = now
+		}
+
+	case BreakerHalfOpen:
+		br.probes[slot] = time.Time{}
+
+		if failed {
+			br.transition(BreakerOpen)
+			br.openedAt = b.now()
+		} else if br.successes++; br.successes >= len(br.probes) {
+			br.transition(BreakerClosed)
+		}
+	}
+}
+
+// notify reports the changes of state of br to OnStateChange. Changes are
+// queued with the lock of br held, and reported in turn by whichever caller
+// holds notifyMu, so that they are reported in the order they happened
+func (b *Breaker) notify(br *breaker, key string) {
+	br.notifyMu.Lock()
+	defer br.notifyMu.Unlock()
+
+	for {
+		br.mu.Lock()
+
+		if len(br.changes) == 0 {
+			br.mu.Unlock()
+			return
+		}
+
+		c := br.changes[0]
+		br.changes = br.changes[1:]
+		br.mu.Unlock()
+
+		if b.cfg.OnStateChange != nil {
+			b.cfg.OnStateChange(key, c.from, c.to)
+		}
+	}
+}
+
+// transition changes the state of the breaker, queueing the change to be
+// reported. It is called with the lock held
+func (br *breaker) transition(to BreakerState) {
+	br.changes = append(br.changes, breakerChange{br.state, to})
+	br.state = to
+	br.gen++
+	br.taken = 0
+	br.successes = 0
+
+	for i := range br.probes {
+		br.probes[i] = time.Time{}
+	}
+
+	if to == BreakerClosed {
+		for i := range br.buckets {
+			br.buckets[i] = breakerBucket{}
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// testBreaker creates a breaker around a Mapper that fails values of zero or
+// less, with a clock that is moved forward by the returned func
+func testBreaker(cfg BreakerConfig) (*Breaker, func(time.Duration)) {
+	m := MapperFunc(func(ctx context.Context) (context.Context, error) {
+		if FromContext(ctx) <= 0 {
+			return nil, errors.New("Failed")
+		}
+		return ctx, nil
+	})
+
+	return testClock(CircuitBreaker(m, cfg))
+}
+
+// testClock gives b a clock that is moved forward by the returned func
+func testClock(b *Breaker) (*Breaker, func(time.Duration)) {
+	var (
+		mu    sync.Mutex
+		clock = time.Unix(1000, 0)
+	)
+
+	b.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return clock
+	}
+
+	return b, func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		clock = clock.Add(d)
+	}
+}
+
+func mapInt(b *Breaker, x int) error {
+	_, err := b.Map(NewContext(context.Background(), x))
+	return err
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var transitions []string
+
+	b, advance := testBreaker(BreakerConfig{
+		Window:      time.Second * 10,
+		MinRequests: 4,
+		FailureRate: 0.5,
+		OpenTimeout: time.Second * 5,
+		Probes:      2,
+		OnStateChange: func(key string, from, to BreakerState) {
+			transitions = append(transitions, fmt.Sprintf("%s->%s", from, to))
+		},
+	})
+
+	// Too few values to open, even though most fail
+	mapInt(b, 1)
+	mapInt(b, 0)
+	mapInt(b, 0)
+
+	if b.State("") != BreakerClosed {
+		t.Fatalf("Want closed, got %s", b.State(""))
+	}
+
+	mapInt(b, 0)
+
+	if b.State("") != BreakerOpen {
+		t.Fatalf("Want open, got %s", b.State(""))
+	}
+
+	var open *CircuitOpenError
+
+	if err := mapInt(b, 1); !errors.As(err, &open) {
+		t.Errorf("Want CircuitOpenError, got %v", err)
+	}
+
+	// Once the timeout passes, probes are let through. A failed probe opens
+	// the breaker again
+	advance(time.Second * 5)
+
+	if err := mapInt(b, 0); err == nil || errors.As(err, &open) {
+		t.Errorf("Want probe to fail, got %v", err)
+	}
+
+	if b.State("") != BreakerOpen {
+		t.Fatalf("Want open after failed probe, got %s", b.State(""))
+	}
+
+	// Successful probes close it
+	advance(time.Second * 5)
+
+	for i := 0; i < 2; i++ {
+		if err := mapInt(b, 1); err != nil {
+			t.Errorf("Want probe %d to succeed, got %v", i, err)
+		}
+	}
+
+	if b.State("") != BreakerClosed {
+		t.Fatalf("Want closed after successful probes, got %s", b.State(""))
+	}
+
+	want := "[closed->open open->half-open half-open->open open->half-open half-open->closed]"
+
+	if got := fmt.Sprint(transitions); got != want {
+		t.Errorf("Want transitions %s, got %s", want, got)
+	}
+}
+
+func TestCircuitBreakerWindow(t *testing.T) {
+	b, advance := testBreaker(BreakerConfig{
+		Window:      time.Second * 10,
+		MinRequests: 2,
+	})
+
+	mapInt(b, 0)
+
+	// The first failure falls out of the window
+	advance(time.Second * 11)
+	mapInt(b, 0)
+
+	if b.State("") != BreakerClosed {
+		t.Errorf("Want closed once old failures leave the window, got %s", b.State(""))
+	}
+
+	mapInt(b, 0)
+
+	if b.State("") != BreakerOpen {
+		t.Errorf("Want open, got %s", b.State(""))
+	}
+}
+
+func TestCircuitBreakerKey(t *testing.T) {
+	b, _ := testBreaker(BreakerConfig{
+		MinRequests: 1,
+		IsFailure: func(err error) bool {
+			return err.Error() == "Failed"
+		},
+		Key: func(ctx context.Context) string {
+			if FromContext(ctx)%2 == 0 {
+				return "even"
+			}
+			return "odd"
+		},
+	})
+
+	mapInt(b, 0)
+
+	if b.State("even") != BreakerOpen || b.State("odd") != BreakerClosed {
+		t.Errorf("Want only the even breaker open, got %s and %s", b.State("even"), b.State("odd"))
+	}
+
+	if err := mapInt(b, 1); err != nil {
+		t.Errorf("Want odd values to be mapped, got %v", err)
+	}
+
+	err := mapInt(b, 2)
+
+	if open, ok := err.(*CircuitOpenError); !ok || open.Key != "even" {
+		t.Errorf("Want CircuitOpenError for even, got %v", err)
+	}
+}
+
+func TestCircuitBreakerIdleKeys(t *testing.T) {
+	b, advance := testBreaker(BreakerConfig{
+		MinRequests: 1,
+		OpenTimeout: time.Second * 5,
+		IdleTimeout: time.Minute,
+		Key: func(ctx context.Context) string {
+			return fmt.Sprint(FromContext(ctx))
+		},
+	})
+
+	for i := -2; i < 3; i++ {
+		mapInt(b, i)
+	}
+
+	advance(time.Minute)
+	mapInt(b, 1)
+
+	// Only the breaker just used is kept
+	if len(b.breakers) != 1 || b.breakers["1"] == nil {
+		t.Errorf("Want only breaker 1 kept, got %v", b.breakers)
+	}
+
+	// Open breakers are kept until they could half-open
+	b, advance = testBreaker(BreakerConfig{
+		MinRequests: 1,
+		OpenTimeout: time.Minute * 5,
+		IdleTimeout: time.Minute,
+		Key: func(ctx context.Context) string {
+			return fmt.Sprint(FromContext(ctx))
+		},
+	})
+
+	mapInt(b, 0)
+	advance(time.Minute * 2)
+	mapInt(b, 1)
+
+	if b.State("0") != BreakerOpen {
+		t.Errorf("Want breaker 0 still open, got %s", b.State("0"))
+	}
+
+	advance(time.Minute * 5)
+	mapInt(b, 1)
+
+	if _, ok := b.breakers["0"]; ok {
+		t.Error("Want breaker 0 discarded once it could half-open")
+	}
+}
+
+func TestCircuitBreakerProbeTimeout(t *testing.T) {
+	var (
+		started = make(chan struct{})
+		release = make(chan struct{})
+		stuck   = true
+	)
+
+	b, advance := testClock(CircuitBreaker(MapperFunc(func(ctx context.Context) (context.Context, error) {
+		if FromContext(ctx) <= 0 {
+			return nil, errors.New("Failed")
+		}
+		if stuck {
+			close(started)
+			<-release
+		}
+		return ctx, nil
+	}), BreakerConfig{
+		MinRequests:  1,
+		OpenTimeout:  time.Second * 5,
+		ProbeTimeout: time.Second * 10,
+	}))
+
+	mapInt(b, 0)
+	advance(time.Second * 5)
+
+	// The probe never returns, holding the only slot
+	done := make(chan error)
+	go func() { done <- mapInt(b, 1) }()
+	<-started
+
+	var open *CircuitOpenError
+
+	if err := mapInt(b, 1); !errors.As(err, &open) || b.State("") != BreakerHalfOpen {
+		t.Errorf("Want CircuitOpenError while the probe is out, got %v", err)
+	}
+
+	// Once the probe times out the breaker opens again, and the next probe
+	// can close it
+	advance(time.Second * 10)
+
+	if err := mapInt(b, 1); !errors.As(err, &open) || b.State("") != BreakerOpen {
+		t.Errorf("Want breaker to open once the probe times out, got %v and %s", err, b.State(""))
+	}
+
+	stuck = false
+	advance(time.Second * 5)
+
+	if err := mapInt(b, 1); err != nil || b.State("") != BreakerClosed {
+		t.Errorf("Want a new probe to close the breaker, got %v and %s", err, b.State(""))
+	}
+
+	// The late result of the stuck probe is ignored
+	close(release)
+
+	if err := <-done; err != nil || b.State("") != BreakerClosed {
+		t.Errorf("Want late probe to be ignored, got %v and %s", err, b.State(""))
+	}
+}
+
+func TestCircuitBreakerStateChangeOrder(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		last = BreakerClosed
+		bad  int
+	)
+
+	b, _ := testBreaker(BreakerConfig{
+		MinRequests: 1,
+		OpenTimeout: time.Nanosecond,
+		OnStateChange: func(key string, from, to BreakerState) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			if from != last {
+				bad++
+			}
+			last = to
+		},
+	})
+
+	b.now = time.Now
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 500; j++ {
+				mapInt(b, (i+j)%2)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	if bad > 0 || last != b.State("") {
+		t.Errorf("Want state changes reported in order, got %d out of order, ending %s with the breaker %s", bad, last, b.State(""))
+	}
+}
+
+func TestCircuitBreakerPipeline(t *testing.T) {
+	b, _ := testBreaker(BreakerConfig{MinRequests: 2})
+
+	input := make([]context.Context, 10)
+
+	for i := range input {
+		input[i] = NewContext(context.Background(), 0)
+	}
+
+	_, errs := runPipeline(Map(b), input)
+
+	var open int
+
+	for _, err := range errs {
+		if _, ok := err.(*CircuitOpenError); ok {
+			open++
+		}
+	}
+
+	if len(errs) != 10 || open != 8 {
+		t.Errorf("Want 10 errors, 8 from the open breaker, got %d and %d", len(errs), open)
+	}
+}
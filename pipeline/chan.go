@@ -0,0 +1,87 @@
+//go:build go1.18
+
+package pipeline
+
+import (
+	"sync"
+
+	"github.com/bernos/go-pipeline/pipeline/stream"
+	"golang.org/x/net/context"
+)
+
+// ToChan creates a Pipeline that sends each value from its input stream to ch,
+// converted by unbox. Values are acked once they have been sent, and nacked if
+// unbox fails, or if their context is done before ch accepts them. Both ch and
+// errs are closed once the input stream is closed.
+//
+// If errs is nil, errors from the input stream and from unbox are sent on the
+// output stream. Otherwise they are sent to errs, which must be read, and the
+// output stream carries no errors. The output stream never carries values
+func ToChan[T any](ch chan<- T, unbox func(context.Context) (T, error), errs chan<- error) Pipeline {
+	return newStage("ToChan", 1, nil, func(s *stage, in stream.Stream) stream.Stream {
+		var (
+			wg     sync.WaitGroup
+			out    stream.Stream
+			cls    stream.CloseFunc
+			report func(error)
+		)
+
+		if errs == nil {
+			out, cls = in.WithValues(make(chan context.Context))
+			report = out.Error
+		} else {
+			// Creating a child of in would take its errors, so errors
+			// are forwarded to errs instead
+			out, cls = stream.New()
+			report = func(err error) { errs <- err }
+
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				for err := range in.Errors() {
+					errs <- err
+				}
+			}()
+		}
+
+		go func() {
+			defer cls()
+			defer close(ch)
+
+			info := s.info(0)
+
+			for ctx := range in.Values() {
+				ctx, a := begin(ctx, info)
+				v, err := unbox(ctx)
+
+				if err == nil {
+					select {
+					case ch <- v:
+						Ack(ctx)
+					case <-ctx.Done():
+						err = ctx.Err()
+					}
+				}
+
+				a.processed(err)
+				a.handOff(0)
+
+				if err != nil {
+					Nack(ctx, err)
+					report(err)
+				}
+
+				a.end()
+			}
+
+			if errs != nil {
+				wg.Wait()
+				close(errs)
+			}
+		}()
+
+		return out
+	})
+}
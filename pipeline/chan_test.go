@@ -0,0 +1,101 @@
+//go:build go1.18
+
+package pipeline
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/bernos/go-pipeline/pipeline/stream"
+	"golang.org/x/net/context"
+)
+
+func unboxInt(ctx context.Context) (int, error) {
+	if x := FromContext(ctx); x >= 0 {
+		return x, nil
+	}
+
+	return 0, errors.New("Negative")
+}
+
+func TestToChan(t *testing.T) {
+	var (
+		r   = &ackRecorder{}
+		ch  = make(chan int)
+		sum = make(chan int)
+	)
+
+	go func() {
+		total := 0
+		for x := range ch {
+			total += x
+		}
+		sum <- total
+	}()
+
+	runAck(ToChan(ch, unboxInt, nil), r.value(1), r.value(-1), r.value(2))
+
+	if got := <-sum; got != 3 {
+		t.Errorf("Want %d, got %d", 3, got)
+	}
+
+	if acked, nacked := r.counts(); acked != 2 || nacked != 1 {
+		t.Errorf("Want 2 acks and 1 nack, got %d and %d", acked, nacked)
+	}
+}
+
+func TestToChanErrors(t *testing.T) {
+	var (
+		ch   = make(chan int, 1)
+		errs = make(chan error)
+	)
+
+	in, cls := stream.New()
+	out := ToChan(ch, unboxInt, errs)(in)
+
+	go func() {
+		defer cls()
+		in.Value(NewContext(context.Background(), -1))
+		in.Error(errors.New("Upstream"))
+	}()
+
+	var got []string
+
+	for err := range errs {
+		got = append(got, err.Error())
+	}
+
+	if len(got) != 2 || got[0] != "Negative" || got[1] != "Upstream" {
+		t.Errorf("Want errors %v, got %v", []string{"Negative", "Upstream"}, got)
+	}
+
+	if _, ok := <-ch; ok {
+		t.Error("Expected channel to be closed")
+	}
+
+	for range out.Values() {
+	}
+}
+
+func TestToChanCancelled(t *testing.T) {
+	var (
+		r           = &ackRecorder{}
+		ch          = make(chan int)
+		ctx, cancel = context.WithCancel(context.Background())
+	)
+
+	cancel()
+
+	value := WithAck(NewContext(ctx, 1), func() {}, func(error) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.nacked = append(r.nacked, 1)
+	})
+
+	// Nothing reads ch, so the value can only be dropped
+	runAck(ToChan(ch, unboxInt, nil), value)
+
+	if _, nacked := r.counts(); nacked != 1 {
+		t.Errorf("Want %d nack, got %d", 1, nacked)
+	}
+}
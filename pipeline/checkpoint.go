@@ -0,0 +1,497 @@
+package pipeline
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// ContextMarshaler converts the values carried by a context to bytes and back.
+// Only the values that are meaningful to the pipeline need to be preserved. A
+// CodecRegistry marshals the values registered with it
+type ContextMarshaler interface {
+	MarshalContext(context.Context) ([]byte, error)
+
+	// UnmarshalContext returns a copy of parent carrying the values in data
+	UnmarshalContext(parent context.Context, data []byte) (context.Context, error)
+}
+
+// Checkpoint is a snapshot of a running pipeline
+type Checkpoint struct {
+	Time time.Time
+
+	// Position of each named source, such as the number of values read from
+	// it. See Checkpointer.Offset
+	Offsets map[string]int64
+
+	// Values that were being processed by the pipeline, marshaled by a
+	// ContextMarshaler
+	Items [][]byte
+
+	// Snapshots of each registered Stateful stage
+	State map[string][]byte
+}
+
+// CheckpointStore saves and loads checkpoints
+type CheckpointStore interface {
+	Save(Checkpoint) error
+
+	// Load returns the most recently saved checkpoint, or nil if there is none
+	Load() (*Checkpoint, error)
+}
+
+// Stateful is implemented by stages that hold state which should survive a
+// restart, such as a Deduper
+type Stateful interface {
+	Snapshot() ([]byte, error)
+	Restore([]byte) error
+}
+
+// Checkpointer periodically saves the state of a pipeline to a CheckpointStore,
+// so that a restarted pipeline can resume from where it left off. A checkpoint
+// holds the values being processed by built-in stages, including those being fed
+// back by a Loop, the offsets of sources and the state of any registered
+// Stateful stages.
+//
+// Values are captured as they pass through built-in stages, and are kept until
+// the values produced from them have been begun by the next stage, so that a
+// value being handed from one stage to the next is not missed. Where both a
+// value and values derived from it are being processed, only the original value
+// is kept, so derived values may be produced again after a restart. A value
+// that is not begun by another stage before a second checkpoint is saved, such
+// as one that has left a pipeline that isn't run by an Execution, is no longer
+// kept. Stages
+// should be idempotent, or filter repeated values using a Deduper. Restored
+// values are used as the starting values of the pipeline, which suits pipelines
+// such as a Loop where any value can be processed from the start. Pausing the
+// pipeline before calling Save gives the most accurate checkpoint
+type Checkpointer struct {
+	store     CheckpointStore
+	marshaler ContextMarshaler
+
+	mu      sync.Mutex
+	parent  context.Context
+	offsets map[string]int64
+	state   map[string]Stateful
+	pending map[string][]byte
+
+	// Values being processed by built-in stages, or being handed on to the
+	// next stage, by span
+	inflight map[*checkpointSpan]context.Context
+}
+
+// NewCheckpointer creates a Checkpointer that saves checkpoints to store, using
+// m to marshal values
+func NewCheckpointer(store CheckpointStore, m ContextMarshaler) *Checkpointer {
+	return &Checkpointer{
+		store:     store,
+		marshaler: m,
+		parent:    context.Background(),
+		offsets:   make(map[string]int64),
+		state:     make(map[string]Stateful),
+		pending:   make(map[string][]byte),
+		inflight:  make(map[*checkpointSpan]context.Context),
+	}
+}
+
+// WithCheckpointer returns a copy of ctx in which c captures the values passing
+// through built-in stages. Spans are passed on to any Tracer already carried by
+// ctx
+func WithCheckpointer(ctx context.Context, c *Checkpointer) context.Context {
+	next, _ := TracerFromContext(ctx)
+	return WithTracer(ctx, &checkpointTracer{c, next})
+}
+
+// Register adds the state of s to checkpoints under key. If a checkpoint has
+// already been restored, s is restored from it straight away
+func (c *Checkpointer) Register(key string, s Stateful) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.state[key] = s
+
+	if data, ok := c.pending[key]; ok {
+		delete(c.pending, key)
+
+		if err := restoreState(s, c.parent, data); err != nil {
+			return fmt.Errorf("Unable to restore state of %s: %s", key, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// SetOffset records the position of the named source, such as the number of
+// values read from it. Sources that are able to resume from an offset use it to
+// record their progress. Checkpointer implements stream.Offsets, so it can be
+// passed to sources such as stream.FromReaderWithOffsets and
+// stream.TailWithOffsets
+func (c *Checkpointer) SetOffset(name string, n int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.offsets[name] = n
+}
+
+// Offset returns the position of the named source, as recorded by SetOffset or
+// restored from a checkpoint
+func (c *Checkpointer) Offset(name string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.offsets[name]
+}
+
+// Restore loads the latest checkpoint from the store, restoring offsets and the
+// state of registered stages. The values that were being processed are returned,
+// unmarshaled onto parent, ready to be used as the starting values of the
+// pipeline. If there is no checkpoint, Restore returns no values
+func (c *Checkpointer) Restore(parent context.Context) ([]context.Context, error) {
+	cp, err := c.store.Load()
+
+	if err != nil || cp == nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.parent = parent
+
+	for name, n := range cp.Offsets {
+		c.offsets[name] = n
+	}
+
+	for key, data := range cp.State {
+		if s, ok := c.state[key]; ok {
+			if err := restoreState(s, parent, data); err != nil {
+				return nil, fmt.Errorf("Unable to restore state of %s: %s", key, err.Error())
+			}
+		} else {
+			c.pending[key] = data
+		}
+	}
+
+	values := make([]context.Context, len(cp.Items))
+
+	for i, data := range cp.Items {
+		if values[i], err = c.marshaler.UnmarshalContext(parent, data); err != nil {
+			return nil, err
+		}
+	}
+
+	return values, nil
+}
+
+// Save a checkpoint to the store
+func (c *Checkpointer) Save() error {
+	c.mu.Lock()
+
+	cp := Checkpoint{
+		Time:    time.Now(),
+		Offsets: make(map[string]int64, len(c.offsets)),
+		State:   make(map[string][]byte, len(c.state)),
+	}
+
+	for name, n := range c.offsets {
+		cp.Offsets[name] = n
+	}
+
+	state := make(map[string]Stateful, len(c.state))
+
+	for key, s := range c.state {
+		state[key] = s
+	}
+
+	// Values that had already finished when the last checkpoint was saved,
+	// and have still not been begun by another stage, are assumed to have
+	// left the pipeline
+	for span := range c.inflight {
+		if span.saved {
+			delete(c.inflight, span)
+		}
+	}
+
+	inflight := make([]context.Context, 0, len(c.inflight))
+
+	for span, ctx := range c.inflight {
+		if !c.derived(span) {
+			inflight = append(inflight, ctx)
+		}
+
+		span.saved = span.ended
+	}
+
+	c.mu.Unlock()
+
+	for key, s := range state {
+		data, err := s.Snapshot()
+
+		if err != nil {
+			return fmt.Errorf("Unable to snapshot state of %s: %s", key, err.Error())
+		}
+
+		cp.State[key] = data
+	}
+
+	for _, ctx := range inflight {
+		data, err := c.marshaler.MarshalContext(ctx)
+
+		if err != nil {
+			return err
+		}
+
+		cp.Items = append(cp.Items, data)
+	}
+
+	return c.store.Save(cp)
+}
+
+// derived reports whether span is processing a value derived from another value
+// that is still being processed. It is called with the lock held
+func (c *Checkpointer) derived(span *checkpointSpan) bool {
+	for p := span.parent; p != nil; p = p.parent {
+		if _, ok := c.inflight[p]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SaveEvery saves a checkpoint every d until ctx is done. Errors are sent on the
+// returned channel, which is closed once ctx is done
+func (c *Checkpointer) SaveEvery(ctx context.Context, d time.Duration) <-chan error {
+	errs := make(chan error)
+
+	go func() {
+		defer close(errs)
+
+		ticker := time.NewTicker(d)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			if err := c.Save(); err != nil {
+				select {
+				case errs <- err:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return errs
+}
+
+// ReduceLeft creates a ReduceLeft Pipeline whose accumulator is saved in
+// checkpoints under key. An error is returned if the accumulator cannot be
+// restored from a checkpoint that has already been loaded
+func (c *Checkpointer) ReduceLeft(key string, r Reducer) (Pipeline, error) {
+	acc := &accumulator{}
+
+	if err := c.Register(key, &accumulatorState{c.marshaler, acc}); err != nil {
+		return nil, err
+	}
+
+	return reduceLeft(r, acc), nil
+}
+
+// contextState is implemented by Stateful stages whose state is a context, which
+// is restored on to the parent passed to Checkpointer.Restore
+type contextState interface {
+	restoreOnto(parent context.Context, data []byte) error
+}
+
+// restoreState restores s from data, on to parent if s is a contextState
+func restoreState(s Stateful, parent context.Context, data []byte) error {
+	if cs, ok := s.(contextState); ok {
+		return cs.restoreOnto(parent, data)
+	}
+
+	return s.Restore(data)
+}
+
+// accumulatorState makes the accumulator of a ReduceLeft stage Stateful
+type accumulatorState struct {
+	marshaler ContextMarshaler
+	acc       *accumulator
+}
+
+func (s *accumulatorState) Snapshot() ([]byte, error) {
+	if ctx := s.acc.get(); ctx != nil {
+		return s.marshaler.MarshalContext(ctx)
+	}
+
+	return nil, nil
+}
+
+func (s *accumulatorState) Restore(data []byte) error {
+	return s.restoreOnto(context.Background(), data)
+}
+
+func (s *accumulatorState) restoreOnto(parent context.Context, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	ctx, err := s.marshaler.UnmarshalContext(parent, data)
+
+	if err == nil {
+		s.acc.set(ctx)
+	}
+
+	return err
+}
+
+type checkpointKey int
+
+const checkpointSpanContextKey checkpointKey = 0
+
+// checkpointTracer captures values as they pass through built-in stages. Each
+// span is added to the context of its value, so that spans for derived values
+// can find their parent
+type checkpointTracer struct {
+	checkpointer *Checkpointer
+	next         Tracer
+}
+
+func (t *checkpointTracer) Start(ctx context.Context, info StageInfo) (context.Context, Span) {
+	span := &checkpointSpan{
+		checkpointer: t.checkpointer,
+		handoffs:     1,
+	}
+
+	span.parent, _ = ctx.Value(checkpointSpanContextKey).(*checkpointSpan)
+
+	if t.next != nil {
+		ctx, span.next = t.next.Start(ctx, info)
+	}
+
+	ctx = context.WithValue(ctx, checkpointSpanContextKey, span)
+
+	c := t.checkpointer
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The value has been handed on from the stage that produced it, which
+	// no longer needs to keep it
+	if span.parent != nil {
+		span.parent.begun++
+		c.release(span.parent)
+	}
+
+	c.inflight[span] = ctx
+
+	return ctx, span
+}
+
+// release stops keeping the value of span once the stage processing it has
+// finished and every value it produced has been begun by another stage. It is
+// called with the lock held
+func (c *Checkpointer) release(span *checkpointSpan) {
+	if span.ended && span.begun >= span.handoffs {
+		delete(c.inflight, span)
+
+		for _, s := range span.joined {
+			delete(c.inflight, s)
+		}
+	}
+}
+
+// handOff records that n more values than expected were produced from ctx by the
+// stage processing it, each of which is expected to be begun by another stage.
+// Stages are expected to produce a single value
+func handOff(ctx context.Context, n int) {
+	if span, ok := ctx.Value(checkpointSpanContextKey).(*checkpointSpan); ok {
+		c := span.checkpointer
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		span.handoffs += n
+		c.release(span)
+	}
+}
+
+// handedOut records that ctx has left the pipeline, so is no longer expected to
+// be begun by another stage
+func handedOut(ctx context.Context) {
+	if span, ok := ctx.Value(checkpointSpanContextKey).(*checkpointSpan); ok {
+		c := span.checkpointer
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		span.begun++
+		c.release(span)
+	}
+}
+
+// joinHandOff records that the values of ctxs were combined in to a single
+// value derived from the first of them, such as a batch, so are all kept until
+// it is begun by another stage
+func joinHandOff(ctxs []context.Context) {
+	first, ok := ctxs[0].Value(checkpointSpanContextKey).(*checkpointSpan)
+
+	if !ok {
+		return
+	}
+
+	c := first.checkpointer
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, ctx := range ctxs[1:] {
+		if span, ok := ctx.Value(checkpointSpanContextKey).(*checkpointSpan); ok {
+			first.joined = append(first.joined, span)
+		}
+	}
+}
+
+type checkpointSpan struct {
+	checkpointer *Checkpointer
+	parent       *checkpointSpan
+	next         Span
+
+	// The rest is guarded by the lock of the Checkpointer. The value is kept
+	// until the span has ended and the values produced from it have been
+	// begun by other stages, or until a checkpoint has been saved since the
+	// span ended, in case they never are
+	handoffs int
+	begun    int
+	ended    bool
+	saved    bool
+
+	// Spans of values that were combined with this one
+	joined []*checkpointSpan
+}
+
+func (s *checkpointSpan) SetError(err error) {
+	if s.next != nil {
+		s.next.SetError(err)
+	}
+}
+
+func (s *checkpointSpan) End() {
+	c := s.checkpointer
+
+	c.mu.Lock()
+	s.ended = true
+	c.release(s)
+	c.mu.Unlock()
+
+	if s.next != nil {
+		s.next.End()
+	}
+}
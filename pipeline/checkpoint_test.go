@@ -0,0 +1,415 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bernos/go-pipeline/pipeline/stream"
+	"golang.org/x/net/context"
+)
+
+// intMarshaler marshals the int values used by tests
+type intMarshaler struct{}
+
+func (intMarshaler) MarshalContext(ctx context.Context) ([]byte, error) {
+	return json.Marshal(FromContext(ctx))
+}
+
+func (intMarshaler) UnmarshalContext(parent context.Context, data []byte) (context.Context, error) {
+	var x int
+	err := json.Unmarshal(data, &x)
+	return NewContext(parent, x), err
+}
+
+type memoryStore struct {
+	mu          sync.Mutex
+	checkpoints []Checkpoint
+}
+
+func (s *memoryStore) Save(cp Checkpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkpoints = append(s.checkpoints, cp)
+	return nil
+}
+
+func (s *memoryStore) Load() (*Checkpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.checkpoints) == 0 {
+		return nil, nil
+	}
+
+	return &s.checkpoints[len(s.checkpoints)-1], nil
+}
+
+func TestCheckpointerSavesValuesInFlight(t *testing.T) {
+	var (
+		store   = &memoryStore{}
+		c       = NewCheckpointer(store, intMarshaler{})
+		started = make(chan struct{})
+		release = make(chan struct{})
+	)
+
+	block := MapperFunc(func(ctx context.Context) (context.Context, error) {
+		started <- struct{}{}
+		<-release
+		return ctx, nil
+	})
+
+	e := PMap(block, 2).Start(WithCheckpointer(NewContext(context.Background(), 42), c))
+	defer e.Cancel()
+
+	<-started
+
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	close(release)
+	<-e.Values()
+
+	values, err := NewCheckpointer(store, intMarshaler{}).Restore(context.Background())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(values) != 1 {
+		t.Fatalf("Want %d values, got %d", 1, len(values))
+	}
+
+	if got := FromContext(values[0]); got != 42 {
+		t.Errorf("Want %d, got %d", 42, got)
+	}
+}
+
+func TestCheckpointerSavesValuesBeingHandedOn(t *testing.T) {
+	var (
+		store    = &memoryStore{}
+		c        = NewCheckpointer(store, intMarshaler{})
+		rec      = NewRecorder()
+		received = make(chan struct{})
+		release  = make(chan struct{})
+	)
+
+	// Takes each value from the Map without beginning it, as if it were
+	// waiting to be begun by the next stage
+	hold := Pipeline(func(in stream.Stream) stream.Stream {
+		out, cls := in.WithValues(make(chan context.Context))
+
+		go func() {
+			defer cls()
+
+			for ctx := range in.Values() {
+				received <- struct{}{}
+				<-release
+				out.Value(ctx)
+			}
+		}()
+
+		return out
+	})
+
+	identity := MapperFunc(func(ctx context.Context) (context.Context, error) {
+		return ctx, nil
+	})
+
+	e := Map(identity).Compose(hold).Start(WithCheckpointer(WithTracer(NewContext(context.Background(), 42), rec), c))
+	defer e.Cancel()
+
+	<-received
+
+	// Wait for the Map to finish with the value
+	for spans := rec.Spans(); len(spans) == 0 || !spans[0].Ended(); spans = rec.Spans() {
+		time.Sleep(time.Millisecond)
+	}
+
+	items := func() []int {
+		if err := c.Save(); err != nil {
+			t.Fatal(err)
+		}
+
+		values, err := NewCheckpointer(store, intMarshaler{}).Restore(context.Background())
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []int
+
+		for _, ctx := range values {
+			got = append(got, FromContext(ctx))
+		}
+
+		return got
+	}
+
+	if got := items(); fmt.Sprint(got) != "[42]" {
+		t.Errorf("Want [42] while the value is handed on, got %v", got)
+	}
+
+	close(release)
+	<-e.Values()
+
+	if got := items(); len(got) != 0 {
+		t.Errorf("Want no values once the value has left the pipeline, got %v", got)
+	}
+}
+
+func TestCheckpointerResumesLoop(t *testing.T) {
+	var (
+		store = &memoryStore{}
+		limit = 5
+	)
+
+	// Counts up to limit, stopping early the first time the value 3 is seen,
+	// as if the process had been killed
+	count := func(c *Checkpointer, stop chan struct{}) Pipeline {
+		var once sync.Once
+
+		return FlatMap(FlatMapperFunc(func(ctx context.Context) ([]context.Context, error) {
+			x := FromContext(ctx)
+
+			if x == 3 {
+				once.Do(func() {
+					if err := c.Save(); err != nil {
+						t.Error(err)
+					}
+					close(stop)
+				})
+			}
+
+			if x == limit {
+				return nil, nil
+			}
+
+			return []context.Context{NewContext(ctx, x+1)}, nil
+		})).Loop()
+	}
+
+	c := NewCheckpointer(store, intMarshaler{})
+	stop := make(chan struct{})
+	e := count(c, stop).Start(WithCheckpointer(NewContext(context.Background(), 0), c))
+
+	go func() {
+		for range e.Values() {
+		}
+	}()
+
+	<-stop
+	e.Cancel()
+	<-e.Done()
+
+	c = NewCheckpointer(store, intMarshaler{})
+	e = count(c, make(chan struct{})).StartWith(WithCheckpointer(context.Background(), c), func(ctx context.Context) []context.Context {
+		values, err := c.Restore(ctx)
+
+		if err != nil {
+			t.Error(err)
+		}
+
+		return values
+	})
+
+	defer e.Cancel()
+
+	// Depending on how far values had got around the loop when the checkpoint
+	// was saved, some may be produced again, but the loop must not start from
+	// scratch
+	var got []int
+
+	for ctx := range e.Values() {
+		got = append(got, FromContext(ctx))
+
+		if FromContext(ctx) == limit {
+			break
+		}
+	}
+
+	if len(got) == 0 || got[0] < 2 || got[len(got)-1] != limit || len(got) != limit-got[0]+1 {
+		t.Errorf("Want values from at least 2 up to %d, got %v", limit, got)
+	}
+}
+
+func TestCheckpointerRestoresState(t *testing.T) {
+	store := &memoryStore{}
+	c := NewCheckpointer(store, intMarshaler{})
+	d := NewDeduper(func(ctx context.Context) string {
+		return fmt.Sprint(FromContext(ctx))
+	})
+
+	if err := c.Register("dedupe", d); err != nil {
+		t.Fatal(err)
+	}
+
+	d.Predicate()(NewContext(context.Background(), 1))
+	c.SetOffset("numbers", 7)
+
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	c = NewCheckpointer(store, intMarshaler{})
+
+	if _, err := c.Restore(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := c.Offset("numbers"); got != 7 {
+		t.Errorf("Want offset %d, got %d", 7, got)
+	}
+
+	// State registered after restoring is restored straight away
+	d = NewDeduper(func(ctx context.Context) string {
+		return fmt.Sprint(FromContext(ctx))
+	})
+
+	if err := c.Register("dedupe", d); err != nil {
+		t.Fatal(err)
+	}
+
+	if d.Predicate()(NewContext(context.Background(), 1)) {
+		t.Error("Expected restored deduper to have seen 1")
+	}
+}
+
+func TestCheckpointerReduceLeft(t *testing.T) {
+	store := &memoryStore{}
+	c := NewCheckpointer(store, intMarshaler{})
+	sum := func(c *Checkpointer, values ...int) int {
+		pl, err := c.ReduceLeft("sum", Sum())
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		in, cls := stream.New()
+		out := pl(in)
+
+		go func() {
+			defer cls()
+			for _, x := range values {
+				in.Value(NewContext(context.Background(), x))
+			}
+		}()
+
+		return FromContext(<-out.Values())
+	}
+
+	if got := sum(c, 1, 2, 3); got != 6 {
+		t.Errorf("Want %d, got %d", 6, got)
+	}
+
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	c = NewCheckpointer(store, intMarshaler{})
+
+	if _, err := c.Restore(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := sum(c, 4); got != 10 {
+		t.Errorf("Want %d, got %d", 10, got)
+	}
+}
+
+func TestCheckpointerReduceLeftRestoresOntoParent(t *testing.T) {
+	type key int
+
+	store := &memoryStore{}
+	store.Save(Checkpoint{State: map[string][]byte{"sum": []byte("6")}})
+
+	c := NewCheckpointer(store, intMarshaler{})
+	pl, err := c.ReduceLeft("sum", Sum())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Restore(context.WithValue(context.Background(), key(0), "parent")); err != nil {
+		t.Fatal(err)
+	}
+
+	in, cls := stream.New()
+	out := pl(in)
+	cls()
+
+	ctx := <-out.Values()
+
+	if FromContext(ctx) != 6 || ctx.Value(key(0)) != "parent" {
+		t.Errorf("Want accumulator of %d restored on to parent, got %d and %v", 6, FromContext(ctx), ctx.Value(key(0)))
+	}
+}
+
+func TestCheckpointerSaveEvery(t *testing.T) {
+	store := &memoryStore{}
+	c := NewCheckpointer(store, intMarshaler{})
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := c.SaveEvery(ctx, time.Millisecond)
+
+	time.Sleep(time.Millisecond * 20)
+	cancel()
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if cp, _ := store.Load(); cp == nil {
+		t.Error("Expected a checkpoint to have been saved")
+	}
+}
+
+func TestCheckpointerResumesSourceFromOffset(t *testing.T) {
+	var (
+		store = &memoryStore{}
+		input = "1\n2\n3\n"
+		c     = NewCheckpointer(store, intMarshaler{})
+	)
+
+	box := func(v interface{}) context.Context {
+		x, _ := strconv.Atoi(v.(string))
+		return NewContext(context.Background(), x)
+	}
+
+	out, cls := stream.FromReaderWithOffsets(strings.NewReader(input), nil, box, c, "input")
+	<-out.Values()
+	<-out.Values()
+	cls()
+
+	// Wait for the offset of the second line to be recorded
+	for i := 0; c.Offset("input") != 2 && i < 100; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := NewCheckpointer(store, intMarshaler{})
+
+	if _, err := restarted.Restore(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	out, cls = stream.FromReaderWithOffsets(strings.NewReader(input), nil, box, restarted, "input")
+	defer cls()
+
+	var got []int
+
+	for ctx := range out.Values() {
+		got = append(got, FromContext(ctx))
+	}
+
+	if want := fmt.Sprint([]int{3}); fmt.Sprint(got) != want {
+		t.Errorf("Want %s, got %v", want, got)
+	}
+}
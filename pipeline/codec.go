@@ -0,0 +1,220 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Codec encodes and decodes a value carried by a context
+type Codec interface {
+	Encode(v interface{}) ([]byte, error)
+	Decode(data []byte) (interface{}, error)
+}
+
+// JSON creates a Codec that encodes values as JSON. Decoded values have the same
+// type as prototype
+func JSON(prototype interface{}) Codec {
+	return jsonCodec{reflect.TypeOf(prototype)}
+}
+
+type jsonCodec struct {
+	typ reflect.Type
+}
+
+func (c jsonCodec) Encode(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (c jsonCodec) Decode(data []byte) (interface{}, error) {
+	v := reflect.New(c.typ)
+
+	if err := json.Unmarshal(data, v.Interface()); err != nil {
+		return nil, err
+	}
+
+	return v.Elem().Interface(), nil
+}
+
+// Gob creates a Codec that encodes values using encoding/gob. Decoded values have
+// the same type as prototype
+func Gob(prototype interface{}) Codec {
+	return gobCodec{reflect.TypeOf(prototype)}
+}
+
+type gobCodec struct {
+	typ reflect.Type
+}
+
+func (c gobCodec) Encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (c gobCodec) Decode(data []byte) (interface{}, error) {
+	v := reflect.New(c.typ)
+
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(v.Interface()); err != nil {
+		return nil, err
+	}
+
+	return v.Elem().Interface(), nil
+}
+
+// CodecRegistry marshals contexts to bytes and back, preserving the values of
+// registered context keys along with any deadline. It implements
+// ContextMarshaler
+type CodecRegistry struct {
+	mu     sync.RWMutex
+	byName map[string]*registeredCodec
+}
+
+type registeredCodec struct {
+	name  string
+	key   interface{}
+	codec Codec
+}
+
+// DefaultCodecs is the CodecRegistry used by RegisterCodec, MarshalContext and
+// UnmarshalContext
+var DefaultCodecs = NewCodecRegistry()
+
+// NewCodecRegistry creates an empty CodecRegistry
+func NewCodecRegistry() *CodecRegistry {
+	return &CodecRegistry{
+		byName: make(map[string]*registeredCodec),
+	}
+}
+
+// Register adds a codec for values stored in contexts under key. The name
+// identifies the value in marshaled contexts, so must be unique and should not
+// change once contexts have been saved. Packages that own unexported context keys
+// typically register them from an init func. Register panics if name is already
+// registered
+func (r *CodecRegistry) Register(name string, key interface{}, c Codec) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.byName[name]; ok {
+		panic(fmt.Sprintf("Codec %s is already registered", name))
+	}
+
+	r.byName[name] = &registeredCodec{name, key, c}
+}
+
+// marshaledContext is the wire format of a marshaled context
+type marshaledContext struct {
+	Deadline *time.Time        `json:"deadline,omitempty"`
+	Values   map[string][]byte `json:"values"`
+}
+
+// MarshalContext encodes the registered values carried by ctx, and its deadline,
+// as bytes. Values that are not registered are not included
+func (r *CodecRegistry) MarshalContext(ctx context.Context) ([]byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	m := marshaledContext{
+		Values: make(map[string][]byte),
+	}
+
+	if d, ok := ctx.Deadline(); ok {
+		m.Deadline = &d
+	}
+
+	for name, rc := range r.byName {
+		v := ctx.Value(rc.key)
+
+		if v == nil {
+			continue
+		}
+
+		data, err := rc.codec.Encode(v)
+
+		if err != nil {
+			return nil, fmt.Errorf("Unable to encode %s: %s", name, err.Error())
+		}
+
+		m.Values[name] = data
+	}
+
+	return json.Marshal(m)
+}
+
+// UnmarshalContext returns a copy of parent carrying the values and deadline in
+// data, which was created by MarshalContext. An error is returned if data holds a
+// value that is not registered
+func (r *CodecRegistry) UnmarshalContext(parent context.Context, data []byte) (context.Context, error) {
+	var m marshaledContext
+
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(m.Values))
+
+	for name := range m.Values {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	ctx := parent
+
+	for _, name := range names {
+		rc, ok := r.byName[name]
+
+		if !ok {
+			return nil, fmt.Errorf("No codec registered for %s", name)
+		}
+
+		v, err := rc.codec.Decode(m.Values[name])
+
+		if err != nil {
+			return nil, fmt.Errorf("Unable to decode %s: %s", name, err.Error())
+		}
+
+		ctx = context.WithValue(ctx, rc.key, v)
+	}
+
+	if m.Deadline != nil {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithDeadline(ctx, *m.Deadline)
+
+		// Release the context's resources once the deadline has passed
+		time.AfterFunc(m.Deadline.Sub(time.Now()), cancel)
+	}
+
+	return ctx, nil
+}
+
+// RegisterCodec adds a codec to DefaultCodecs. See CodecRegistry.Register
+func RegisterCodec(name string, key interface{}, c Codec) {
+	DefaultCodecs.Register(name, key, c)
+}
+
+// MarshalContext encodes ctx using DefaultCodecs
+func MarshalContext(ctx context.Context) ([]byte, error) {
+	return DefaultCodecs.MarshalContext(ctx)
+}
+
+// UnmarshalContext decodes data onto parent using DefaultCodecs
+func UnmarshalContext(parent context.Context, data []byte) (context.Context, error) {
+	return DefaultCodecs.UnmarshalContext(parent, data)
+}
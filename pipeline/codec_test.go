@@ -0,0 +1,93 @@
+package pipeline
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+type codecTestKey int
+
+const (
+	pointKey codecTestKey = iota
+	labelKey
+	unregisteredKey
+)
+
+type point struct {
+	X, Y int
+}
+
+func TestCodecRegistry(t *testing.T) {
+	for name, codec := range map[string]func(interface{}) Codec{"JSON": JSON, "Gob": Gob} {
+		r := NewCodecRegistry()
+		r.Register("point", pointKey, codec(point{}))
+		r.Register("label", labelKey, codec(""))
+
+		deadline := time.Now().Add(time.Hour).Round(0)
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+
+		ctx = context.WithValue(ctx, pointKey, point{1, 2})
+		ctx = context.WithValue(ctx, labelKey, "a")
+		ctx = context.WithValue(ctx, unregisteredKey, "b")
+
+		data, err := r.MarshalContext(ctx)
+
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		got, err := r.UnmarshalContext(context.Background(), data)
+
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		if p, _ := got.Value(pointKey).(point); p != (point{1, 2}) {
+			t.Errorf("%s: want %v, got %v", name, point{1, 2}, got.Value(pointKey))
+		}
+
+		if l, _ := got.Value(labelKey).(string); l != "a" {
+			t.Errorf("%s: want %q, got %v", name, "a", got.Value(labelKey))
+		}
+
+		if v := got.Value(unregisteredKey); v != nil {
+			t.Errorf("%s: want unregistered value to be dropped, got %v", name, v)
+		}
+
+		if d, ok := got.Deadline(); !ok || !d.Equal(deadline) {
+			t.Errorf("%s: want deadline %s, got %s", name, deadline, d)
+		}
+	}
+}
+
+func TestCodecRegistryUnknownValue(t *testing.T) {
+	r := NewCodecRegistry()
+	r.Register("label", labelKey, JSON(""))
+
+	data, err := r.MarshalContext(context.WithValue(context.Background(), labelKey, "a"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewCodecRegistry().UnmarshalContext(context.Background(), data); err == nil || !strings.Contains(err.Error(), "label") {
+		t.Errorf("Want error for unknown value, got %v", err)
+	}
+}
+
+func TestCodecRegistryDuplicateName(t *testing.T) {
+	r := NewCodecRegistry()
+	r.Register("label", labelKey, JSON(""))
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected registering a duplicate name to panic")
+		}
+	}()
+
+	r.Register("label", pointKey, JSON(point{}))
+}
@@ -0,0 +1,95 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// Deduper remembers the values it has seen, so that repeated values can be
+// filtered from a pipeline. Values are identified by a key, such as a URL. A
+// Deduper is Stateful, so the keys it has seen can be saved in checkpoints
+type Deduper struct {
+	key func(context.Context) string
+
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+// NewDeduper creates a Deduper that identifies values using key. Values for
+// which key returns an empty string are never considered to be repeats
+func NewDeduper(key func(context.Context) string) *Deduper {
+	return &Deduper{
+		key:  key,
+		seen: make(map[string]bool),
+	}
+}
+
+// Predicate returns a Predicate, for use with Filter, that is satisfied by values
+// that the Deduper has not seen before
+func (d *Deduper) Predicate() Predicate {
+	return func(ctx context.Context) bool {
+		key := d.key(ctx)
+
+		if key == "" {
+			return true
+		}
+
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		if d.seen[key] {
+			return false
+		}
+
+		d.seen[key] = true
+
+		return true
+	}
+}
+
+// Len returns the number of keys seen
+func (d *Deduper) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return len(d.seen)
+}
+
+// Snapshot satisfies the Stateful interface
+func (d *Deduper) Snapshot() ([]byte, error) {
+	d.mu.Lock()
+
+	keys := make([]string, 0, len(d.seen))
+
+	for key := range d.seen {
+		keys = append(keys, key)
+	}
+
+	d.mu.Unlock()
+
+	sort.Strings(keys)
+
+	return json.Marshal(keys)
+}
+
+// Restore satisfies the Stateful interface. Restored keys are added to any keys
+// already seen
+func (d *Deduper) Restore(data []byte) error {
+	var keys []string
+
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, key := range keys {
+		d.seen[key] = true
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package pipeline
+
+import (
+	"fmt"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestDeduper(t *testing.T) {
+	d := NewDeduper(func(ctx context.Context) string {
+		if x := FromContext(ctx); x != 0 {
+			return fmt.Sprint(x)
+		}
+		return ""
+	})
+
+	var got []int
+
+	for _, x := range []int{1, 2, 1, 0, 3, 2, 0} {
+		if d.Predicate()(NewContext(context.Background(), x)) {
+			got = append(got, x)
+		}
+	}
+
+	if want := fmt.Sprint([]int{1, 2, 0, 3, 0}); fmt.Sprint(got) != want {
+		t.Errorf("Want %s, got %v", want, got)
+	}
+
+	if d.Len() != 3 {
+		t.Errorf("Want %d keys, got %d", 3, d.Len())
+	}
+}
+
+func TestDeduperSnapshot(t *testing.T) {
+	key := func(ctx context.Context) string {
+		return fmt.Sprint(FromContext(ctx))
+	}
+
+	d := NewDeduper(key)
+	d.Predicate()(NewContext(context.Background(), 1))
+
+	data, err := d.Snapshot()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewDeduper(key)
+
+	if err := restored.Restore(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if restored.Predicate()(NewContext(context.Background(), 1)) {
+		t.Error("Expected restored deduper to have seen 1")
+	}
+
+	if !restored.Predicate()(NewContext(context.Background(), 2)) {
+		t.Error("Expected restored deduper not to have seen 2")
+	}
+}
@@ -11,7 +11,7 @@ import (
 // Delay creates a pipeline that waits for the specified duration between
 // pulling values from its input stream
 func Delay(d time.Duration) Pipeline {
-	return func(in stream.Stream) stream.Stream {
+	return newStage("Delay", 1, nil, func(s *stage, in stream.Stream) stream.Stream {
 		var (
 			out, cls = in.WithValues(make(chan context.Context))
 		)
@@ -26,5 +26,5 @@ func Delay(d time.Duration) Pipeline {
 		}()
 
 		return out
-	}
+	})
 }
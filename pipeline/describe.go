@@ -0,0 +1,234 @@
+package pipeline
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/bernos/go-pipeline/pipeline/stream"
+)
+
+// Graph describes the stages of a Pipeline
+type Graph struct {
+	// Name of the pipeline, if it was built from a Spec with a name
+	Name string
+
+	// Stages of the pipeline, in the order that values pass through them
+	Stages []*Node
+
+	count int
+}
+
+// Node is a single stage in a Graph
+type Node struct {
+	// ID of the node, unique within its Graph
+	ID int
+
+	Name string
+	Type string
+
+	// Number of concurrent workers used by the stage
+	Workers int
+
+	// Stages of the pipeline wrapped by a Loop, Tee or Parallel stage
+	Stages []*Node
+
+	stage *stage
+}
+
+// Describe returns a Graph of the stages in p. Built-in stages describe
+// themselves, along with any pipelines they wrap. Any other pipeline is
+// described as a single opaque stage of type "Pipeline". Describing a pipeline
+// does not start it
+func Describe(p Pipeline) *Graph {
+	g := &Graph{}
+	d := newDescriber(g)
+	d.describe(p)
+	g.Stages = d.nodes
+
+	return g
+}
+
+// Label returns a human readable label for the node, such as "fetch (PMap x10)"
+func (n *Node) Label() string {
+	label := n.Type
+
+	if n.Workers > 1 {
+		label = fmt.Sprintf("%s x%d", label, n.Workers)
+	}
+
+	if n.Name != n.Type {
+		label = fmt.Sprintf("%s (%s)", n.Name, label)
+	}
+
+	return label
+}
+
+// String renders the graph as an indented text tree, suitable for logging
+func (g *Graph) String() string {
+	var buf bytes.Buffer
+	writeTree(&buf, g.Stages, 0)
+	return buf.String()
+}
+
+func writeTree(buf *bytes.Buffer, nodes []*Node, depth int) {
+	for _, n := range nodes {
+		fmt.Fprintf(buf, "%s%s\n", strings.Repeat("  ", depth), n.Label())
+		writeTree(buf, n.Stages, depth+1)
+	}
+}
+
+// DOT renders the graph in the Graphviz DOT language
+func (g *Graph) DOT() string {
+	var buf bytes.Buffer
+
+	fmt.Fprintln(&buf, "digraph pipeline {")
+	fmt.Fprintln(&buf, "\trankdir=LR;")
+
+	if g.Name != "" {
+		fmt.Fprintf(&buf, "\tlabel=%q;\n", g.Name)
+	}
+
+	fmt.Fprintln(&buf, "\tnode [shape=box];")
+	writeDOT(&buf, g.Stages, "\t")
+	fmt.Fprintln(&buf, "}")
+
+	return buf.String()
+}
+
+func writeDOT(buf *bytes.Buffer, nodes []*Node, indent string) {
+	for i, n := range nodes {
+		fmt.Fprintf(buf, "%sn%d [label=%q];\n", indent, n.ID, n.Label())
+
+		if i > 0 {
+			fmt.Fprintf(buf, "%sn%d -> n%d;\n", indent, nodes[i-1].ID, n.ID)
+		}
+
+		if len(n.Stages) > 0 {
+			fmt.Fprintf(buf, "%ssubgraph cluster_n%d {\n", indent, n.ID)
+			fmt.Fprintf(buf, "%s\tlabel=%q;\n", indent, n.Label())
+			writeDOT(buf, n.Stages, indent+"\t")
+			fmt.Fprintf(buf, "%s}\n", indent)
+
+			first, last := n.Stages[0], n.Stages[len(n.Stages)-1]
+			fmt.Fprintf(buf, "%sn%d -> n%d [style=dashed];\n", indent, n.ID, first.ID)
+
+			if n.Type != "Tee" {
+				fmt.Fprintf(buf, "%sn%d -> n%d [style=dashed];\n", indent, last.ID, n.ID)
+			}
+		}
+	}
+}
+
+var mermaidEscaper = strings.NewReplacer(`"`, "#quot;")
+
+// Mermaid renders the graph as a Mermaid flowchart
+func (g *Graph) Mermaid() string {
+	var buf bytes.Buffer
+
+	if g.Name != "" {
+		fmt.Fprintf(&buf, "---\ntitle: %s\n---\n", g.Name)
+	}
+
+	fmt.Fprintln(&buf, "flowchart LR")
+	writeMermaid(&buf, g.Stages, "\t")
+
+	return buf.String()
+}
+
+func writeMermaid(buf *bytes.Buffer, nodes []*Node, indent string) {
+	for i, n := range nodes {
+		fmt.Fprintf(buf, "%sn%d[\"%s\"]\n", indent, n.ID, mermaidEscaper.Replace(n.Label()))
+
+		if i > 0 {
+			fmt.Fprintf(buf, "%sn%d --> n%d\n", indent, nodes[i-1].ID, n.ID)
+		}
+
+		if len(n.Stages) > 0 {
+			fmt.Fprintf(buf, "%ssubgraph s%d [\"%s\"]\n", indent, n.ID, mermaidEscaper.Replace(n.Label()))
+			writeMermaid(buf, n.Stages, indent+"\t")
+			fmt.Fprintf(buf, "%send\n", indent)
+
+			first, last := n.Stages[0], n.Stages[len(n.Stages)-1]
+			fmt.Fprintf(buf, "%sn%d -.-> n%d\n", indent, n.ID, first.ID)
+
+			if n.Type != "Tee" {
+				fmt.Fprintf(buf, "%sn%d -.-> n%d\n", indent, last.ID, n.ID)
+			}
+		}
+	}
+}
+
+// describer is passed to a pipeline in place of a real stream in order to
+// describe it. Built-in stages recognise the describer, and add themselves to it
+// rather than starting. Any other pipeline will find the describer to be a
+// closed stream
+type describer struct {
+	stream.Stream
+	graph *Graph
+	nodes []*Node
+}
+
+func newDescriber(g *Graph) *describer {
+	s, cls := stream.New()
+	cls()
+
+	return &describer{
+		Stream: s,
+		graph:  g,
+	}
+}
+
+// describe adds the stages of p
+func (d *describer) describe(p Pipeline) {
+	if p(d) != stream.Stream(d) {
+		d.node("Pipeline", 1)
+	}
+}
+
+// namePipeline returns a pipeline that behaves like p, and gives the graph that
+// describes it a name
+func namePipeline(name string, p Pipeline) Pipeline {
+	return func(in stream.Stream) stream.Stream {
+		if d, ok := in.(*describer); ok {
+			// A pipeline's own name takes precedence over the names of
+			// the pipelines it is composed of
+			if d.graph.Name == "" {
+				d.graph.Name = name
+			}
+
+			d.describe(p)
+			return d
+		}
+
+		return p(in)
+	}
+}
+
+// add adds a built-in stage, along with the stages of the pipeline it wraps
+func (d *describer) add(s *stage, inner Pipeline) {
+	n := d.node(s.typ, s.workers)
+	n.Name = s.name
+	n.stage = s
+
+	if inner != nil {
+		child := newDescriber(d.graph)
+		child.describe(inner)
+		n.Stages = child.nodes
+	}
+}
+
+func (d *describer) node(t string, workers int) *Node {
+	d.graph.count++
+
+	n := &Node{
+		ID:      d.graph.count,
+		Name:    t,
+		Type:    t,
+		Workers: workers,
+	}
+
+	d.nodes = append(d.nodes, n)
+
+	return n
+}
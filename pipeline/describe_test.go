@@ -0,0 +1,168 @@
+package pipeline
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bernos/go-pipeline/pipeline/stream"
+	"golang.org/x/net/context"
+)
+
+func describeTestPipeline() Pipeline {
+	identity := MapperFunc(func(ctx context.Context) (context.Context, error) {
+		return ctx, nil
+	})
+
+	opaque := Pipeline(func(in stream.Stream) stream.Stream {
+		out, cls := in.WithValues(make(chan context.Context))
+
+		go func() {
+			defer cls()
+
+			for ctx := range in.Values() {
+				out.Value(ctx)
+			}
+		}()
+
+		return out
+	})
+
+	return PMap(identity, 4).Named("fetch").
+		Compose(Tee(Sink(func(ctx context.Context) error { return nil }))).
+		Compose(Loop(Map(identity).Compose(opaque))).Named("crawl")
+}
+
+func TestDescribe(t *testing.T) {
+	g := Describe(describeTestPipeline())
+
+	want := "" +
+		"fetch (PMap x4)\n" +
+		"Tee\n" +
+		"  Sink\n" +
+		"crawl (Loop)\n" +
+		"  Map\n" +
+		"  Pipeline\n"
+
+	if got := g.String(); got != want {
+		t.Errorf("Want\n%s\ngot\n%s", want, got)
+	}
+}
+
+func TestDescribeDOT(t *testing.T) {
+	dot := Describe(describeTestPipeline()).DOT()
+
+	for _, line := range []string{
+		"digraph pipeline {",
+		`n1 [label="fetch (PMap x4)"];`,
+		"n1 -> n2;",
+		"subgraph cluster_n4 {",
+		"n4 -> n5 [style=dashed];",
+		"n6 -> n4 [style=dashed];",
+	} {
+		if !strings.Contains(dot, line) {
+			t.Errorf("Expected DOT output to contain %s, got\n%s", line, dot)
+		}
+	}
+
+	if strings.Contains(dot, "n3 -> n2") {
+		t.Errorf("Expected no edge from Tee output back to the Tee, got\n%s", dot)
+	}
+}
+
+func TestDescribeMermaid(t *testing.T) {
+	mermaid := Describe(describeTestPipeline()).Mermaid()
+
+	for _, line := range []string{
+		"flowchart LR",
+		`n1["fetch (PMap x4)"]`,
+		"n2 --> n4",
+		`subgraph s4 ["crawl (Loop)"]`,
+		"n4 -.-> n5",
+	} {
+		if !strings.Contains(mermaid, line) {
+			t.Errorf("Expected Mermaid output to contain %s, got\n%s", line, mermaid)
+		}
+	}
+}
+
+func TestNamedStageIsReportedToMetrics(t *testing.T) {
+	metrics := NewMetrics()
+
+	identity := MapperFunc(func(ctx context.Context) (context.Context, error) {
+		return ctx, nil
+	})
+
+	input := []context.Context{WithMetrics(context.Background(), metrics)}
+	runPipeline(Map(identity).Named("identity"), input)
+
+	stages := metrics.Stages()
+
+	if len(stages) != 1 {
+		t.Fatalf("Want %d stages, got %d", 1, len(stages))
+	}
+
+	if stages[0].Name != "identity" {
+		t.Errorf("Want %s, got %s", "identity", stages[0].Name)
+	}
+}
+
+func TestNamingSharedStage(t *testing.T) {
+	metrics := NewMetrics()
+
+	identity := MapperFunc(func(ctx context.Context) (context.Context, error) {
+		return ctx, nil
+	})
+
+	shared := Map(identity)
+	first := shared.Named("first")
+	second := shared.Named("second")
+
+	if name := Describe(shared).Stages[0].Name; name != "Map" {
+		t.Errorf("Want %s, got %s", "Map", name)
+	}
+
+	if name := Describe(first).Stages[0].Name; name != "first" {
+		t.Errorf("Want %s, got %s", "first", name)
+	}
+
+	if name := Describe(second).Stages[0].Name; name != "second" {
+		t.Errorf("Want %s, got %s", "second", name)
+	}
+
+	input := []context.Context{WithMetrics(context.Background(), metrics)}
+	runPipeline(first, input)
+	runPipeline(second.Compose(shared), input)
+
+	names := make(map[string]uint64)
+
+	for _, s := range metrics.Stages() {
+		names[s.Name] += s.Items
+	}
+
+	if len(names) != 3 || names["first"] != 1 || names["second"] != 1 || names["Map"] != 1 {
+		t.Errorf("Want one value each for first, second and Map, got %v", names)
+	}
+}
+
+func TestNamedDescribesLazily(t *testing.T) {
+	calls := 0
+
+	p := Pipeline(func(in stream.Stream) stream.Stream {
+		calls++
+		return in
+	})
+
+	named := Named("opaque", p)
+
+	if calls != 0 {
+		t.Errorf("Want pipeline not to be described until needed, got %d calls", calls)
+	}
+
+	Describe(named)
+	Describe(named)
+
+	// Once to find the stage to name, and once for each description
+	if calls != 3 {
+		t.Errorf("Want %d calls, got %d", 3, calls)
+	}
+}
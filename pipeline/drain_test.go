@@ -0,0 +1,162 @@
+package pipeline
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestDrainLetsLoopFinish(t *testing.T) {
+	var (
+		started = make(chan struct{}, 1)
+		values  = make(chan int, 10)
+	)
+
+	slow := MapperFunc(func(ctx context.Context) (context.Context, error) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+
+		time.Sleep(time.Millisecond * 20)
+		return NewContext(ctx, FromContext(ctx)+1), nil
+	})
+
+	e := PMap(slow, 2).Loop().Start(NewContext(context.Background(), 0))
+
+	go func() {
+		for ctx := range e.Values() {
+			values <- FromContext(ctx)
+		}
+		close(values)
+	}()
+
+	<-started
+
+	abandoned, err := e.Drain(time.Second)
+
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+
+	if len(abandoned) != 0 {
+		t.Errorf("Want %d abandoned values, got %d", 0, len(abandoned))
+	}
+
+	// The value that was in flight when we started draining is still sent on
+	// the output stream
+	count := 0
+
+	for _ = range values {
+		count++
+	}
+
+	if count == 0 {
+		t.Error("Expected in flight value to be sent on the output stream")
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	started := make(chan struct{})
+
+	stuck := MapperFunc(func(ctx context.Context) (context.Context, error) {
+		close(started)
+		<-ctx.Done()
+		return ctx, nil
+	})
+
+	e := Map(stuck).Named("stuck").Start(NewContext(context.Background(), 42))
+
+	go func() {
+		for _ = range e.Values() {
+		}
+	}()
+
+	<-started
+
+	abandoned, err := e.Drain(time.Millisecond * 20)
+
+	if err != ErrDrainTimeout {
+		t.Errorf("Want %v, got %v", ErrDrainTimeout, err)
+	}
+
+	if len(abandoned) != 1 || FromContext(abandoned[0]) != 42 {
+		t.Errorf("Expected value 42 to be abandoned, got %v", abandoned)
+	}
+
+	select {
+	case <-e.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for execution to be cancelled")
+	}
+}
+
+func TestDrainTimeoutReturnsOriginalValues(t *testing.T) {
+	started := make(chan struct{})
+
+	split := FlatMapperFunc(func(ctx context.Context) ([]context.Context, error) {
+		x := FromContext(ctx)
+		return []context.Context{NewContext(ctx, x*10), NewContext(ctx, x*10+1)}, nil
+	})
+
+	stuck := MapperFunc(func(ctx context.Context) (context.Context, error) {
+		if FromContext(ctx) == 10 {
+			close(started)
+		}
+
+		<-ctx.Done()
+		return ctx, nil
+	})
+
+	// The FlatMap is still sending the second value derived from 1 while the
+	// first is stuck, so both stages are processing a value
+	e := FlatMap(split).Map(stuck).Start(NewContext(context.Background(), 1))
+
+	go func() {
+		for _ = range e.Values() {
+		}
+	}()
+
+	<-started
+
+	abandoned, err := e.Drain(time.Millisecond * 20)
+
+	if err != ErrDrainTimeout {
+		t.Errorf("Want %v, got %v", ErrDrainTimeout, err)
+	}
+
+	if len(abandoned) != 1 || FromContext(abandoned[0]) != 1 {
+		t.Errorf("Expected only value 1 to be abandoned, got %v", abandoned)
+	}
+}
+
+func TestTeeDrainsSecondaryPipeline(t *testing.T) {
+	identity := MapperFunc(func(ctx context.Context) (context.Context, error) {
+		return ctx, nil
+	})
+
+	inputs := make([]context.Context, 5)
+
+	for i := range inputs {
+		inputs[i] = NewContext(context.Background(), i)
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		values, _ := runPipeline(Tee(Map(identity)), inputs)
+
+		if len(values) != len(inputs) {
+			t.Errorf("Want %d values, got %d", len(inputs), len(values))
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for tee to finish")
+	}
+}
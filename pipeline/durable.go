@@ -0,0 +1,441 @@
+package pipeline
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/bernos/go-pipeline/pipeline/stream"
+	"golang.org/x/net/context"
+)
+
+// DefaultSegmentSize is the size, in bytes, at which a Durable stage starts a new
+// segment of its log
+const DefaultSegmentSize = 16 << 20
+
+// Durable creates a Pipeline that persists each value to an append-only log in
+// dir, using m to marshal it, before sending it on the output stream. Each input
+// value is acked once it has been persisted, or nacked if it could not be. Values
+// are removed from the log once they are acknowledged by calling Ack with their
+// context, or the context of a value derived from them. See WithAck. Values that
+// were nacked, or not acknowledged when the pipeline stopped, are sent again,
+// before any new input, the next time the pipeline is run. Replayed values are
+// unmarshaled onto an empty context.
+//
+// The log is split in to segments, which are deleted once all of their values
+// have been acknowledged. When the log is opened, unacknowledged values are
+// copied to a new segment and the old segments are deleted. The directory must
+// not be shared with any other Durable stage
+func Durable(dir string, m ContextMarshaler) Pipeline {
+	return DurableWithSegmentSize(dir, m, DefaultSegmentSize)
+}
+
+// DurableWithSegmentSize creates a Durable pipeline that starts a new segment of
+// its log once the current segment reaches size bytes
+func DurableWithSegmentSize(dir string, m ContextMarshaler, size int64) Pipeline {
+	return newStage("Durable", 1, nil, func(s *stage, in stream.Stream) stream.Stream {
+		out, cls := in.WithValues(make(chan context.Context))
+
+		go func() {
+			defer cls()
+
+			info := s.info(0)
+			log, replay, err := openSegmentLog(dir, size)
+
+			if err != nil {
+				// Without a log, no value can be persisted
+				for ctx := range in.Values() {
+					Nack(ctx, err)
+					out.Error(err)
+				}
+
+				return
+			}
+
+			defer log.close()
+
+			for _, r := range replay {
+				ctx, err := m.UnmarshalContext(context.Background(), r.data)
+
+				if err == nil {
+					out.Value(log.withAck(ctx, r.id))
+				} else {
+					out.Error(fmt.Errorf("Unable to replay value %d from %s: %s", r.id, dir, err.Error()))
+				}
+			}
+
+			for ctx := range in.Values() {
+				ctx, a := begin(ctx, info)
+
+				var id uint64
+				data, err := m.MarshalContext(ctx)
+
+				if err == nil {
+					id, err = log.append(data)
+				}
+
+				a.processed(err)
+
+				if err == nil {
+					// The value is safe in the log, so the source no longer
+					// needs to hold on to it
+					Ack(ctx)
+					out.Value(log.withAck(ctx, id))
+				} else {
+					Nack(ctx, err)
+					out.Error(err)
+				}
+
+				a.end()
+			}
+		}()
+
+		return out
+	})
+}
+
+const (
+	recordItem byte = 'I'
+	recordAck  byte = 'A'
+
+	// Each record starts with its kind, the id of the value, the length of
+	// its data and a checksum
+	recordHeaderSize = 1 + 8 + 4 + 4
+
+	// Records claiming to be longer than this are treated as corrupt
+	maxRecordSize = 1 << 30
+)
+
+// segmentLog is the log used by a Durable stage
+type segmentLog struct {
+	dir  string
+	size int64
+
+	mu       sync.Mutex
+	segments []*segment
+	active   *os.File
+	nextID   uint64
+	pending  map[uint64]*segment
+	closing  bool
+}
+
+// segment is a single file of a segmentLog. The last segment of the log is the
+// active segment, which records are appended to
+type segment struct {
+	seq  int64
+	path string
+	size int64
+
+	// Number of values in the segment that have not been acknowledged
+	live int
+}
+
+// logRecord is a value read from a segmentLog
+type logRecord struct {
+	id   uint64
+	data []byte
+}
+
+// openSegmentLog opens the log in dir, creating it if necessary. Values that have
+// not been acknowledged are copied to a new segment, and returned in the order
+// that they were appended
+func openSegmentLog(dir string, size int64) (*segmentLog, []logRecord, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, err
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "segment-*.log"))
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sort.Strings(paths)
+
+	var (
+		items   = make(map[uint64][]byte)
+		acked   = make(map[uint64]bool)
+		lastSeq int64
+		maxID   uint64
+	)
+
+	for _, path := range paths {
+		var seq int64
+
+		if _, err := fmt.Sscanf(filepath.Base(path), "segment-%d.log", &seq); err == nil && seq > lastSeq {
+			lastSeq = seq
+		}
+
+		err := readSegment(path, func(kind byte, id uint64, data []byte) {
+			switch kind {
+			case recordItem:
+				items[id] = data
+			case recordAck:
+				acked[id] = true
+			}
+
+			if id > maxID {
+				maxID = id
+			}
+		})
+
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var replay []logRecord
+
+	for id, data := range items {
+		if !acked[id] {
+			replay = append(replay, logRecord{id, data})
+		}
+	}
+
+	sort.Sort(byRecordID(replay))
+
+	l := &segmentLog{
+		dir:     dir,
+		size:    size,
+		nextID:  maxID + 1,
+		pending: make(map[uint64]*segment),
+	}
+
+	if err := l.roll(lastSeq + 1); err != nil {
+		return nil, nil, err
+	}
+
+	for _, r := range replay {
+		if err := l.write(recordItem, r.id, r.data); err != nil {
+			l.active.Close()
+			return nil, nil, err
+		}
+
+		l.track(r.id)
+	}
+
+	if err := l.active.Sync(); err != nil {
+		l.active.Close()
+		return nil, nil, err
+	}
+
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil {
+			l.active.Close()
+			return nil, nil, err
+		}
+	}
+
+	return l, replay, nil
+}
+
+// readSegment calls fn for each record in the segment at path. Reading stops at
+// the first incomplete or corrupt record, which is left by a crash part way
+// through an append
+func readSegment(path string, fn func(kind byte, id uint64, data []byte)) error {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	var (
+		r      = bufio.NewReader(f)
+		header = make([]byte, recordHeaderSize)
+	)
+
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil
+		}
+
+		var (
+			id     = binary.BigEndian.Uint64(header[1:9])
+			length = binary.BigEndian.Uint32(header[9:13])
+			sum    = binary.BigEndian.Uint32(header[13:17])
+		)
+
+		if length > maxRecordSize {
+			return nil
+		}
+
+		data := make([]byte, length)
+
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil
+		}
+
+		if checksum(header[:13], data) != sum {
+			return nil
+		}
+
+		fn(header[0], id, data)
+	}
+}
+
+func checksum(header, data []byte) uint32 {
+	h := crc32.NewIEEE()
+	h.Write(header)
+	h.Write(data)
+	return h.Sum32()
+}
+
+// append adds a value to the log, returning its id. The value is synced to disk
+// before append returns
+func (l *segmentLog) append(data []byte) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	id := l.nextID
+
+	if err := l.write(recordItem, id, data); err != nil {
+		return 0, err
+	}
+
+	if err := l.active.Sync(); err != nil {
+		return 0, err
+	}
+
+	l.nextID++
+	l.track(id)
+
+	if seg := l.segments[len(l.segments)-1]; seg.size >= l.size {
+		if err := l.roll(seg.seq + 1); err != nil {
+			return 0, err
+		}
+	}
+
+	return id, nil
+}
+
+// ack records that the value with the given id has been processed
+func (l *segmentLog) ack(id uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	seg, ok := l.pending[id]
+
+	if !ok {
+		return
+	}
+
+	delete(l.pending, id)
+	seg.live--
+
+	// If the ack can't be written the value is replayed on restart, which
+	// is preferable to losing it
+	l.write(recordAck, id, nil)
+
+	l.compact()
+
+	if l.closing && len(l.pending) == 0 {
+		l.active.Close()
+	}
+}
+
+// nack releases a value that could not be processed. It is left in the log, so
+// that it is replayed the next time the log is opened
+func (l *segmentLog) nack(id uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.pending[id]; !ok {
+		return
+	}
+
+	delete(l.pending, id)
+
+	if l.closing && len(l.pending) == 0 {
+		l.active.Close()
+	}
+}
+
+// withAck returns a copy of ctx that acknowledges the value with the given id
+func (l *segmentLog) withAck(ctx context.Context, id uint64) context.Context {
+	return WithAck(ctx, func() {
+		l.ack(id)
+	}, func(error) {
+		l.nack(id)
+	})
+}
+
+// close closes the log once all values have been acknowledged
+func (l *segmentLog) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.closing = true
+
+	if len(l.pending) == 0 {
+		l.active.Close()
+	}
+}
+
+// track adds a value appended to the active segment to the values awaiting an
+// ack. It is called with the lock held
+func (l *segmentLog) track(id uint64) {
+	seg := l.segments[len(l.segments)-1]
+	seg.live++
+	l.pending[id] = seg
+}
+
+// write appends a record to the active segment. It is called with the lock held
+func (l *segmentLog) write(kind byte, id uint64, data []byte) error {
+	buf := make([]byte, recordHeaderSize+len(data))
+	buf[0] = kind
+	binary.BigEndian.PutUint64(buf[1:9], id)
+	binary.BigEndian.PutUint32(buf[9:13], uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[13:17], checksum(buf[:13], data))
+	copy(buf[recordHeaderSize:], data)
+
+	n, err := l.active.Write(buf)
+	l.segments[len(l.segments)-1].size += int64(n)
+
+	return err
+}
+
+// roll starts a new active segment. It is called with the lock held
+func (l *segmentLog) roll(seq int64) error {
+	path := filepath.Join(l.dir, fmt.Sprintf("segment-%020d.log", seq))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	if l.active != nil {
+		l.active.Close()
+	}
+
+	l.active = f
+	l.segments = append(l.segments, &segment{seq: seq, path: path})
+
+	return nil
+}
+
+// compact deletes segments from the start of the log once all of their values
+// have been acknowledged. Segments are only deleted in order, as a segment may
+// hold acks for values in earlier segments. It is called with the lock held
+func (l *segmentLog) compact() {
+	for len(l.segments) > 1 && l.segments[0].live == 0 {
+		if err := os.Remove(l.segments[0].path); err != nil {
+			return
+		}
+
+		l.segments = l.segments[1:]
+	}
+}
+
+type byRecordID []logRecord
+
+func (r byRecordID) Len() int           { return len(r) }
+func (r byRecordID) Less(i, j int) bool { return r[i].id < r[j].id }
+func (r byRecordID) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
@@ -0,0 +1,247 @@
+package pipeline
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bernos/go-pipeline/pipeline/stream"
+	"golang.org/x/net/context"
+)
+
+// runDurable sends values through a Durable stage, acknowledging those for which
+// ack returns true, and returns every value that came out of the stage
+func runDurable(t *testing.T, pl Pipeline, ack func(int) bool, values ...int) []int {
+	in, cls := stream.New()
+	out := pl(in)
+
+	go func() {
+		defer cls()
+		for _, x := range values {
+			in.Value(NewContext(context.Background(), x))
+		}
+	}()
+
+	go func() {
+		for err := range out.Errors() {
+			t.Error(err)
+		}
+	}()
+
+	var got []int
+
+	for ctx := range out.Values() {
+		x := FromContext(ctx)
+		got = append(got, x)
+
+		if ack(x) {
+			Ack(ctx)
+		}
+	}
+
+	return got
+}
+
+func TestDurableReplaysUnacknowledgedValues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "durable")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	odd := func(x int) bool { return x%2 == 1 }
+	all := func(int) bool { return true }
+
+	got := runDurable(t, Durable(dir, intMarshaler{}), odd, 1, 2, 3, 4)
+
+	if want := fmt.Sprint([]int{1, 2, 3, 4}); fmt.Sprint(got) != want {
+		t.Errorf("Want %s, got %v", want, got)
+	}
+
+	got = runDurable(t, Durable(dir, intMarshaler{}), all, 5)
+
+	if want := fmt.Sprint([]int{2, 4, 5}); fmt.Sprint(got) != want {
+		t.Errorf("Want %s, got %v", want, got)
+	}
+
+	got = runDurable(t, Durable(dir, intMarshaler{}), all)
+
+	if len(got) != 0 {
+		t.Errorf("Want no values, got %v", got)
+	}
+}
+
+func TestDurableCompactsSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "durable")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Start a new segment after every value
+	pl := DurableWithSegmentSize(dir, intMarshaler{}, 1)
+	values := []int{1, 2, 3, 4, 5}
+
+	runDurable(t, pl, func(x int) bool { return x != 3 }, values...)
+
+	// Segments up to and including the one holding 3 must be kept
+	segments, _ := filepath.Glob(filepath.Join(dir, "segment-*.log"))
+
+	if len(segments) != 4 {
+		t.Errorf("Want %d segments, got %d", 4, len(segments))
+	}
+
+	got := runDurable(t, pl, func(int) bool { return true })
+
+	if want := fmt.Sprint([]int{3}); fmt.Sprint(got) != want {
+		t.Errorf("Want %s, got %v", want, got)
+	}
+
+	segments, _ = filepath.Glob(filepath.Join(dir, "segment-*.log"))
+
+	if len(segments) != 1 {
+		t.Errorf("Want %d segment, got %d", 1, len(segments))
+	}
+}
+
+func TestDurableIgnoresTornRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "durable")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	runDurable(t, Durable(dir, intMarshaler{}), func(int) bool { return false }, 1, 2)
+
+	// Simulate a crash part way through appending a record
+	segments, _ := filepath.Glob(filepath.Join(dir, "segment-*.log"))
+	f, err := os.OpenFile(segments[len(segments)-1], os.O_APPEND|os.O_WRONLY, 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.Write([]byte{recordItem, 0, 0, 0})
+	f.Close()
+
+	got := runDurable(t, Durable(dir, intMarshaler{}), func(int) bool { return true })
+
+	if want := fmt.Sprint([]int{1, 2}); fmt.Sprint(got) != want {
+		t.Errorf("Want %s, got %v", want, got)
+	}
+}
+
+func TestDurableAcksInputOncePersisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "durable")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	in, cls := stream.New()
+	out := Durable(dir, intMarshaler{})(in)
+	acked := make(chan int, 1)
+
+	go func() {
+		defer cls()
+		in.Value(WithAck(NewContext(context.Background(), 1), func() { acked <- 1 }, nil))
+	}()
+
+	go func() {
+		for range out.Errors() {
+		}
+	}()
+
+	// The input is acked before the output value is
+	for range out.Values() {
+		select {
+		case <-acked:
+		default:
+			t.Error("Expected input to be acked once persisted")
+		}
+	}
+}
+
+func TestDurableReplaysNackedValues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "durable")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	pl := DurableWithSegmentSize(dir, intMarshaler{}, 1)
+	in, cls := stream.New()
+	out := pl(in)
+
+	go func() {
+		defer cls()
+		for _, x := range []int{1, 2, 3} {
+			in.Value(NewContext(context.Background(), x))
+		}
+	}()
+
+	go func() {
+		for range out.Errors() {
+		}
+	}()
+
+	for ctx := range out.Values() {
+		if FromContext(ctx) == 2 {
+			Nack(ctx, fmt.Errorf("failed"))
+		} else {
+			Ack(ctx)
+		}
+	}
+
+	got := runDurable(t, pl, func(int) bool { return true })
+
+	if want := fmt.Sprint([]int{2}); fmt.Sprint(got) != want {
+		t.Errorf("Want %s, got %v", want, got)
+	}
+}
+
+func TestSegmentLogClosesOnceNackedValuesAreReleased(t *testing.T) {
+	dir, err := ioutil.TempDir("", "durable")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	log, _, err := openSegmentLog(dir, DefaultSegmentSize)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := log.append([]byte("1"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log.close()
+
+	if _, err := log.active.Write(nil); err != nil {
+		t.Fatal("Expected log to stay open while a value is pending")
+	}
+
+	Nack(log.withAck(context.Background(), id), fmt.Errorf("failed"))
+
+	if _, err := log.active.Write(nil); err == nil {
+		t.Error("Expected log to be closed once the pending value was nacked")
+	}
+}
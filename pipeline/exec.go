@@ -0,0 +1,395 @@
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/bernos/go-pipeline/pipeline/stream"
+	"golang.org/x/net/context"
+)
+
+// Framing determines how values are delimited when they are written to and read
+// from the process run by Exec
+type Framing int
+
+const (
+	// LineFraming ends each value with a newline. Values must not contain
+	// newlines
+	LineFraming Framing = iota
+
+	// LengthPrefixFraming precedes each value with its length, in bytes, as a
+	// 4 byte big endian unsigned integer
+	LengthPrefixFraming
+)
+
+// DefaultExecStopTimeout is how long Exec waits for a process to exit after its
+// stdin is closed if ExecOptions.StopTimeout is not set
+const DefaultExecStopTimeout = 5 * time.Second
+
+// ExecOptions configures Exec
+type ExecOptions struct {
+	// Encode converts a value to the bytes written to the process. Required
+	Encode Formatter
+
+	// Decode converts the bytes read from the process in to an output value,
+	// derived from the input value ctx. Required
+	Decode func(ctx context.Context, data []byte) (context.Context, error)
+
+	// Framing determines how values are delimited. The default is LineFraming
+	Framing Framing
+
+	// Pool is the number of processes that are run, each processing one value
+	// at a time. Zero means 1
+	Pool int
+
+	// Dir and Env are set on the exec.Cmd used to start each process
+	Dir string
+	Env []string
+
+	// StopTimeout is how long to wait for a process to exit after its stdin
+	// is closed, before it is killed. Zero means DefaultExecStopTimeout
+	StopTimeout time.Duration
+}
+
+// Exec creates a Pipeline that maps each value from its input stream by sending
+// it to a long-lived process, started by running cmd with args. Each value is
+// encoded and written to the process's stdin, and the process must respond by
+// writing exactly one result to its stdout, which is decoded to produce the
+// output value. Each line the process writes to stderr is sent to the output
+// stream as an error.
+//
+// If the process exits, or the context of the value it is processing is done,
+// the value fails and the process is restarted for the next value. A process
+// that exits between values is restarted before the next value is sent to it.
+// If a process that was idle fails before responding at all, it may have been
+// exiting as the value was sent, so the value is sent once more to a new
+// process. Values whose context is already done are failed without being sent. Processes are
+// started when the first value arrives, and stopped by closing their stdin once
+// the input stream is closed
+func Exec(cmd string, args []string, opts ExecOptions) Pipeline {
+	n := opts.Pool
+
+	if n <= 0 {
+		n = 1
+	}
+
+	if opts.StopTimeout <= 0 {
+		opts.StopTimeout = DefaultExecStopTimeout
+	}
+
+	return newStage("Exec", n, nil, func(s *stage, in stream.Stream) stream.Stream {
+		var (
+			wg       sync.WaitGroup
+			out, cls = in.WithValues(make(chan context.Context))
+		)
+
+		wg.Add(n)
+
+		for i := 0; i < n; i++ {
+			go func(info StageInfo) {
+				defer wg.Done()
+
+				var p *execProcess
+
+				for ctx := range in.Values() {
+					ctx, a := begin(ctx, info)
+
+					var (
+						value context.Context
+						req   []byte
+						data  []byte
+						err   error
+					)
+
+					if p != nil && p.exited() {
+						// The process exited while idle, so start another
+						// rather than failing the value
+						if err := p.stop(); err != nil {
+							out.Error(err)
+						}
+
+						p = nil
+					}
+
+					err = ctx.Err()
+
+					// Whether the process was started for an earlier value
+					idle := p != nil
+
+					if err == nil && p == nil {
+						p, err = startProcess(cmd, args, opts, out.Error)
+					}
+
+					if err == nil {
+						req, err = opts.Encode(ctx)
+					}
+
+					if err == nil {
+						data, err = p.roundTrip(ctx, req)
+
+						if e, ok := err.(*execError); ok {
+							p = nil
+
+							if idle && !e.responded && ctx.Err() == nil {
+								p, err = startProcess(cmd, args, opts, out.Error)
+
+								if err == nil {
+									data, err = p.roundTrip(ctx, req)
+
+									if _, ok := err.(*execError); ok {
+										p = nil
+									}
+								}
+							}
+						}
+					}
+
+					if err == nil {
+						value, err = opts.Decode(ctx, data)
+					}
+
+					a.processed(err)
+
+					if err == nil {
+						out.Value(inheritAck(ctx, value))
+					} else {
+						Nack(ctx, err)
+						out.Error(err)
+					}
+
+					a.end()
+				}
+
+				if p != nil {
+					if err := p.stop(); err != nil {
+						out.Error(err)
+					}
+				}
+			}(s.info(i))
+		}
+
+		go func() {
+			defer cls()
+			wg.Wait()
+		}()
+
+		return out
+	})
+}
+
+// execError is returned by execProcess.roundTrip when the process has failed,
+// and has been stopped
+type execError struct {
+	name string
+	err  error
+
+	// Whether any of the response was read before the process failed
+	responded bool
+}
+
+func (e *execError) Error() string {
+	return fmt.Sprintf("Exec %s failed: %s", e.name, e.err.Error())
+}
+
+// execProcess is a process run by Exec
+type execProcess struct {
+	name    string
+	framing Framing
+	timeout time.Duration
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	w       *bufio.Writer
+	r       *bufio.Reader
+
+	// Closed once stderr has been read to the end
+	stderr chan struct{}
+}
+
+func startProcess(name string, args []string, opts ExecOptions, errs func(error)) (*execProcess, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Dir = opts.Dir
+	cmd.Env = opts.Env
+
+	stdin, err := cmd.StdinPipe()
+
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+
+	if err != nil {
+		return nil, err
+	}
+
+	stderr, err := cmd.StderrPipe()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("Unable to start %s: %s", name, err.Error())
+	}
+
+	p := &execProcess{
+		name:    name,
+		framing: opts.Framing,
+		timeout: opts.StopTimeout,
+		cmd:     cmd,
+		stdin:   stdin,
+		w:       bufio.NewWriter(stdin),
+		r:       bufio.NewReader(stdout),
+		stderr:  make(chan struct{}),
+	}
+
+	go func() {
+		defer close(p.stderr)
+
+		scanner := bufio.NewScanner(stderr)
+
+		for scanner.Scan() {
+			errs(fmt.Errorf("%s: %s", name, scanner.Text()))
+		}
+
+		// Lines too long to scan are discarded, so that the process does
+		// not block writing to stderr
+		io.Copy(ioutil.Discard, stderr)
+	}()
+
+	return p, nil
+}
+
+// roundTrip sends data to the process and reads its response. If the process
+// fails, or ctx is done first, the process is killed and an *execError is
+// returned
+func (p *execProcess) roundTrip(ctx context.Context, data []byte) ([]byte, error) {
+	if p.framing == LineFraming && bytes.IndexByte(data, '\n') >= 0 {
+		return nil, fmt.Errorf("Unable to send value to %s: value contains a newline", p.name)
+	}
+
+	var (
+		done   = make(chan struct{})
+		killed = make(chan bool, 1)
+	)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.cmd.Process.Kill()
+			killed <- true
+		case <-done:
+			killed <- false
+		}
+	}()
+
+	resp, responded, err := p.exchange(data)
+	close(done)
+
+	// The process may have been killed after responding, in which case it
+	// can't be used again
+	if <-killed && err == nil {
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		p.cmd.Process.Kill()
+		<-p.stderr
+
+		if werr := p.cmd.Wait(); werr != nil {
+			err = werr
+		}
+
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+
+		return nil, &execError{p.name, err, responded}
+	}
+
+	return resp, nil
+}
+
+// exited reports whether the process has exited, which is when it closes
+// stderr
+func (p *execProcess) exited() bool {
+	select {
+	case <-p.stderr:
+		return true
+	default:
+		return false
+	}
+}
+
+// exchange sends data to the process and reads its response, reporting whether
+// any of the response was read if it fails
+func (p *execProcess) exchange(data []byte) ([]byte, bool, error) {
+	switch p.framing {
+	case LengthPrefixFraming:
+		var header [4]byte
+		binary.BigEndian.PutUint32(header[:], uint32(len(data)))
+		p.w.Write(header[:])
+		p.w.Write(data)
+	default:
+		p.w.Write(data)
+		p.w.WriteByte('\n')
+	}
+
+	if err := p.w.Flush(); err != nil {
+		return nil, false, err
+	}
+
+	switch p.framing {
+	case LengthPrefixFraming:
+		var header [4]byte
+
+		if n, err := io.ReadFull(p.r, header[:]); err != nil {
+			return nil, n > 0, err
+		}
+
+		resp := make([]byte, binary.BigEndian.Uint32(header[:]))
+
+		if _, err := io.ReadFull(p.r, resp); err != nil {
+			return nil, true, err
+		}
+
+		return resp, true, nil
+	default:
+		line, err := p.r.ReadBytes('\n')
+
+		if err != nil {
+			return nil, len(line) > 0, err
+		}
+
+		return bytes.TrimRight(line, "\r\n"), true, nil
+	}
+}
+
+// stop closes the process's stdin and waits for it to exit, killing it if it
+// does not exit within its timeout
+func (p *execProcess) stop() error {
+	p.stdin.Close()
+
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+
+	select {
+	case <-p.stderr:
+	case <-timer.C:
+		p.cmd.Process.Kill()
+		<-p.stderr
+	}
+
+	if err := p.cmd.Wait(); err != nil {
+		return &execError{name: p.name, err: err}
+	}
+
+	return nil
+}
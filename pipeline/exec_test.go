@@ -0,0 +1,272 @@
+package pipeline
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bernos/go-pipeline/pipeline/stream"
+	"golang.org/x/net/context"
+)
+
+const execHelperEnv = "PIPELINE_EXEC_HELPER"
+
+// TestExecHelper is run as the subprocess in the Exec tests. It doubles each
+// number it reads, and behaves according to the mode set in its environment
+func TestExecHelper(t *testing.T) {
+	mode := os.Getenv(execHelperEnv)
+
+	if mode == "" {
+		return
+	}
+
+	var (
+		r = bufio.NewReader(os.Stdin)
+		w = bufio.NewWriter(os.Stdout)
+	)
+
+	for {
+		var line string
+
+		if mode == "length" {
+			var header [4]byte
+
+			if _, err := io.ReadFull(r, header[:]); err != nil {
+				os.Exit(0)
+			}
+
+			data := make([]byte, binary.BigEndian.Uint32(header[:]))
+			io.ReadFull(r, data)
+			line = string(data)
+		} else {
+			l, err := r.ReadString('\n')
+
+			if err != nil {
+				os.Exit(0)
+			}
+
+			line = strings.TrimSpace(l)
+		}
+
+		x, _ := strconv.Atoi(line)
+
+		switch mode {
+		case "crash":
+			if x == 0 {
+				os.Exit(1)
+			}
+		case "stderr":
+			fmt.Fprintf(os.Stderr, "warning %d\n", x)
+		}
+
+		result := strconv.Itoa(x * 2)
+
+		if mode == "length" {
+			var header [4]byte
+			binary.BigEndian.PutUint32(header[:], uint32(len(result)))
+			w.Write(header[:])
+			w.WriteString(result)
+		} else {
+			fmt.Fprintln(w, result)
+		}
+
+		w.Flush()
+
+		if mode == "once" {
+			os.Exit(0)
+		}
+	}
+}
+
+func execOptions(mode string) ExecOptions {
+	return ExecOptions{
+		Encode: func(ctx context.Context) ([]byte, error) {
+			return []byte(strconv.Itoa(FromContext(ctx))), nil
+		},
+		Decode: func(ctx context.Context, data []byte) (context.Context, error) {
+			x, err := strconv.Atoi(string(data))
+			return NewContext(ctx, x), err
+		},
+		Env: append(os.Environ(), execHelperEnv+"="+mode),
+	}
+}
+
+func runExec(opts ExecOptions, input ...int) ([]int, []error) {
+	values := make([]context.Context, len(input))
+
+	for i, x := range input {
+		values[i] = NewContext(context.Background(), x)
+	}
+
+	out, errs := runPipeline(Exec(os.Args[0], []string{"-test.run=TestExecHelper"}, opts), values)
+	results := make([]int, len(out))
+
+	for i, ctx := range out {
+		results[i] = FromContext(ctx)
+	}
+
+	return results, errs
+}
+
+func TestExec(t *testing.T) {
+	for _, framing := range []Framing{LineFraming, LengthPrefixFraming} {
+		mode := "lines"
+		opts := execOptions(mode)
+
+		if framing == LengthPrefixFraming {
+			mode = "length"
+			opts = execOptions(mode)
+			opts.Framing = framing
+		}
+
+		got, errs := runExec(opts, 1, 2, 3)
+
+		if len(errs) > 0 {
+			t.Errorf("%s: unexpected errors %v", mode, errs)
+		}
+
+		if fmt.Sprint(got) != "[2 4 6]" {
+			t.Errorf("%s: want [2 4 6], got %v", mode, got)
+		}
+	}
+}
+
+func TestExecPool(t *testing.T) {
+	opts := execOptions("lines")
+	opts.Pool = 3
+
+	got, errs := runExec(opts, 1, 2, 3, 4, 5, 6)
+
+	if len(errs) > 0 {
+		t.Errorf("Unexpected errors %v", errs)
+	}
+
+	sort.Ints(got)
+
+	if fmt.Sprint(got) != "[2 4 6 8 10 12]" {
+		t.Errorf("Want [2 4 6 8 10 12], got %v", got)
+	}
+}
+
+func TestExecRestart(t *testing.T) {
+	got, errs := runExec(execOptions("crash"), 1, 0, 2)
+
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "failed") {
+		t.Errorf("Want 1 error from the crash, got %v", errs)
+	}
+
+	if fmt.Sprint(got) != "[2 4]" {
+		t.Errorf("Want [2 4], got %v", got)
+	}
+}
+
+func TestExecStderr(t *testing.T) {
+	got, errs := runExec(execOptions("stderr"), 1, 2)
+
+	if fmt.Sprint(got) != "[2 4]" {
+		t.Errorf("Want [2 4], got %v", got)
+	}
+
+	var messages []string
+
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+
+	sort.Strings(messages)
+
+	if len(messages) != 2 || !strings.HasSuffix(messages[0], "warning 1") || !strings.HasSuffix(messages[1], "warning 2") {
+		t.Errorf("Want stderr lines as errors, got %v", messages)
+	}
+}
+
+func TestExecNewline(t *testing.T) {
+	opts := execOptions("lines")
+	opts.Encode = func(ctx context.Context) ([]byte, error) {
+		return []byte("1\n2"), nil
+	}
+
+	got, errs := runExec(opts, 1)
+
+	if len(got) != 0 || len(errs) != 1 {
+		t.Errorf("Want value with a newline to fail, got %v and %v", got, errs)
+	}
+}
+
+func TestExecRestartsIdleProcess(t *testing.T) {
+	var (
+		in, cls = stream.New()
+		out     = Exec(os.Args[0], []string{"-test.run=TestExecHelper"}, execOptions("once"))(in)
+		errs    = make(chan error, 10)
+	)
+
+	defer cls()
+
+	go func() {
+		for err := range out.Errors() {
+			errs <- err
+		}
+	}()
+
+	// Each process exits after one value, so the next value finds it either
+	// exited or exiting, and must be sent to a new process either way
+	for _, x := range []int{1, 2, 3} {
+		go in.Value(NewContext(context.Background(), x))
+
+		select {
+		case ctx := <-out.Values():
+			if got := FromContext(ctx); got != x*2 {
+				t.Errorf("Want %d, got %d", x*2, got)
+			}
+		case err := <-errs:
+			t.Fatalf("Unexpected error %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for result")
+		}
+	}
+}
+
+func TestExecProcessExited(t *testing.T) {
+	p, err := startProcess(os.Args[0], []string{"-test.run=TestExecHelper"}, execOptions("once"), func(err error) {
+		t.Errorf("Unexpected error %v", err)
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := p.roundTrip(context.Background(), []byte("1")); err != nil || string(data) != "2" {
+		t.Fatalf("Want 2, got %q and %v", data, err)
+	}
+
+	// Wait for the process to exit
+	<-p.stderr
+
+	if !p.exited() {
+		t.Error("Want process to have exited")
+	}
+
+	_, err = p.roundTrip(context.Background(), []byte("2"))
+
+	if e, ok := err.(*execError); !ok || e.responded {
+		t.Errorf("Want *execError with no response, got %v", err)
+	}
+}
+
+func TestExecDoneContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(NewContext(context.Background(), 1))
+	cancel()
+
+	out, errs := runPipeline(Exec(os.Args[0], []string{"-test.run=TestExecHelper"}, execOptions("lines")), []context.Context{ctx})
+
+	if len(out) != 0 || len(errs) != 1 || errs[0] != context.Canceled {
+		t.Errorf("Want value to fail with %v, got %v and %v", context.Canceled, out, errs)
+	}
+}
@@ -0,0 +1,493 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/bernos/go-pipeline/pipeline/stream"
+	"golang.org/x/net/context"
+)
+
+const (
+	maxRecentErrors   = 20
+	maxInFlightSample = 5
+	maxSampleLength   = 200
+)
+
+// ErrDrainTimeout is returned by Execution.Drain if values are still being
+// processed when the deadline passes
+var ErrDrainTimeout = errors.New("Timed out draining pipeline")
+
+// Execution is a running pipeline, created by Pipeline.Start. Values and errors
+// from the pipeline are available from the embedded Stream, which is closed once
+// the pipeline has finished
+type Execution struct {
+	stream.Stream
+
+	pipeline Pipeline
+	pauser   *Pauser
+	started  time.Time
+	cancel   context.CancelFunc
+	metrics  *Metrics
+	inflight *inflightTracer
+
+	drain     chan struct{}
+	drainOnce sync.Once
+
+	// The graph is only described when it is first needed
+	graph     *Graph
+	graphOnce sync.Once
+
+	mu        sync.Mutex
+	cancelled bool
+	errors    []ErrorRecord
+}
+
+// ExecutionStats is a snapshot of the state of an Execution
+type ExecutionStats struct {
+	Started    time.Time
+	Paused     bool
+	Draining   bool
+	Cancelled  bool
+	Finished   bool
+	Goroutines int
+	Stages     []StageStats
+	Errors     []ErrorRecord
+}
+
+// StageStats is a snapshot of the state of a single stage of an Execution
+type StageStats struct {
+	ID      int
+	Name    string
+	Type    string
+	Workers int
+
+	// Nesting level of the stage within Loop, Tee and Parallel stages
+	Depth int
+
+	// Number of values processed, and number of values that resulted in an
+	// error, summed over all workers
+	Items  uint64
+	Errors uint64
+
+	// Number of values currently being processed by the stage. As streams are
+	// unbuffered, this is the queue depth of the stage
+	InFlight int
+
+	// A sample of the values currently being processed
+	Samples []string
+}
+
+// ErrorRecord is an error sent on the error stream of an Execution
+type ErrorRecord struct {
+	Time  time.Time
+	Error string
+}
+
+// Start runs the pipeline using ctx as a starting value, in the same way as Run,
+// and returns an Execution that can be used to monitor and control it. The
+// pipeline's input is closed when ctx is cancelled, or when the execution is
+// drained. Unless ctx already carries Metrics, new Metrics are added to it
+func (p Pipeline) Start(ctx context.Context) *Execution {
+	return p.StartWith(ctx, func(ctx context.Context) []context.Context {
+		return []context.Context{ctx}
+	})
+}
+
+// StartWith runs the pipeline in the same way as Start, using the values returned
+// by seed as the starting values. Seed is passed ctx once it has been prepared for
+// the execution, so that the starting values can be derived from it. Resuming
+// from a checkpoint, for example
+//
+//	e := p.StartWith(ctx, func(ctx context.Context) []context.Context {
+//		values, _ := checkpointer.Restore(ctx)
+//		return values
+//	})
+func (p Pipeline) StartWith(ctx context.Context, seed func(context.Context) []context.Context) *Execution {
+	pausable, pauser := Pausable(p)
+	ctx, cancel := context.WithCancel(ctx)
+
+	e := &Execution{
+		pipeline: p,
+		pauser:   pauser,
+		started:  time.Now(),
+		cancel:   cancel,
+		drain:    make(chan struct{}),
+	}
+
+	if m, ok := MetricsFromContext(ctx); ok {
+		e.metrics = m
+	} else {
+		e.metrics = NewMetrics()
+		ctx = WithMetrics(ctx, e.metrics)
+	}
+
+	next, _ := TracerFromContext(ctx)
+	e.inflight = newInflightTracer(next)
+	ctx = WithTracer(ctx, e.inflight)
+
+	var (
+		wg       sync.WaitGroup
+		values   = make(chan context.Context)
+		in, cls  = stream.WithValues(values)
+		out      = pausable(in)
+		result   stream.Stream
+		closeOut stream.CloseFunc
+		done     = ctx.Done()
+	)
+
+	result, closeOut = stream.New()
+	e.Stream = result
+
+	// Send the starting values, then close the input once the execution is
+	// either cancelled or drained
+	go func() {
+		defer cls()
+
+		for _, v := range seed(ctx) {
+			select {
+			case values <- v:
+			case <-done:
+				return
+			case <-e.drain:
+				return
+			}
+		}
+
+		select {
+		case <-done:
+		case <-e.drain:
+		}
+	}()
+
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		for ctx := range out.Values() {
+			handedOut(ctx)
+			result.Value(ctx)
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		for err := range out.Errors() {
+			e.recordError(err)
+			result.Error(err)
+		}
+	}()
+
+	go func() {
+		defer closeOut()
+		wg.Wait()
+
+		// Release the resources of the context now that nothing uses it
+		cancel()
+	}()
+
+	return e
+}
+
+// Pause the execution. See Pausable
+func (e *Execution) Pause() {
+	e.pauser.Pause()
+}
+
+// Resume a paused execution
+func (e *Execution) Resume() {
+	e.pauser.Resume()
+}
+
+// Paused reports whether the execution is paused
+func (e *Execution) Paused() bool {
+	return e.pauser.Paused()
+}
+
+// Drain stops the execution accepting new input, and waits up to timeout for the
+// values already in the pipeline to be processed. A paused execution is resumed
+// so that it can drain. If the deadline passes, the execution is cancelled and
+// the values that were still being processed are returned along with
+// ErrDrainTimeout. Where both a value and values derived from it were being
+// processed, only the original value is returned
+func (e *Execution) Drain(timeout time.Duration) ([]context.Context, error) {
+	e.Resume()
+	e.drainOnce.Do(func() {
+		close(e.drain)
+	})
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-e.Done():
+		return nil, nil
+	case <-timer.C:
+	}
+
+	abandoned := e.inflight.values()
+	e.Cancel()
+
+	return abandoned, ErrDrainTimeout
+}
+
+// Cancel stops the execution by cancelling the context it was started with. A
+// paused execution does not need to be resumed in order to be cancelled
+func (e *Execution) Cancel() {
+	e.mu.Lock()
+	e.cancelled = true
+	e.mu.Unlock()
+
+	e.cancel()
+}
+
+// Metrics returns the Metrics collected by the execution
+func (e *Execution) Metrics() *Metrics {
+	return e.metrics
+}
+
+// Describe returns a Graph of the stages in the pipeline being executed
+func (e *Execution) Describe() *Graph {
+	e.graphOnce.Do(func() {
+		e.graph = Describe(e.pipeline)
+	})
+
+	return e.graph
+}
+
+// Stats returns a snapshot of the state of the execution
+func (e *Execution) Stats() ExecutionStats {
+	e.mu.Lock()
+
+	stats := ExecutionStats{
+		Started:    e.started,
+		Paused:     e.Paused(),
+		Cancelled:  e.cancelled,
+		Goroutines: runtime.NumGoroutine(),
+		Errors:     append([]ErrorRecord(nil), e.errors...),
+	}
+
+	e.mu.Unlock()
+
+	select {
+	case <-e.Done():
+		stats.Finished = true
+	default:
+	}
+
+	select {
+	case <-e.drain:
+		stats.Draining = true
+	default:
+	}
+
+	var walk func(nodes []*Node, depth int)
+
+	walk = func(nodes []*Node, depth int) {
+		for _, n := range nodes {
+			stage := StageStats{
+				ID:      n.ID,
+				Name:    n.Name,
+				Type:    n.Type,
+				Workers: n.Workers,
+				Depth:   depth,
+			}
+
+			// Stages that are not built-in can't be told apart, so only
+			// built-in stages are reported on
+			if n.stage != nil {
+				stage.Items, stage.Errors, stage.InFlight, stage.Samples = e.inflight.stage(n.stage)
+			}
+
+			stats.Stages = append(stats.Stages, stage)
+
+			walk(n.Stages, depth+1)
+		}
+	}
+
+	walk(e.Describe().Stages, 0)
+
+	return stats
+}
+
+func (e *Execution) recordError(err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.errors = append(e.errors, ErrorRecord{
+		Time:  time.Now(),
+		Error: err.Error(),
+	})
+
+	if len(e.errors) > maxRecentErrors {
+		e.errors = e.errors[len(e.errors)-maxRecentErrors:]
+	}
+}
+
+type inflightKey int
+
+const inflightSpanContextKey inflightKey = 0
+
+// inflightTracer is a Tracer that keeps track of the values currently being
+// processed by each stage, and of the values each stage has processed, before
+// passing spans on to another Tracer. Each span is added to the context of its
+// value, so that spans for derived values can find their parent
+type inflightTracer struct {
+	next Tracer
+
+	mu     sync.Mutex
+	stages map[*stage]*stageActivity
+}
+
+// stageActivity is the activity of a single stage seen by an inflightTracer
+type stageActivity struct {
+	items  uint64
+	errors uint64
+	spans  map[*inflightSpan]context.Context
+}
+
+func newInflightTracer(next Tracer) *inflightTracer {
+	return &inflightTracer{
+		next:   next,
+		stages: make(map[*stage]*stageActivity),
+	}
+}
+
+func (t *inflightTracer) Start(ctx context.Context, info StageInfo) (context.Context, Span) {
+	span := &inflightSpan{
+		tracer: t,
+		stage:  info.stage,
+	}
+
+	span.parent, _ = ctx.Value(inflightSpanContextKey).(*inflightSpan)
+
+	if t.next != nil {
+		ctx, span.next = t.next.Start(ctx, info)
+	}
+
+	ctx = context.WithValue(ctx, inflightSpanContextKey, span)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	a := t.stages[span.stage]
+
+	if a == nil {
+		a = &stageActivity{spans: make(map[*inflightSpan]context.Context)}
+		t.stages[span.stage] = a
+	}
+
+	a.spans[span] = ctx
+
+	return ctx, span
+}
+
+// stage returns the number of values processed by a stage, the number that
+// resulted in an error, and the number in flight along with a sample of them
+func (t *inflightTracer) stage(s *stage) (uint64, uint64, int, []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	a := t.stages[s]
+
+	if a == nil {
+		return 0, 0, 0, nil
+	}
+
+	var samples []string
+
+	for _, ctx := range a.spans {
+		if len(samples) == maxInFlightSample {
+			break
+		}
+
+		sample := fmt.Sprint(ctx)
+
+		if len(sample) > maxSampleLength {
+			sample = sample[:maxSampleLength] + "..."
+		}
+
+		samples = append(samples, sample)
+	}
+
+	return a.items, a.errors, len(a.spans), samples
+}
+
+// values returns the values currently in flight that are not derived from
+// another value in flight
+func (t *inflightTracer) values() []context.Context {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	live := make(map[*inflightSpan]bool)
+
+	for _, a := range t.stages {
+		for span := range a.spans {
+			live[span] = true
+		}
+	}
+
+	var values []context.Context
+
+	for _, a := range t.stages {
+		for span, ctx := range a.spans {
+			if !span.derived(live) {
+				values = append(values, ctx)
+			}
+		}
+	}
+
+	return values
+}
+
+func (t *inflightTracer) end(span *inflightSpan) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	a := t.stages[span.stage]
+	delete(a.spans, span)
+	a.items++
+
+	if span.failed {
+		a.errors++
+	}
+}
+
+type inflightSpan struct {
+	tracer *inflightTracer
+	stage  *stage
+	parent *inflightSpan
+	next   Span
+	failed bool
+}
+
+// derived reports whether the span is processing a value derived from the value
+// of one of the live spans
+func (s *inflightSpan) derived(live map[*inflightSpan]bool) bool {
+	for p := s.parent; p != nil; p = p.parent {
+		if live[p] {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *inflightSpan) SetError(err error) {
+	s.failed = true
+
+	if s.next != nil {
+		s.next.SetError(err)
+	}
+}
+
+func (s *inflightSpan) End() {
+	s.tracer.end(s)
+
+	if s.next != nil {
+		s.next.End()
+	}
+}
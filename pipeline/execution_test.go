@@ -0,0 +1,121 @@
+package pipeline
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestExecutionStats(t *testing.T) {
+	var (
+		started = make(chan struct{})
+		release = make(chan struct{})
+	)
+
+	mapper := MapperFunc(func(ctx context.Context) (context.Context, error) {
+		close(started)
+		<-release
+		return nil, fmt.Errorf("failed")
+	})
+
+	e := Map(mapper).Named("slow").Start(NewContext(context.Background(), 1))
+	defer e.Cancel()
+
+	<-started
+
+	stats := e.Stats()
+
+	if len(stats.Stages) != 1 {
+		t.Fatalf("Want %d stages, got %d", 1, len(stats.Stages))
+	}
+
+	if s := stats.Stages[0]; s.Name != "slow" || s.InFlight != 1 || len(s.Samples) != 1 {
+		t.Errorf("Expected one value in flight in stage slow, got %+v", s)
+	}
+
+	close(release)
+	<-e.Errors()
+
+	e.Cancel()
+	<-e.Done()
+
+	stats = e.Stats()
+
+	if s := stats.Stages[0]; s.InFlight != 0 || s.Items != 1 || s.Errors != 1 {
+		t.Errorf("Expected one failed value in stage slow, got %+v", s)
+	}
+
+	if len(stats.Errors) != 1 || stats.Errors[0].Error != "failed" {
+		t.Errorf("Expected recent error to be recorded, got %+v", stats.Errors)
+	}
+}
+
+func TestExecutionCancel(t *testing.T) {
+	identity := MapperFunc(func(ctx context.Context) (context.Context, error) {
+		return ctx, nil
+	})
+
+	e := Map(identity).Start(context.Background())
+
+	<-e.Values()
+	e.Cancel()
+
+	select {
+	case <-e.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for execution to finish")
+	}
+
+	if stats := e.Stats(); !stats.Cancelled || !stats.Finished {
+		t.Errorf("Expected execution to be cancelled and finished, got %+v", stats)
+	}
+}
+
+func TestExecutionReleasesContextWhenFinished(t *testing.T) {
+	identity := MapperFunc(func(ctx context.Context) (context.Context, error) {
+		return ctx, nil
+	})
+
+	e := Map(identity).Start(context.Background())
+	ctx := <-e.Values()
+
+	if _, err := e.Drain(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if ctx.Err() != context.Canceled {
+		t.Errorf("Want context of a finished execution to be %v, got %v", context.Canceled, ctx.Err())
+	}
+
+	if stats := e.Stats(); stats.Cancelled {
+		t.Errorf("Expected finished execution not to be reported as cancelled, got %+v", stats)
+	}
+}
+
+func TestExecutionStatsForStagesSharingAName(t *testing.T) {
+	identity := MapperFunc(func(ctx context.Context) (context.Context, error) {
+		return ctx, nil
+	})
+
+	e := Map(identity).Named("same").
+		Compose(Map(identity).Named("same")).
+		Start(NewContext(context.Background(), 1))
+
+	<-e.Values()
+	e.Cancel()
+	<-e.Done()
+
+	stats := e.Stats()
+
+	if len(stats.Stages) != 2 {
+		t.Fatalf("Want %d stages, got %d", 2, len(stats.Stages))
+	}
+
+	for _, s := range stats.Stages {
+		if s.Items != 1 {
+			t.Errorf("Want %d item in stage %d, got %d", 1, s.ID, s.Items)
+		}
+	}
+}
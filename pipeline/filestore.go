@@ -0,0 +1,140 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// DefaultCheckpointsKept is the number of checkpoints kept by a FileStore
+const DefaultCheckpointsKept = 3
+
+// FileStore is a CheckpointStore that saves each checkpoint as a JSON file in a
+// directory. Files are written atomically, so a crash while saving leaves the
+// previous checkpoint intact
+type FileStore struct {
+	// Dir is the directory containing the checkpoint files. It is created if
+	// it does not exist
+	Dir string
+
+	// Keep is the number of checkpoints kept. Older checkpoints are removed
+	// after each save
+	Keep int
+
+	mu sync.Mutex
+}
+
+// NewFileStore creates a FileStore that saves checkpoints to dir
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{
+		Dir:  dir,
+		Keep: DefaultCheckpointsKept,
+	}
+}
+
+// Save satisfies the CheckpointStore interface
+func (s *FileStore) Save(cp Checkpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return err
+	}
+
+	files, err := s.files()
+
+	if err != nil {
+		return err
+	}
+
+	var seq int64
+
+	if len(files) > 0 {
+		fmt.Sscanf(filepath.Base(files[len(files)-1]), "checkpoint-%d.json", &seq)
+	}
+
+	tmp, err := ioutil.TempFile(s.Dir, "checkpoint-*.tmp")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if err := json.NewEncoder(tmp).Encode(cp); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	name := filepath.Join(s.Dir, fmt.Sprintf("checkpoint-%020d.json", seq+1))
+
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		return err
+	}
+
+	files = append(files, name)
+
+	for len(files) > s.Keep && s.Keep > 0 {
+		if err := os.Remove(files[0]); err != nil {
+			return err
+		}
+
+		files = files[1:]
+	}
+
+	return nil
+}
+
+// Load satisfies the CheckpointStore interface
+func (s *FileStore) Load() (*Checkpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files, err := s.files()
+
+	if err != nil || len(files) == 0 {
+		return nil, err
+	}
+
+	f, err := os.Open(files[len(files)-1])
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	cp := &Checkpoint{}
+
+	if err := json.NewDecoder(f).Decode(cp); err != nil {
+		return nil, fmt.Errorf("Unable to read checkpoint %s: %s", f.Name(), err.Error())
+	}
+
+	return cp, nil
+}
+
+// files returns the checkpoint files in the store, oldest first
+func (s *FileStore) files() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(s.Dir, "checkpoint-*.json"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(files)
+
+	return files, nil
+}
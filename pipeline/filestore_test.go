@@ -0,0 +1,55 @@
+package pipeline
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoints")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	store := NewFileStore(filepath.Join(dir, "crawl"))
+
+	if cp, err := store.Load(); cp != nil || err != nil {
+		t.Errorf("Want no checkpoint, got %v, %v", cp, err)
+	}
+
+	for i := int64(1); i <= 5; i++ {
+		err := store.Save(Checkpoint{
+			Offsets: map[string]int64{"source": i},
+			Items:   [][]byte{[]byte("item")},
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cp, err := store.Load()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := cp.Offsets["source"]; got != 5 {
+		t.Errorf("Want offset %d, got %d", 5, got)
+	}
+
+	if len(cp.Items) != 1 || string(cp.Items[0]) != "item" {
+		t.Errorf("Want items %q, got %q", [][]byte{[]byte("item")}, cp.Items)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "crawl", "*"))
+
+	if len(files) != DefaultCheckpointsKept {
+		t.Errorf("Want %d files, got %v", DefaultCheckpointsKept, files)
+	}
+}
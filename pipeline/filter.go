@@ -9,21 +9,33 @@ import (
 type Predicate func(context.Context) bool
 
 // Filter filters values from the input channel that satisfy predicate and sends them
-// on the output channel
+// on the output channel. Values that are filtered out are acked
 func Filter(p Predicate) Pipeline {
-	return func(in stream.Stream) stream.Stream {
+	return newStage("Filter", 1, nil, func(s *stage, in stream.Stream) stream.Stream {
 		out, cls := in.WithValues(make(chan context.Context))
 
 		go func() {
 			defer cls()
 
+			info := s.info(0)
+			p := s.wrapPredicate(info, p)
+
 			for ctx := range in.Values() {
-				if p(ctx) {
+				ctx, a := begin(ctx, info)
+				ok := p(ctx)
+				a.processed(nil)
+
+				if ok {
 					out.Value(ctx)
+				} else {
+					a.handOff(0)
+					Ack(ctx)
 				}
+
+				a.end()
 			}
 		}()
 
 		return out
-	}
+	})
 }
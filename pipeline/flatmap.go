@@ -23,14 +23,18 @@ func (fn FlatMapperFunc) FlatMap(ctx context.Context) ([]context.Context, error)
 // output stream via the FlatMapper m. Each Context returned by m.FlatMap will be
 // sent as a value on the output stream
 func FlatMap(m FlatMapper) Pipeline {
-	return PFlatMap(m, 1)
+	return pflatmap("FlatMap", m, 1)
 }
 
 // PFlatMap creates a Pipeline that maps all values from its input stream to its
 // output stream via n concurrent instances of the FlatMapper m. Each Context
 // returned by m.FlatMap will be sent as a value on the output stream
 func PFlatMap(m FlatMapper, n int) Pipeline {
-	return func(in stream.Stream) stream.Stream {
+	return pflatmap("PFlatMap", m, n)
+}
+
+func pflatmap(t string, m FlatMapper, n int) Pipeline {
+	return newStage(t, n, nil, func(s *stage, in stream.Stream) stream.Stream {
 		var (
 			wg       sync.WaitGroup
 			out, cls = in.WithValues(make(chan context.Context))
@@ -39,19 +43,31 @@ func PFlatMap(m FlatMapper, n int) Pipeline {
 		wg.Add(n)
 
 		for i := 0; i < n; i++ {
-			go func() {
+			go func(info StageInfo) {
 				defer wg.Done()
+
+				m := s.wrapFlatMapper(info, m)
+
 				for ctx := range in.Values() {
+					ctx, a := begin(ctx, info)
 					values, err := m.FlatMap(ctx)
+					a.processed(err)
+
 					if err == nil {
+						values = ackAll(ctx, values)
+						a.handOff(len(values))
+
 						for v := range values {
 							out.Value(values[v])
 						}
 					} else {
+						Nack(ctx, err)
 						out.Error(err)
 					}
+
+					a.end()
 				}
-			}()
+			}(s.info(i))
 		}
 
 		go func() {
@@ -60,5 +76,5 @@ func PFlatMap(m FlatMapper, n int) Pipeline {
 		}()
 
 		return out
-	}
+	})
 }
@@ -0,0 +1,50 @@
+package httpstage
+
+import (
+	"sync"
+)
+
+// Cache stores responses by URL, so that Fetch can make conditional requests.
+// Implementations must be safe for concurrent use
+type Cache interface {
+	Get(url string) (*Response, bool)
+	Set(url string, r *Response)
+}
+
+// MemoryCache is a Cache that keeps responses in memory
+type MemoryCache struct {
+	mu        sync.RWMutex
+	responses map[string]*Response
+}
+
+// NewMemoryCache creates an empty MemoryCache
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{
+		responses: make(map[string]*Response),
+	}
+}
+
+// Get satisfies the Cache interface
+func (c *MemoryCache) Get(url string) (*Response, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	r, ok := c.responses[url]
+	return r, ok
+}
+
+// Set satisfies the Cache interface
+func (c *MemoryCache) Set(url string, r *Response) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.responses[url] = r
+}
+
+// Len returns the number of responses in the cache
+func (c *MemoryCache) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return len(c.responses)
+}
@@ -0,0 +1,400 @@
+// Package httpstage provides pipeline stages that make HTTP requests, with limits
+// on concurrency per host and on the size of responses, and support for
+// conditional requests backed by a cache
+package httpstage
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bernos/go-pipeline/pipeline"
+	"golang.org/x/net/context"
+)
+
+const (
+	// DefaultMaxBodySize is the largest response body read by Fetch if
+	// Options.MaxBodySize is not set
+	DefaultMaxBodySize = 10 << 20
+
+	// DefaultMaxRedirects is the number of redirects followed by Fetch if
+	// Options.MaxRedirects is not set
+	DefaultMaxRedirects = 10
+
+	// DefaultMaxIdleConnsPerHost is the number of idle connections kept open
+	// to each host by the client created by Fetch if Options.Client is not set
+	// and Options.MaxPerHost is not set
+	DefaultMaxIdleConnsPerHost = 10
+)
+
+type key int
+
+const (
+	responseKey key = iota
+	hostSlotKey
+)
+
+// Response is the result of a request made by Fetch
+type Response struct {
+	// URL is the URL of the response, after following any redirects
+	URL        string
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+
+	// FromCache is true if the server responded with 304 Not Modified, and
+	// the response was read from the cache
+	FromCache bool
+}
+
+// ResponseFromContext retrieves the Response added to a context by Fetch
+func ResponseFromContext(ctx context.Context) (*Response, bool) {
+	r, ok := ctx.Value(responseKey).(*Response)
+	return r, ok
+}
+
+// NewContext returns a copy of ctx carrying r
+func NewContext(ctx context.Context, r *Response) context.Context {
+	return context.WithValue(ctx, responseKey, r)
+}
+
+// Options configures Fetch
+type Options struct {
+	// Request creates the request to make for a value. Required
+	Request func(ctx context.Context) (*http.Request, error)
+
+	// Client makes requests. If nil, a client with a pooled transport is
+	// created
+	Client *http.Client
+
+	// MaxPerHost is the largest number of requests that are made to a single
+	// host at once, including requests that follow redirects. Zero means no
+	// limit
+	MaxPerHost int
+
+	// MaxBodySize is the largest response body, in bytes, that is read.
+	// Larger responses fail with a *BodyTooLargeError. Zero means
+	// DefaultMaxBodySize
+	MaxBodySize int64
+
+	// MaxRedirects is the number of redirects that are followed. Zero means
+	// DefaultMaxRedirects, and a negative number means that redirects are not
+	// followed, in which case redirect responses fail with a *RedirectError
+	MaxRedirects int
+
+	// CheckRedirect, if set, is called before following each redirect, after
+	// MaxRedirects and the CheckRedirect of Client, if any, are checked. See
+	// http.Client
+	CheckRedirect func(req *http.Request, via []*http.Request) error
+
+	// Cache stores responses carrying an ETag or Last-Modified header, so that
+	// later GET requests for the same URL can be made conditional. If nil,
+	// requests are not conditional
+	Cache Cache
+}
+
+// Fetch creates a pipeline.Mapper that makes the request created by
+// opts.Request for each value, and adds the *Response to its context. See
+// ResponseFromContext. Responses with a 3xx, 4xx or 5xx status fail with a
+// *RedirectError, *ClientError or *ServerError respectively, except for a 304
+// response with no cached response to use, which fails with a
+// *NotModifiedError
+func Fetch(opts Options) pipeline.Mapper {
+	f := &fetcher{
+		opts:  opts,
+		hosts: make(map[string]chan struct{}),
+		max:   opts.MaxBodySize,
+	}
+
+	f.client = f.newClient()
+
+	if f.max <= 0 {
+		f.max = DefaultMaxBodySize
+	}
+
+	return f
+}
+
+type fetcher struct {
+	opts   Options
+	client *http.Client
+	max    int64
+
+	mu    sync.Mutex
+	hosts map[string]chan struct{}
+}
+
+func (f *fetcher) newClient() *http.Client {
+	var (
+		opts   = f.opts
+		client http.Client
+		check  func(req *http.Request, via []*http.Request) error
+	)
+
+	if opts.Client != nil {
+		client = *opts.Client
+		check = opts.Client.CheckRedirect
+	} else {
+		idle := opts.MaxPerHost
+
+		if idle <= 0 {
+			idle = DefaultMaxIdleConnsPerHost
+		}
+
+		client.Transport = &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			MaxIdleConnsPerHost: idle,
+			IdleConnTimeout:     90 * time.Second,
+		}
+	}
+
+	max := opts.MaxRedirects
+
+	if max == 0 {
+		max = DefaultMaxRedirects
+	}
+
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) > max {
+			return http.ErrUseLastResponse
+		}
+
+		for _, fn := range []func(*http.Request, []*http.Request) error{check, opts.CheckRedirect} {
+			if fn == nil {
+				continue
+			}
+
+			if err := fn(req, via); err != nil {
+				return err
+			}
+		}
+
+		// The redirect is followed, so the request counts against the
+		// limit for its new host
+		if slot, ok := req.Context().Value(hostSlotKey).(*hostSlot); ok {
+			return slot.move(req.Context(), req.URL.Host)
+		}
+
+		return nil
+	}
+
+	return &client
+}
+
+// Map satisfies the pipeline.Mapper interface
+func (f *fetcher) Map(ctx context.Context) (context.Context, error) {
+	req, err := f.opts.Request(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	release, err := f.acquire(ctx, req.URL.Host)
+
+	if err != nil {
+		return nil, err
+	}
+
+	slot := &hostSlot{f: f, host: req.URL.Host, release: release}
+	defer slot.done()
+
+	req = req.WithContext(context.WithValue(ctx, hostSlotKey, slot))
+
+	var (
+		key    = req.URL.String()
+		cached *Response
+	)
+
+	if f.opts.Cache != nil && req.Method == "GET" {
+		if r, ok := f.opts.Cache.Get(key); ok {
+			cached = r
+
+			if etag := r.Header.Get("ETag"); etag != "" {
+				req.Header.Set("If-None-Match", etag)
+			}
+
+			if lm := r.Header.Get("Last-Modified"); lm != "" {
+				req.Header.Set("If-Modified-Since", lm)
+			}
+		}
+	}
+
+	resp, err := f.client.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	url := resp.Request.URL.String()
+
+	if resp.StatusCode == http.StatusNotModified {
+		if cached == nil {
+			return nil, &NotModifiedError{StatusError{url, resp.StatusCode, resp.Status}}
+		}
+
+		r := *cached
+		r.FromCache = true
+		return NewContext(ctx, &r), nil
+	}
+
+	if err := statusError(url, resp); err != nil {
+		return nil, err
+	}
+
+	if resp.ContentLength > f.max {
+		return nil, &BodyTooLargeError{URL: url, Limit: f.max}
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, f.max+1))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(body)) > f.max {
+		return nil, &BodyTooLargeError{URL: url, Limit: f.max}
+	}
+
+	r := &Response{
+		URL:        url,
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       body,
+	}
+
+	if f.opts.Cache != nil && req.Method == "GET" && (r.Header.Get("ETag") != "" || r.Header.Get("Last-Modified") != "") {
+		f.opts.Cache.Set(key, r)
+	}
+
+	return NewContext(ctx, r), nil
+}
+
+// acquire waits until a request can be made to host, returning a func that
+// must be called once the request is done
+func (f *fetcher) acquire(ctx context.Context, host string) (func(), error) {
+	if f.opts.MaxPerHost <= 0 {
+		return func() {}, nil
+	}
+
+	f.mu.Lock()
+	sem, ok := f.hosts[host]
+
+	if !ok {
+		sem = make(chan struct{}, f.opts.MaxPerHost)
+		f.hosts[host] = sem
+	}
+
+	f.mu.Unlock()
+
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// hostSlot is the place held by a request made by Fetch in the limit for the
+// host that it is being made to, which moves as redirects are followed
+type hostSlot struct {
+	f       *fetcher
+	host    string
+	release func()
+}
+
+// move gives up the place held for the current host and waits for a place for
+// host, if they differ
+func (s *hostSlot) move(ctx context.Context, host string) error {
+	if host == s.host {
+		return nil
+	}
+
+	s.release()
+	s.release = func() {}
+
+	release, err := s.f.acquire(ctx, host)
+
+	if err != nil {
+		return err
+	}
+
+	s.host, s.release = host, release
+
+	return nil
+}
+
+// done gives up the place held by the request
+func (s *hostSlot) done() {
+	s.release()
+}
+
+// StatusError describes a response with an unsuccessful status
+type StatusError struct {
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s: %s", e.URL, e.Status)
+}
+
+// RedirectError is returned for 3xx responses that were not followed
+type RedirectError struct {
+	StatusError
+
+	// Location is the URL that the response redirects to, if any
+	Location string
+}
+
+// NotModifiedError is returned for 304 responses when there is no cached
+// response to use in their place, for example because the request made by
+// Options.Request was already conditional, or Options.Cache is nil
+type NotModifiedError struct {
+	StatusError
+}
+
+func (e *NotModifiedError) Error() string {
+	return fmt.Sprintf("%s: %s, with no cached response", e.URL, e.Status)
+}
+
+// ClientError is returned for 4xx responses
+type ClientError struct {
+	StatusError
+}
+
+// ServerError is returned for 5xx responses
+type ServerError struct {
+	StatusError
+}
+
+func statusError(url string, resp *http.Response) error {
+	e := StatusError{url, resp.StatusCode, resp.Status}
+
+	switch {
+	case resp.StatusCode >= 500:
+		return &ServerError{e}
+	case resp.StatusCode >= 400:
+		return &ClientError{e}
+	case resp.StatusCode >= 300:
+		return &RedirectError{e, resp.Header.Get("Location")}
+	}
+
+	return nil
+}
+
+// BodyTooLargeError is returned when a response body is larger than
+// Options.MaxBodySize
+type BodyTooLargeError struct {
+	URL   string
+	Limit int64
+}
+
+func (e *BodyTooLargeError) Error() string {
+	return fmt.Sprintf("%s: Response body is larger than %d bytes", e.URL, e.Limit)
+}
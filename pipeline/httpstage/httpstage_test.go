@@ -0,0 +1,355 @@
+package httpstage
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+type urlKey int
+
+func withURL(url string) context.Context {
+	return context.WithValue(context.Background(), urlKey(0), url)
+}
+
+func get(ctx context.Context) (*http.Request, error) {
+	return http.NewRequest("GET", ctx.Value(urlKey(0)).(string), nil)
+}
+
+func fetch(t *testing.T, opts Options, url string) (*Response, error) {
+	opts.Request = get
+	ctx, err := Fetch(opts).Map(withURL(url))
+
+	if err != nil {
+		return nil, err
+	}
+
+	r, ok := ResponseFromContext(ctx)
+
+	if !ok {
+		t.Fatal("Want response in context")
+	}
+
+	return r, nil
+}
+
+func TestFetch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	}))
+
+	defer server.Close()
+
+	r, err := fetch(t, Options{}, server.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(r.Body) != "hello" || r.StatusCode != http.StatusOK || r.URL != server.URL {
+		t.Errorf("Unexpected response %+v", r)
+	}
+}
+
+func TestFetchStatusErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			http.NotFound(w, r)
+		case "/broken":
+			http.Error(w, "broken", http.StatusInternalServerError)
+		}
+	}))
+
+	defer server.Close()
+
+	_, err := fetch(t, Options{}, server.URL+"/missing")
+
+	var ce *ClientError
+
+	if !errors.As(err, &ce) || ce.StatusCode != http.StatusNotFound {
+		t.Errorf("Want ClientError, got %v", err)
+	}
+
+	_, err = fetch(t, Options{}, server.URL+"/broken")
+
+	var se *ServerError
+
+	if !errors.As(err, &se) || se.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Want ServerError, got %v", err)
+	}
+}
+
+func TestFetchRedirects(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/new", http.StatusMovedPermanently)
+			return
+		}
+
+		fmt.Fprint(w, r.URL.Path)
+	}))
+
+	defer server.Close()
+
+	r, err := fetch(t, Options{}, server.URL+"/old")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.URL != server.URL+"/new" || string(r.Body) != "/new" {
+		t.Errorf("Want redirect to be followed, got %+v", r)
+	}
+
+	_, err = fetch(t, Options{MaxRedirects: -1}, server.URL+"/old")
+
+	var re *RedirectError
+
+	if !errors.As(err, &re) || re.Location != "/new" {
+		t.Errorf("Want RedirectError, got %v", err)
+	}
+}
+
+func TestFetchClientCheckRedirect(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/new", http.StatusMovedPermanently)
+			return
+		}
+
+		fmt.Fprint(w, r.URL.Path)
+	}))
+
+	defer server.Close()
+
+	var calls []string
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			calls = append(calls, "client")
+			return nil
+		},
+	}
+
+	_, err := fetch(t, Options{
+		Client: client,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			calls = append(calls, "options")
+			return errors.New("Redirect refused")
+		},
+	}, server.URL+"/old")
+
+	if err == nil || !strings.Contains(err.Error(), "Redirect refused") {
+		t.Errorf("Want redirect to be refused, got %v", err)
+	}
+
+	if strings.Join(calls, ",") != "client,options" {
+		t.Errorf("Want both CheckRedirect funcs to be called, got %v", calls)
+	}
+}
+
+func TestFetchMaxBodySize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Flush first, so that the response has no content length
+		fmt.Fprint(w, "0123")
+		w.(http.Flusher).Flush()
+		fmt.Fprint(w, "456789")
+	}))
+
+	defer server.Close()
+
+	_, err := fetch(t, Options{MaxBodySize: 5}, server.URL)
+
+	var be *BodyTooLargeError
+
+	if !errors.As(err, &be) {
+		t.Errorf("Want BodyTooLargeError, got %v", err)
+	}
+
+	if _, err := fetch(t, Options{MaxBodySize: 10}, server.URL); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFetchConditional(t *testing.T) {
+	var hits int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprint(w, "cached")
+	}))
+
+	defer server.Close()
+
+	cache := NewMemoryCache()
+	opts := Options{Cache: cache}
+
+	for i := 0; i < 3; i++ {
+		r, err := fetch(t, opts, server.URL)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(r.Body) != "cached" || r.FromCache != (i > 0) {
+			t.Errorf("%d: unexpected response %+v", i, r)
+		}
+	}
+
+	if hits != 1 || cache.Len() != 1 {
+		t.Errorf("Want 1 full response and 1 cached, got %d and %d", hits, cache.Len())
+	}
+}
+
+func TestFetchNotModifiedWithoutCache(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotModified)
+	}))
+
+	defer server.Close()
+
+	_, err := fetch(t, Options{Cache: NewMemoryCache()}, server.URL)
+
+	var ne *NotModifiedError
+
+	if !errors.As(err, &ne) || ne.StatusCode != http.StatusNotModified {
+		t.Errorf("Want NotModifiedError, got %v", err)
+	}
+}
+
+func TestFetchMaxPerHost(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		current int
+		max     int
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		current++
+		if current > max {
+			max = current
+		}
+		mu.Unlock()
+
+		time.Sleep(time.Millisecond * 20)
+
+		mu.Lock()
+		current--
+		mu.Unlock()
+	}))
+
+	defer server.Close()
+
+	var (
+		wg sync.WaitGroup
+		m  = Fetch(Options{Request: get, MaxPerHost: 2})
+	)
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if _, err := m.Map(withURL(server.URL)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if max > 2 {
+		t.Errorf("Want at most 2 concurrent requests, got %d", max)
+	}
+}
+
+func TestFetchRequestError(t *testing.T) {
+	m := Fetch(Options{
+		Request: func(ctx context.Context) (*http.Request, error) {
+			return nil, errors.New("Bad request")
+		},
+	})
+
+	if _, err := m.Map(context.Background()); err == nil || !strings.Contains(err.Error(), "Bad request") {
+		t.Errorf("Want request error, got %v", err)
+	}
+}
+
+func TestFetchMaxPerHostRedirects(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		current int
+		max     int
+	)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		current++
+		if current > max {
+			max = current
+		}
+		mu.Unlock()
+
+		time.Sleep(time.Millisecond * 20)
+
+		mu.Lock()
+		current--
+		mu.Unlock()
+	}))
+
+	defer target.Close()
+
+	redirector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL, http.StatusFound)
+	}))
+
+	defer redirector.Close()
+
+	var (
+		wg sync.WaitGroup
+		m  = Fetch(Options{Request: get, MaxPerHost: 1})
+	)
+
+	// Half of the requests reach the target by a redirect, and must still
+	// wait for the requests made to it directly
+	for i := 0; i < 8; i++ {
+		url := target.URL
+
+		if i%2 == 0 {
+			url = redirector.URL
+		}
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if _, err := m.Map(withURL(url)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if max > 1 {
+		t.Errorf("Want at most 1 concurrent request, got %d", max)
+	}
+}
@@ -7,15 +7,23 @@ import (
 	"golang.org/x/net/context"
 )
 
+// Loop creates a Pipeline that feeds all output of p back in to p, as well as
+// sending it on the output stream. Errors from p are sent on the output stream.
+// Once the input stream is closed the loop drains: values already in p are
+// allowed to finish and are sent on the output stream, but are no longer fed
+// back. The output stream is closed once p has finished
 func Loop(p Pipeline) Pipeline {
-	return func(in stream.Stream) stream.Stream {
+	return newStage("Loop", 1, p, func(s *stage, in stream.Stream) stream.Stream {
 		var (
+			mu              sync.Mutex
 			wg              sync.WaitGroup
+			draining        bool
 			feedback        = make(chan context.Context)
 			pipeIn, pipeCls = stream.WithValues(feedback)
-			out             = p(pipeIn)
-			echo, cls       = stream.New()
-			done            = make(chan interface{})
+			out             = p(withMiddlewareOf(in, pipeIn))
+			echo, cls       = in.WithValues(make(chan context.Context))
+			done            = make(chan struct{})
+			forwarded       = make(chan struct{})
 		)
 
 		go func() {
@@ -26,36 +34,73 @@ func Loop(p Pipeline) Pipeline {
 			}
 		}()
 
+		// Once the input is closed, wait for values that are on their way
+		// around the loop to either be fed back or sent on the output
+		// stream, then close the input of p so that it can finish
 		go func() {
+			<-done
 
-			defer func() {
-				defer cls()
-				defer pipeCls()
-				wg.Wait()
-			}()
-
-			for {
-				select {
-				case <-done:
-					return
-				case ctx := <-out.Values():
+			mu.Lock()
+			draining = true
+			mu.Unlock()
+
+			wg.Wait()
+			pipeCls()
+		}()
+
+		go func() {
+			defer close(forwarded)
+
+			for err := range out.Errors() {
+				echo.Error(err)
+			}
+		}()
+
+		go func() {
+			defer cls()
+
+			for ctx := range out.Values() {
+				mu.Lock()
+				feed := !draining
+
+				if feed {
 					wg.Add(1)
+				}
+
+				mu.Unlock()
 
-					go func(ctx context.Context) {
-						defer wg.Done()
-
-						select {
-						case <-done:
-							return
-						case feedback <- ctx:
-							echo.Value(ctx)
-							return
-						}
-					}(ctx)
+				if !feed {
+					echo.Value(ctx)
+					continue
 				}
+
+				go func(ctx context.Context) {
+					defer wg.Done()
+
+					// Each trip around the loop is an activity,
+					// covering the time spent waiting for the loop
+					// to accept the value as feedback
+					ctx, a := begin(ctx, s.info(0))
+					defer a.end()
+
+					// A paused loop stops feeding values back,
+					// as it would otherwise never come to rest
+					waitIfPaused(ctx)
+
+					select {
+					case <-done:
+					case feedback <- ctx:
+						a.processed(nil)
+						a.handOff(2)
+					}
+
+					echo.Value(ctx)
+				}(ctx)
 			}
+
+			<-forwarded
 		}()
 
 		return echo
-	}
+	})
 }
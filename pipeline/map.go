@@ -23,14 +23,18 @@ func (fn MapperFunc) Map(ctx context.Context) (context.Context, error) {
 // Map creates a Pipeline that maps all values from its input stream to its
 // output stream via the Mapper m
 func Map(m Mapper) Pipeline {
-	return PMap(m, 1)
+	return pmap("Map", m, 1)
 }
 
 // PMap is a parallel implementation of Map. It produces a Pipeline that maps
 // all values from its input stream to its output stream via n concurrent instances
 // of the Mapper m
 func PMap(m Mapper, n int) Pipeline {
-	return func(in stream.Stream) stream.Stream {
+	return pmap("PMap", m, n)
+}
+
+func pmap(t string, m Mapper, n int) Pipeline {
+	return newStage(t, n, nil, func(s *stage, in stream.Stream) stream.Stream {
 		var (
 			wg       sync.WaitGroup
 			out, cls = in.WithValues(make(chan context.Context))
@@ -39,18 +43,26 @@ func PMap(m Mapper, n int) Pipeline {
 		wg.Add(n)
 
 		for i := 0; i < n; i++ {
-			go func() {
+			go func(info StageInfo) {
 				defer wg.Done()
 
+				m := s.wrapMapper(info, m)
+
 				for ctx := range in.Values() {
+					ctx, a := begin(ctx, info)
 					value, err := m.Map(ctx)
+					a.processed(err)
+
 					if err == nil {
-						out.Value(value)
+						out.Value(inheritAck(ctx, value))
 					} else {
+						Nack(ctx, err)
 						out.Error(err)
 					}
+
+					a.end()
 				}
-			}()
+			}(s.info(i))
 		}
 
 		go func() {
@@ -59,5 +71,5 @@ func PMap(m Mapper, n int) Pipeline {
 		}()
 
 		return out
-	}
+	})
 }
@@ -0,0 +1,149 @@
+package pipeline
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+type metricsKey int
+
+const metricsContextKey metricsKey = 0
+
+// DefaultBuckets are the upper bounds, in seconds, of the duration histogram
+// buckets used by NewMetrics
+var DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics collects per-stage counters and duration histograms. Built-in stages
+// report to the Metrics carried by the context of each value they process, so
+// instrumenting a pipeline is a matter of adding Metrics to the context passed
+// to Run, or to the contexts sent on the input stream
+type Metrics struct {
+	mu      sync.Mutex
+	buckets []float64
+	stages  map[StageInfo]*StageMetrics
+}
+
+// StageMetrics is a snapshot of the metrics collected for one worker of a stage
+type StageMetrics struct {
+	StageInfo
+
+	// Number of values processed
+	Items uint64
+
+	// Number of values that resulted in an error
+	Errors uint64
+
+	// Cumulative counts of durations less than or equal to the corresponding
+	// upper bound in Buckets
+	Counts []uint64
+
+	// Upper bounds of the duration histogram buckets, in seconds
+	Buckets []float64
+
+	// Total time spent processing values
+	Sum time.Duration
+}
+
+// NewMetrics creates Metrics using DefaultBuckets for duration histograms
+func NewMetrics() *Metrics {
+	return NewMetricsWithBuckets(DefaultBuckets)
+}
+
+// NewMetricsWithBuckets creates Metrics using the provided upper bounds, in
+// seconds, for duration histograms
+func NewMetricsWithBuckets(buckets []float64) *Metrics {
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+
+	return &Metrics{
+		buckets: b,
+		stages:  make(map[StageInfo]*StageMetrics),
+	}
+}
+
+// WithMetrics returns a copy of ctx carrying m
+func WithMetrics(ctx context.Context, m *Metrics) context.Context {
+	return context.WithValue(ctx, metricsContextKey, m)
+}
+
+// MetricsFromContext retrieves Metrics from ctx
+func MetricsFromContext(ctx context.Context) (*Metrics, bool) {
+	m, ok := ctx.Value(metricsContextKey).(*Metrics)
+	return m, ok
+}
+
+// Observe records that a stage took d to process a value, resulting in err
+func (m *Metrics) Observe(info StageInfo, d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Metrics are reported by name, so stages that share a name share metrics
+	info.stage = nil
+
+	s, ok := m.stages[info]
+
+	if !ok {
+		s = &StageMetrics{
+			StageInfo: info,
+			Counts:    make([]uint64, len(m.buckets)),
+			Buckets:   m.buckets,
+		}
+		m.stages[info] = s
+	}
+
+	s.Items++
+	s.Sum += d
+
+	if err != nil {
+		s.Errors++
+	}
+
+	seconds := d.Seconds()
+
+	for i := range m.buckets {
+		if seconds <= m.buckets[i] {
+			s.Counts[i]++
+		}
+	}
+}
+
+// Stages returns a snapshot of the metrics collected so far, ordered by stage
+// name, type and worker
+func (m *Metrics) Stages() []StageMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stages := make([]StageMetrics, 0, len(m.stages))
+
+	for _, s := range m.stages {
+		snapshot := *s
+		snapshot.Counts = append([]uint64(nil), s.Counts...)
+		stages = append(stages, snapshot)
+	}
+
+	sort.Sort(byStage(stages))
+
+	return stages
+}
+
+type byStage []StageMetrics
+
+func (s byStage) Len() int      { return len(s) }
+func (s byStage) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+func (s byStage) Less(i, j int) bool {
+	a, b := s[i].StageInfo, s[j].StageInfo
+
+	if a.Name != b.Name {
+		return a.Name < b.Name
+	}
+
+	if a.Type != b.Type {
+		return a.Type < b.Type
+	}
+
+	return a.Worker < b.Worker
+}
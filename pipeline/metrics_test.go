@@ -0,0 +1,82 @@
+package pipeline
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestMetricsObservesStages(t *testing.T) {
+	var (
+		metrics = NewMetrics()
+		inputs  = make([]context.Context, 10)
+	)
+
+	mapper := MapperFunc(func(ctx context.Context) (context.Context, error) {
+		if FromContext(ctx)%2 == 0 {
+			return nil, fmt.Errorf("even")
+		}
+		return ctx, nil
+	})
+
+	for i := range inputs {
+		inputs[i] = NewContext(WithMetrics(context.Background(), metrics), i)
+	}
+
+	runPipeline(PMap(mapper, 2).Filter(func(ctx context.Context) bool {
+		return true
+	}), inputs)
+
+	var items, errors, filtered uint64
+
+	for _, s := range metrics.Stages() {
+		switch s.Type {
+		case "PMap":
+			items += s.Items
+			errors += s.Errors
+		case "Filter":
+			filtered += s.Items
+		default:
+			t.Errorf("Unexpected stage type %s", s.Type)
+		}
+	}
+
+	if items != 10 {
+		t.Errorf("Want %d items, got %d", 10, items)
+	}
+
+	if errors != 5 {
+		t.Errorf("Want %d errors, got %d", 5, errors)
+	}
+
+	if filtered != 5 {
+		t.Errorf("Want %d filtered items, got %d", 5, filtered)
+	}
+}
+
+func TestMetricsHistogram(t *testing.T) {
+	var (
+		metrics = NewMetricsWithBuckets([]float64{1, 0.01})
+		info    = StageInfo{Name: "Map", Type: "Map"}
+	)
+
+	metrics.Observe(info, time.Millisecond, nil)
+	metrics.Observe(info, time.Millisecond*100, nil)
+	metrics.Observe(info, time.Second*2, nil)
+
+	stages := metrics.Stages()
+
+	if len(stages) != 1 {
+		t.Fatalf("Want %d stages, got %d", 1, len(stages))
+	}
+
+	want := []uint64{1, 2}
+
+	for i := range want {
+		if stages[0].Counts[i] != want[i] {
+			t.Errorf("Want count %d for bucket %v, got %d", want[i], stages[0].Buckets[i], stages[0].Counts[i])
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package pipeline
+
+import (
+	"fmt"
+
+	"github.com/bernos/go-pipeline/pipeline/stream"
+	"golang.org/x/net/context"
+)
+
+// Middleware wraps the Mapper used by a Map, PMap or Swappable stage, adding
+// cross-cutting behaviour such as logging, panic recovery or context enrichment.
+// Middleware is applied to a pipeline using WithMiddleware
+type Middleware func(StageInfo, Mapper) Mapper
+
+// FlatMapperMiddleware wraps the FlatMapper used by a FlatMap or PFlatMap stage
+type FlatMapperMiddleware func(StageInfo, FlatMapper) FlatMapper
+
+// PredicateMiddleware wraps the Predicate used by a Filter, TakeUntil or TakeWhile
+// stage
+type PredicateMiddleware func(StageInfo, Predicate) Predicate
+
+// ReducerMiddleware wraps the Reducer used by a ReduceLeft or ReduceRight stage
+type ReducerMiddleware func(StageInfo, Reducer) Reducer
+
+// SinkMiddleware wraps the function used by a Sink stage
+type SinkMiddleware func(StageInfo, func(context.Context) error) func(context.Context) error
+
+// Middlewares is the middleware applied to the built-in stages of a pipeline by
+// WithMiddleware. Within each list, the first middleware is outermost
+type Middlewares struct {
+	Mappers     []Middleware
+	FlatMappers []FlatMapperMiddleware
+	Predicates  []PredicateMiddleware
+	Reducers    []ReducerMiddleware
+	Sinks       []SinkMiddleware
+}
+
+// WithMiddleware creates a Pipeline that runs p with mw applied to each of its
+// built-in stages, including those in pipelines wrapped by Loop, Tee and
+// Parallel stages. Stages that follow the returned pipeline are not affected.
+// Middleware is applied once per worker when a stage starts. Where pipelines
+// with middleware are nested, the middleware of the outer pipeline is applied
+// outside that of the inner one
+func WithMiddleware(p Pipeline, mw Middlewares) Pipeline {
+	return func(in stream.Stream) stream.Stream {
+		if d, ok := in.(*describer); ok {
+			return p(d)
+		}
+
+		scope := &middlewareScope{in, &mw}
+		out := p(scope)
+
+		// Stop applying the middleware in any pipeline that follows
+		if m, ok := out.(*middlewareScope); ok && m.middleware == scope.middleware {
+			return m.Stream
+		}
+
+		return out
+	}
+}
+
+// middlewareScope is the input to a pipeline with middleware. It is passed on to
+// the streams derived from it, so that each stage in the pipeline finds the
+// middleware on its input
+type middlewareScope struct {
+	stream.Stream
+	middleware *Middlewares
+}
+
+func (m *middlewareScope) WithValues(values chan context.Context) (stream.Stream, stream.CloseFunc) {
+	s, cls := m.Stream.WithValues(values)
+	return &middlewareScope{s, m.middleware}, cls
+}
+
+// middlewareOf returns the middleware in scope for a stage with input in,
+// innermost first
+func middlewareOf(in stream.Stream) []*Middlewares {
+	var mw []*Middlewares
+
+	for s := in; s != nil; s = unwrap(s) {
+		if m, ok := s.(*middlewareScope); ok {
+			mw = append(mw, m.middleware)
+		}
+	}
+
+	return mw
+}
+
+// withMiddlewareOf wraps s so that the stages of a pipeline run on it, such as
+// one wrapped by a Loop or Parallel stage, have the middleware in scope for a
+// stage with input in
+func withMiddlewareOf(in, s stream.Stream) stream.Stream {
+	mw := middlewareOf(in)
+
+	for i := len(mw) - 1; i >= 0; i-- {
+		s = &middlewareScope{s, mw[i]}
+	}
+
+	return s
+}
+
+func (s *stage) wrapMapper(info StageInfo, m Mapper) Mapper {
+	for _, mw := range s.middleware {
+		for i := len(mw.Mappers) - 1; i >= 0; i-- {
+			m = mw.Mappers[i](info, m)
+		}
+	}
+
+	return m
+}
+
+func (s *stage) wrapFlatMapper(info StageInfo, m FlatMapper) FlatMapper {
+	for _, mw := range s.middleware {
+		for i := len(mw.FlatMappers) - 1; i >= 0; i-- {
+			m = mw.FlatMappers[i](info, m)
+		}
+	}
+
+	return m
+}
+
+func (s *stage) wrapPredicate(info StageInfo, p Predicate) Predicate {
+	for _, mw := range s.middleware {
+		for i := len(mw.Predicates) - 1; i >= 0; i-- {
+			p = mw.Predicates[i](info, p)
+		}
+	}
+
+	return p
+}
+
+func (s *stage) wrapReducer(info StageInfo, r Reducer) Reducer {
+	for _, mw := range s.middleware {
+		for i := len(mw.Reducers) - 1; i >= 0; i-- {
+			r = mw.Reducers[i](info, r)
+		}
+	}
+
+	return r
+}
+
+func (s *stage) wrapSink(info StageInfo, fn func(context.Context) error) func(context.Context) error {
+	for _, mw := range s.middleware {
+		for i := len(mw.Sinks) - 1; i >= 0; i-- {
+			fn = mw.Sinks[i](info, fn)
+		}
+	}
+
+	return fn
+}
+
+// Recover creates Middleware that recovers from a panic in a Mapper, sending
+// an error on the stage's error stream instead
+func Recover() Middleware {
+	return func(info StageInfo, m Mapper) Mapper {
+		return MapperFunc(func(ctx context.Context) (out context.Context, err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					out, err = nil, fmt.Errorf("Stage %s panicked: %v", info.Name, r)
+				}
+			}()
+
+			return m.Map(ctx)
+		})
+	}
+}
+
+// RecoverFlatMapper creates FlatMapperMiddleware that recovers from a panic in
+// a FlatMapper, sending an error on the stage's error stream instead
+func RecoverFlatMapper() FlatMapperMiddleware {
+	return func(info StageInfo, m FlatMapper) FlatMapper {
+		return FlatMapperFunc(func(ctx context.Context) (out []context.Context, err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					out, err = nil, fmt.Errorf("Stage %s panicked: %v", info.Name, r)
+				}
+			}()
+
+			return m.FlatMap(ctx)
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package pipeline
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestMiddlewareIsAppliedByBuilderMethods(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		calls []string
+	)
+
+	record := func(s string) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, s)
+	}
+
+	mw := Middlewares{
+		Mappers: []Middleware{func(info StageInfo, m Mapper) Mapper {
+			return MapperFunc(func(ctx context.Context) (context.Context, error) {
+				record("outer " + info.Name)
+				return m.Map(ctx)
+			})
+		}, func(info StageInfo, m Mapper) Mapper {
+			return MapperFunc(func(ctx context.Context) (context.Context, error) {
+				record("inner " + info.Name)
+				return m.Map(ctx)
+			})
+		}},
+		Predicates: []PredicateMiddleware{func(info StageInfo, p Predicate) Predicate {
+			return func(ctx context.Context) bool {
+				record("predicate " + info.Type)
+				return p(ctx)
+			}
+		}},
+	}
+
+	identity := MapperFunc(func(ctx context.Context) (context.Context, error) {
+		return ctx, nil
+	})
+
+	pl := Map(identity).Named("identity").Filter(func(ctx context.Context) bool {
+		return true
+	}).WithMiddleware(mw)
+
+	values, _ := runPipeline(pl, []context.Context{NewContext(context.Background(), 1)})
+
+	if len(values) != 1 {
+		t.Fatalf("Want %d values, got %d", 1, len(values))
+	}
+
+	want := []string{"outer identity", "inner identity", "predicate Filter"}
+
+	if len(calls) != len(want) {
+		t.Fatalf("Want calls %v, got %v", want, calls)
+	}
+
+	for i := range want {
+		if calls[i] != want[i] {
+			t.Errorf("Want %s, got %s", want[i], calls[i])
+		}
+	}
+}
+
+func TestMiddlewareIsAppliedPerWorker(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		workers = make(map[int]bool)
+	)
+
+	mw := Middlewares{Mappers: []Middleware{func(info StageInfo, m Mapper) Mapper {
+		mu.Lock()
+		defer mu.Unlock()
+		workers[info.Worker] = true
+		return m
+	}}}
+
+	identity := MapperFunc(func(ctx context.Context) (context.Context, error) {
+		return ctx, nil
+	})
+
+	runPipeline(WithMiddleware(PMap(identity, 3), mw), []context.Context{context.Background()})
+
+	if len(workers) != 3 {
+		t.Errorf("Want %d workers, got %d", 3, len(workers))
+	}
+}
+
+func TestRecover(t *testing.T) {
+	mw := Middlewares{
+		Mappers:     []Middleware{Recover()},
+		FlatMappers: []FlatMapperMiddleware{RecoverFlatMapper()},
+	}
+
+	mapper := MapperFunc(func(ctx context.Context) (context.Context, error) {
+		panic("boom")
+	})
+
+	flatMapper := FlatMapperFunc(func(ctx context.Context) ([]context.Context, error) {
+		panic("boom")
+	})
+
+	values, errors := runPipeline(Map(mapper).WithMiddleware(mw), []context.Context{context.Background()})
+
+	if len(values) != 0 || len(errors) != 1 {
+		t.Errorf("Want %d values and %d errors, got %d and %d", 0, 1, len(values), len(errors))
+	}
+
+	values, errors = runPipeline(FlatMap(flatMapper).WithMiddleware(mw), []context.Context{context.Background()})
+
+	if len(values) != 0 || len(errors) != 1 {
+		t.Errorf("Want %d values and %d errors, got %d and %d", 0, 1, len(values), len(errors))
+	}
+}
+
+func TestMiddlewareIsScopedToPipeline(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		calls []string
+	)
+
+	record := func(name string) Middleware {
+		return func(info StageInfo, m Mapper) Mapper {
+			return MapperFunc(func(ctx context.Context) (context.Context, error) {
+				mu.Lock()
+				calls = append(calls, name+" "+info.Name)
+				mu.Unlock()
+				return m.Map(ctx)
+			})
+		}
+	}
+
+	identity := MapperFunc(func(ctx context.Context) (context.Context, error) {
+		return ctx, nil
+	})
+
+	// The inner pipeline runs inside a Parallel stage, and the last stage
+	// follows the pipelines with middleware
+	inner := Map(identity).Named("inner").WithMiddleware(Middlewares{Mappers: []Middleware{record("inner")}})
+	outer := Parallel(inner, 1).WithMiddleware(Middlewares{Mappers: []Middleware{record("outer")}})
+	pl := outer.Compose(Map(identity).Named("after"))
+
+	values, _ := runPipeline(pl, []context.Context{NewContext(context.Background(), 1)})
+
+	if len(values) != 1 {
+		t.Fatalf("Want %d values, got %d", 1, len(values))
+	}
+
+	if want := "outer inner,inner inner"; strings.Join(calls, ",") != want {
+		t.Errorf("Want calls %s, got %s", want, strings.Join(calls, ","))
+	}
+}
+
+func TestSinkMiddleware(t *testing.T) {
+	var got []int
+
+	mw := Middlewares{Sinks: []SinkMiddleware{func(info StageInfo, fn func(context.Context) error) func(context.Context) error {
+		return func(ctx context.Context) error {
+			got = append(got, FromContext(ctx))
+			return fn(ctx)
+		}
+	}}}
+
+	sink := Sink(func(ctx context.Context) error {
+		return nil
+	})
+
+	runPipeline(sink.WithMiddleware(mw), []context.Context{NewContext(context.Background(), 1), NewContext(context.Background(), 2)})
+
+	if fmt.Sprint(got) != "[1 2]" {
+		t.Errorf("Want [1 2], got %v", got)
+	}
+}
@@ -0,0 +1,15 @@
+module github.com/bernos/go-pipeline/pipeline/oteltrace
+
+go 1.23.0
+
+require (
+	github.com/bernos/go-pipeline v0.0.0
+	go.opentelemetry.io/otel v1.38.0
+	go.opentelemetry.io/otel/trace v1.38.0
+	golang.org/x/net v0.40.0
+)
+
+require gopkg.in/yaml.v3 v3.0.1 // indirect
+
+// Build against the pipeline package in this repository
+replace github.com/bernos/go-pipeline => ../..
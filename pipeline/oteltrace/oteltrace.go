@@ -0,0 +1,49 @@
+// Package oteltrace adapts an OpenTelemetry Tracer for use as a pipeline.Tracer,
+// so that values can be followed through a pipeline using any OpenTelemetry
+// compatible tracing backend. It is a module of its own, so that programs that
+// don't use it don't depend on OpenTelemetry
+package oteltrace
+
+import (
+	"github.com/bernos/go-pipeline/pipeline"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+)
+
+// New creates a pipeline.Tracer that starts a span using t for each value
+// processed by a stage. Spans are named after the stage, and carry the stage type
+// and worker as attributes
+func New(t trace.Tracer) pipeline.Tracer {
+	return &tracer{t}
+}
+
+type tracer struct {
+	tracer trace.Tracer
+}
+
+func (t *tracer) Start(ctx context.Context, info pipeline.StageInfo) (context.Context, pipeline.Span) {
+	ctx, span := t.tracer.Start(ctx, info.Name,
+		trace.WithSpanKind(trace.SpanKindInternal),
+		trace.WithAttributes(
+			attribute.String("pipeline.stage.name", info.Name),
+			attribute.String("pipeline.stage.type", info.Type),
+			attribute.Int("pipeline.stage.worker", info.Worker),
+		))
+
+	return ctx, &otelSpan{span}
+}
+
+type otelSpan struct {
+	span trace.Span
+}
+
+func (s *otelSpan) SetError(err error) {
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+func (s *otelSpan) End() {
+	s.span.End()
+}
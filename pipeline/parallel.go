@@ -7,14 +7,21 @@ import (
 )
 
 // Parallel runs n instances of a Pipeline in parallel, collecting all output and errors
-// onto the output channels
+// onto the output channels. Naming a Parallel stage also names the last stage of
+// each instance, as the Parallel stage does not process values itself
 func Parallel(pl Pipeline, n int) Pipeline {
-	return func(in stream.Stream) stream.Stream {
+	return newStage("Parallel", n, pl, func(s *stage, in stream.Stream) stream.Stream {
 		var (
 			wg       sync.WaitGroup
 			out, cls = in.WithValues(make(chan context.Context))
 		)
 
+		inner := pl
+
+		if s.name != s.typ {
+			inner = Named(s.name, pl)
+		}
+
 		for i := 0; i < n; i++ {
 			wg.Add(1)
 
@@ -22,7 +29,7 @@ func Parallel(pl Pipeline, n int) Pipeline {
 				defer wg.Done()
 
 				pipelineIn, closePipeline := stream.New()
-				pipeOut := pl(pipelineIn)
+				pipeOut := inner(withMiddlewareOf(in, pipelineIn))
 
 				defer closePipeline()
 
@@ -54,5 +61,5 @@ func Parallel(pl Pipeline, n int) Pipeline {
 		}()
 
 		return out
-	}
+	})
 }
@@ -72,3 +72,25 @@ func TestParallelError(t *testing.T) {
 		t.Errorf("Expected %d errors, got %d", concurrency, errcount)
 	}
 }
+
+func TestNamedParallel(t *testing.T) {
+	metrics := NewMetrics()
+
+	identity := MapperFunc(func(ctx context.Context) (context.Context, error) {
+		return ctx, nil
+	})
+
+	pl := Parallel(Map(identity), 2).Named("fetch")
+
+	if name := Describe(pl).Stages[0].Name; name != "fetch" {
+		t.Errorf("Want %s, got %s", "fetch", name)
+	}
+
+	runPipeline(pl, []context.Context{WithMetrics(context.Background(), metrics)})
+
+	stages := metrics.Stages()
+
+	if len(stages) != 1 || stages[0].Name != "fetch" {
+		t.Errorf("Want the inner stage to be reported as %s, got %+v", "fetch", stages)
+	}
+}
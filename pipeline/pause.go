@@ -0,0 +1,108 @@
+package pipeline
+
+import (
+	"sync"
+
+	"github.com/bernos/go-pipeline/pipeline/stream"
+	"golang.org/x/net/context"
+)
+
+type pauserKey int
+
+const pauserContextKey pauserKey = 0
+
+// Pauser pauses and resumes a pipeline created by Pausable. The zero value is
+// a Pauser that is not paused
+type Pauser struct {
+	mu     sync.Mutex
+	resume chan struct{}
+}
+
+// Pause the pipeline. No new values are pulled from the input stream, and values
+// are not fed back by a Loop, but values already in the pipeline are allowed to
+// finish. Calling Pause on a paused pipeline does nothing
+func (p *Pauser) Pause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.resume == nil {
+		p.resume = make(chan struct{})
+	}
+}
+
+// Resume a paused pipeline. Calling Resume on a pipeline that is not paused does
+// nothing
+func (p *Pauser) Resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.resume != nil {
+		close(p.resume)
+		p.resume = nil
+	}
+}
+
+// Paused reports whether the pipeline is paused
+func (p *Pauser) Paused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.resume != nil
+}
+
+// Wait blocks while the pipeline is paused, or until done is closed
+func (p *Pauser) Wait(done <-chan struct{}) {
+	p.mu.Lock()
+	resume := p.resume
+	p.mu.Unlock()
+
+	if resume != nil {
+		select {
+		case <-resume:
+		case <-done:
+		}
+	}
+}
+
+// Pausable creates a Pipeline that can be paused and resumed using the returned
+// Pauser. While paused, no values are pulled from the input stream. Values that
+// have already entered the pipeline carry the Pauser in their context, so that
+// a Loop parks them before feeding them back, until the pipeline is resumed or
+// the value's context is done. Values are otherwise allowed to finish
+func Pausable(p Pipeline) (Pipeline, *Pauser) {
+	pauser := &Pauser{}
+
+	return func(in stream.Stream) stream.Stream {
+		if d, ok := in.(*describer); ok {
+			d.describe(p)
+			return d
+		}
+
+		gated, cls := in.WithValues(make(chan context.Context))
+
+		go func() {
+			defer cls()
+
+			for {
+				pauser.Wait(in.Done())
+
+				ctx, ok := <-in.Values()
+
+				if !ok {
+					return
+				}
+
+				gated.Value(context.WithValue(ctx, pauserContextKey, pauser))
+			}
+		}()
+
+		return p(gated)
+	}, pauser
+}
+
+// waitIfPaused blocks while the pipeline that ctx is passing through is paused
+func waitIfPaused(ctx context.Context) {
+	if p, ok := ctx.Value(pauserContextKey).(*Pauser); ok {
+		p.Wait(ctx.Done())
+	}
+}
@@ -0,0 +1,149 @@
+package pipeline
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bernos/go-pipeline/pipeline/stream"
+	"golang.org/x/net/context"
+)
+
+func TestPausable(t *testing.T) {
+	identity := MapperFunc(func(ctx context.Context) (context.Context, error) {
+		return ctx, nil
+	})
+
+	pl, pauser := Pausable(Map(identity))
+	in, cls := stream.New()
+	out := pl(in)
+
+	defer cls()
+
+	go func() {
+		in.Value(NewContext(context.Background(), 1))
+		in.Value(NewContext(context.Background(), 2))
+	}()
+
+	if got := FromContext(<-out.Values()); got != 1 {
+		t.Errorf("Want %d, got %d", 1, got)
+	}
+
+	pauser.Pause()
+
+	if !pauser.Paused() {
+		t.Error("Expected pipeline to be paused")
+	}
+
+	select {
+	case ctx := <-out.Values():
+		// The second value may already have been pulled before we paused
+		if got := FromContext(ctx); got != 2 {
+			t.Errorf("Want %d, got %d", 2, got)
+		}
+	case <-time.After(time.Millisecond * 50):
+		pauser.Resume()
+
+		if got := FromContext(<-out.Values()); got != 2 {
+			t.Errorf("Want %d, got %d", 2, got)
+		}
+	}
+}
+
+func TestPausableFinishesValuesInFlight(t *testing.T) {
+	var (
+		started = make(chan struct{})
+		release = make(chan struct{})
+	)
+
+	block := MapperFunc(func(ctx context.Context) (context.Context, error) {
+		started <- struct{}{}
+		<-release
+		return ctx, nil
+	})
+
+	identity := MapperFunc(func(ctx context.Context) (context.Context, error) {
+		return ctx, nil
+	})
+
+	pl, pauser := Pausable(Map(block).Map(identity))
+	in, cls := stream.New()
+	out := pl(in)
+
+	defer cls()
+
+	go in.Value(NewContext(context.Background(), 1))
+
+	<-started
+	pauser.Pause()
+	close(release)
+
+	// The value had already entered the pipeline, so passes through the
+	// rest of it while paused
+	select {
+	case ctx := <-out.Values():
+		if got := FromContext(ctx); got != 1 {
+			t.Errorf("Want %d, got %d", 1, got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for value in flight to finish")
+	}
+}
+
+func TestPausableParksWorkersInLoop(t *testing.T) {
+	var count int64
+
+	inc := MapperFunc(func(ctx context.Context) (context.Context, error) {
+		atomic.AddInt64(&count, 1)
+		return NewContext(ctx, FromContext(ctx)+1), nil
+	})
+
+	e := Map(inc).Loop().Start(NewContext(context.Background(), 0))
+	defer e.Cancel()
+
+	go func() {
+		for range e.Values() {
+		}
+	}()
+
+	time.Sleep(time.Millisecond * 10)
+	e.Pause()
+
+	// Allow the value in flight to finish
+	time.Sleep(time.Millisecond * 10)
+	paused := atomic.LoadInt64(&count)
+	time.Sleep(time.Millisecond * 20)
+
+	if got := atomic.LoadInt64(&count); got != paused {
+		t.Errorf("Expected loop to stop while paused, but count went from %d to %d", paused, got)
+	}
+
+	e.Resume()
+	time.Sleep(time.Millisecond * 10)
+
+	if got := atomic.LoadInt64(&count); got == paused {
+		t.Error("Expected loop to continue once resumed")
+	}
+}
+
+func TestCancelPausedExecution(t *testing.T) {
+	identity := MapperFunc(func(ctx context.Context) (context.Context, error) {
+		return ctx, nil
+	})
+
+	e := Map(identity).Loop().Start(context.Background())
+
+	go func() {
+		for range e.Values() {
+		}
+	}()
+
+	e.Pause()
+	e.Cancel()
+
+	select {
+	case <-e.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for paused execution to be cancelled")
+	}
+}
@@ -1,6 +1,8 @@
 package pipeline
 
 import (
+	"sync"
+
 	"github.com/bernos/go-pipeline/pipeline/stream"
 	"golang.org/x/net/context"
 )
@@ -13,12 +15,23 @@ type Pipeline func(stream.Stream) stream.Stream
 // Run the pipeline using ctx as a starting value. The pipeline will be stopped when
 // ctx is cancelled
 func (p Pipeline) Run(ctx context.Context) stream.Stream {
-	in, cls := stream.New()
-	done := ctx.Done()
+	var (
+		values  = make(chan context.Context)
+		in, cls = stream.WithValues(values)
+		done    = ctx.Done()
+	)
 
 	go func() {
 		defer cls()
-		in.Value(ctx)
+
+		// The pipeline may never pull ctx, for example if it is paused, so
+		// give up sending it if ctx is cancelled first
+		select {
+		case values <- ctx:
+		case <-done:
+			return
+		}
+
 		<-done
 	}()
 
@@ -31,6 +44,17 @@ func (p Pipeline) Compose(next Pipeline) Pipeline {
 	return Compose(next, p)
 }
 
+// Named gives the last stage of the pipeline a name
+func (p Pipeline) Named(name string) Pipeline {
+	return Named(name, p)
+}
+
+// WithMiddleware applies mw to the built-in stages of the pipeline. See
+// WithMiddleware
+func (p Pipeline) WithMiddleware(mw Middlewares) Pipeline {
+	return WithMiddleware(p, mw)
+}
+
 func (p Pipeline) Map(m Mapper) Pipeline {
 	return Compose(Map(m), p)
 }
@@ -79,6 +103,83 @@ func (p Pipeline) TakeWhile(predicate Predicate) Pipeline {
 // of the next
 func Compose(f, g Pipeline) Pipeline {
 	return func(in stream.Stream) stream.Stream {
+		if d, ok := in.(*describer); ok {
+			d.describe(g)
+			d.describe(f)
+			return d
+		}
+
 		return f(g(in))
 	}
 }
+
+// Named gives the last stage of p a name. Names are used when describing a
+// pipeline, and are reported to Metrics, Tracers and Middleware. The stage is
+// not changed, so a stage that is shared by several pipelines is only named in
+// the pipeline returned by Named. Pipelines that are not built from the stages
+// in this package can not be named. The stage is found when the pipeline is
+// first described or run
+func Named(name string, p Pipeline) Pipeline {
+	var (
+		once   sync.Once
+		target *stage
+	)
+
+	return func(in stream.Stream) stream.Stream {
+		once.Do(func() {
+			if g := Describe(p); len(g.Stages) > 0 {
+				target = g.Stages[len(g.Stages)-1].stage
+			}
+		})
+
+		if target == nil {
+			return p(in)
+		}
+
+		if d, ok := in.(*describer); ok {
+			n := len(d.nodes)
+			d.describe(p)
+
+			if len(d.nodes) > n && d.nodes[len(d.nodes)-1].stage == target {
+				d.nodes[len(d.nodes)-1].Name = name
+			}
+
+			return d
+		}
+
+		out := p(&naming{in, target, name})
+
+		// Stop naming the stage in any pipeline that follows
+		if n, ok := out.(*naming); ok && n.stage == target && n.name == name {
+			return n.Stream
+		}
+
+		return out
+	}
+}
+
+// naming is the input to a named pipeline. It is passed on to the streams
+// derived from it, so that the stage being named finds it on its input
+type naming struct {
+	stream.Stream
+	stage *stage
+	name  string
+}
+
+func (n *naming) WithValues(values chan context.Context) (stream.Stream, stream.CloseFunc) {
+	s, cls := n.Stream.WithValues(values)
+	return &naming{s, n.stage, n.name}, cls
+}
+
+// unwrap returns the stream wrapped by the input of a named pipeline or a
+// pipeline with middleware, or nil if s is neither
+func unwrap(s stream.Stream) stream.Stream {
+	switch w := s.(type) {
+	case *naming:
+		return w.Stream
+	case *middlewareScope:
+		return w.Stream
+	}
+
+	return nil
+}
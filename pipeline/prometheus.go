@@ -0,0 +1,72 @@
+package pipeline
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// PrometheusHandler creates an http.Handler that serves m in the Prometheus text
+// exposition format. Each series is labelled with the stage name, stage type and
+// worker
+func PrometheusHandler(m *Metrics) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		buf := bufio.NewWriter(w)
+		defer buf.Flush()
+
+		writePrometheus(buf, m.Stages())
+	})
+}
+
+func writePrometheus(w *bufio.Writer, stages []StageMetrics) {
+	fmt.Fprintln(w, "# HELP pipeline_stage_items_total Number of values processed by a pipeline stage.")
+	fmt.Fprintln(w, "# TYPE pipeline_stage_items_total counter")
+
+	for _, s := range stages {
+		fmt.Fprintf(w, "pipeline_stage_items_total{%s} %d\n", labels(s.StageInfo), s.Items)
+	}
+
+	fmt.Fprintln(w, "# HELP pipeline_stage_errors_total Number of values that a pipeline stage failed to process.")
+	fmt.Fprintln(w, "# TYPE pipeline_stage_errors_total counter")
+
+	for _, s := range stages {
+		fmt.Fprintf(w, "pipeline_stage_errors_total{%s} %d\n", labels(s.StageInfo), s.Errors)
+	}
+
+	fmt.Fprintln(w, "# HELP pipeline_stage_duration_seconds Time taken by a pipeline stage to process a value.")
+	fmt.Fprintln(w, "# TYPE pipeline_stage_duration_seconds histogram")
+
+	for _, s := range stages {
+		l := labels(s.StageInfo)
+
+		for i, le := range s.Buckets {
+			fmt.Fprintf(w, "pipeline_stage_duration_seconds_bucket{%s,le=\"%s\"} %d\n", l, formatFloat(le), s.Counts[i])
+		}
+
+		fmt.Fprintf(w, "pipeline_stage_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", l, s.Items)
+		fmt.Fprintf(w, "pipeline_stage_duration_seconds_sum{%s} %s\n", l, formatFloat(s.Sum.Seconds()))
+		fmt.Fprintf(w, "pipeline_stage_duration_seconds_count{%s} %d\n", l, s.Items)
+	}
+}
+
+func labels(info StageInfo) string {
+	return fmt.Sprintf(`stage="%s",type="%s",worker="%d"`,
+		labelEscaper.Replace(info.Name),
+		labelEscaper.Replace(info.Type),
+		info.Worker)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,42 @@
+package pipeline
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusHandler(t *testing.T) {
+	metrics := NewMetricsWithBuckets([]float64{0.5})
+	metrics.Observe(StageInfo{Name: `fetch "urls"`, Type: "PMap", Worker: 3}, time.Second, fmt.Errorf("failed"))
+
+	server := httptest.NewServer(PrometheusHandler(metrics))
+	defer server.Close()
+
+	resp, err := server.Client().Get(server.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	want := []string{
+		"# TYPE pipeline_stage_items_total counter",
+		`pipeline_stage_items_total{stage="fetch \"urls\"",type="PMap",worker="3"} 1`,
+		`pipeline_stage_errors_total{stage="fetch \"urls\"",type="PMap",worker="3"} 1`,
+		`pipeline_stage_duration_seconds_bucket{stage="fetch \"urls\"",type="PMap",worker="3",le="0.5"} 0`,
+		`pipeline_stage_duration_seconds_bucket{stage="fetch \"urls\"",type="PMap",worker="3",le="+Inf"} 1`,
+		`pipeline_stage_duration_seconds_sum{stage="fetch \"urls\"",type="PMap",worker="3"} 1`,
+	}
+
+	for _, line := range want {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("Expected output to contain %s, got\n%s", line, body)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+
+	"github.com/bernos/go-pipeline/pipeline/stream"
+	"golang.org/x/net/context"
+)
+
+// ToJSONLines creates a Pipeline that writes each value from its input stream to
+// w as a line of JSON. The value to encode is retrieved from each context by
+// value. See ToWriter
+func ToJSONLines(w io.Writer, value func(context.Context) (interface{}, error)) Pipeline {
+	return toWriter("ToJSONLines", w, func(ctx context.Context) ([]byte, error) {
+		v, err := value(ctx)
+
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := json.Marshal(v)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return append(data, '\n'), nil
+	})
+}
+
+// ToCSV creates a Pipeline that writes each value from its input stream to w as
+// a CSV record. The fields of the record are retrieved from each context by
+// record. Only the Comma option is used. To write a header, write it to w before
+// running the pipeline. See ToWriter
+func ToCSV(w io.Writer, opts stream.CSVOptions, record func(context.Context) ([]string, error)) Pipeline {
+	return toWriter("ToCSV", w, func(ctx context.Context) ([]byte, error) {
+		fields, err := record(ctx)
+
+		if err != nil {
+			return nil, err
+		}
+
+		var buf bytes.Buffer
+		writer := csv.NewWriter(&buf)
+
+		if opts.Comma != 0 {
+			writer.Comma = opts.Comma
+		}
+
+		writer.Write(fields)
+		writer.Flush()
+
+		return buf.Bytes(), writer.Error()
+	})
+}
@@ -0,0 +1,37 @@
+package pipeline
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bernos/go-pipeline/pipeline/stream"
+	"golang.org/x/net/context"
+)
+
+func TestToJSONLines(t *testing.T) {
+	var buf bytes.Buffer
+
+	value := func(ctx context.Context) (interface{}, error) {
+		return map[string]int{"x": FromContext(ctx)}, nil
+	}
+
+	runAck(ToJSONLines(&buf, value), NewContext(context.Background(), 1), NewContext(context.Background(), 2))
+
+	if want := "{\"x\":1}\n{\"x\":2}\n"; buf.String() != want {
+		t.Errorf("Want %q, got %q", want, buf.String())
+	}
+}
+
+func TestToCSV(t *testing.T) {
+	var buf bytes.Buffer
+
+	record := func(ctx context.Context) ([]string, error) {
+		return []string{"a;b", "c"}, nil
+	}
+
+	runAck(ToCSV(&buf, stream.CSVOptions{Comma: ';'}, record), NewContext(context.Background(), 1))
+
+	if want := "\"a;b\";c\n"; buf.String() != want {
+		t.Errorf("Want %q, got %q", want, buf.String())
+	}
+}
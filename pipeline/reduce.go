@@ -1,6 +1,8 @@
 package pipeline
 
 import (
+	"sync"
+
 	"github.com/bernos/go-pipeline/pipeline/stream"
 	"golang.org/x/net/context"
 )
@@ -16,38 +18,65 @@ func (fn ReducerFunc) Reduce(ctx context.Context, accumulator context.Context) (
 }
 
 func ReduceLeft(r Reducer) Pipeline {
-	return func(in stream.Stream) stream.Stream {
-		var (
-			out, cls    = in.WithValues(make(chan context.Context))
-			accumulator context.Context
-		)
+	return reduceLeft(r, &accumulator{})
+}
+
+// accumulator holds the result of a ReduceLeft stage so far. It is safe to read
+// while the stage is running
+type accumulator struct {
+	mu  sync.Mutex
+	ctx context.Context
+}
+
+func (acc *accumulator) get() context.Context {
+	acc.mu.Lock()
+	defer acc.mu.Unlock()
+	return acc.ctx
+}
+
+func (acc *accumulator) set(ctx context.Context) {
+	acc.mu.Lock()
+	defer acc.mu.Unlock()
+	acc.ctx = ctx
+}
+
+func reduceLeft(r Reducer, acc *accumulator) Pipeline {
+	return newStage("ReduceLeft", 1, nil, func(s *stage, in stream.Stream) stream.Stream {
+		out, cls := in.WithValues(make(chan context.Context))
 
 		go func() {
 			defer cls()
 
+			info := s.info(0)
+			r := s.wrapReducer(info, r)
+
 			for ctx := range in.Values() {
-				if accumulator == nil {
-					accumulator = ctx
+				if acc.get() == nil {
+					acc.set(ctx)
 				} else {
-					result, err := r.Reduce(ctx, accumulator)
+					ctx, a := begin(ctx, info)
+					result, err := r.Reduce(ctx, acc.get())
+					a.processed(err)
+					a.handOff(0)
+					a.end()
 
 					if err == nil {
-						accumulator = result
+						acc.set(result)
 					} else {
 						out.Error(err)
 					}
 				}
 			}
 
-			out.Value(accumulator)
+			out.Value(acc.get())
 		}()
 
 		return out
-	}
+	})
 }
 
 func ReduceRight(r Reducer) Pipeline {
-	return func(in stream.Stream) stream.Stream {
+	return newStage("ReduceRight", 1, nil, func(s *stage, in stream.Stream) stream.Stream {
 		var (
 			out, cls    = in.WithValues(make(chan context.Context))
 			accumulator context.Context
@@ -57,6 +86,9 @@ func ReduceRight(r Reducer) Pipeline {
 		go func() {
 			defer cls()
 
+			info := s.info(0)
+			r := s.wrapReducer(info, r)
+
 			for ctx := range in.Values() {
 				values = append(values, ctx)
 			}
@@ -69,7 +101,11 @@ func ReduceRight(r Reducer) Pipeline {
 				i--
 
 				for i >= 0 {
-					result, err := r.Reduce(values[i], accumulator)
+					ctx, a := begin(values[i], info)
+					result, err := r.Reduce(ctx, accumulator)
+					a.processed(err)
+					a.handOff(0)
+					a.end()
 
 					if err == nil {
 						accumulator = result
@@ -85,5 +121,5 @@ func ReduceRight(r Reducer) Pipeline {
 		}()
 
 		return out
-	}
+	})
 }
@@ -0,0 +1,410 @@
+package pipeline
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// MapperFactory creates a Mapper from the params of a stage in a Spec
+type MapperFactory func(Params) (Mapper, error)
+
+// FlatMapperFactory creates a FlatMapper from the params of a stage in a Spec
+type FlatMapperFactory func(Params) (FlatMapper, error)
+
+// PredicateFactory creates a Predicate from the params of a stage in a Spec
+type PredicateFactory func(Params) (Predicate, error)
+
+// ReducerFactory creates a Reducer from the params of a stage in a Spec
+type ReducerFactory func(Params) (Reducer, error)
+
+// SinkFactory creates the func passed to Sink from the params of a stage in a
+// Spec
+type SinkFactory func(Params) (func(context.Context) error, error)
+
+// Registry holds named factories for the stages that can be used in a Spec, and
+// builds pipelines from specs
+type Registry struct {
+	mu          sync.RWMutex
+	mappers     map[string]MapperFactory
+	flatMappers map[string]FlatMapperFactory
+	predicates  map[string]PredicateFactory
+	reducers    map[string]ReducerFactory
+	sinks       map[string]SinkFactory
+}
+
+// DefaultRegistry is the Registry used by the package level Register funcs, Load
+// and LoadFile
+var DefaultRegistry = NewRegistry()
+
+// NewRegistry creates an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{
+		mappers:     make(map[string]MapperFactory),
+		flatMappers: make(map[string]FlatMapperFactory),
+		predicates:  make(map[string]PredicateFactory),
+		reducers:    make(map[string]ReducerFactory),
+		sinks:       make(map[string]SinkFactory),
+	}
+}
+
+// RegisterMapper adds a factory for the Mapper used by map stages with the given
+// name. It panics if name is already registered as a Mapper
+func (r *Registry) RegisterMapper(name string, f MapperFactory) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.mappers[name]; ok {
+		panic(fmt.Sprintf("Mapper %s is already registered", name))
+	}
+
+	r.mappers[name] = f
+}
+
+// RegisterFlatMapper adds a factory for the FlatMapper used by flatmap stages
+// with the given name. It panics if name is already registered as a FlatMapper
+func (r *Registry) RegisterFlatMapper(name string, f FlatMapperFactory) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.flatMappers[name]; ok {
+		panic(fmt.Sprintf("FlatMapper %s is already registered", name))
+	}
+
+	r.flatMappers[name] = f
+}
+
+// RegisterPredicate adds a factory for the Predicate used by filter stages with
+// the given name. It panics if name is already registered as a Predicate
+func (r *Registry) RegisterPredicate(name string, f PredicateFactory) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.predicates[name]; ok {
+		panic(fmt.Sprintf("Predicate %s is already registered", name))
+	}
+
+	r.predicates[name] = f
+}
+
+// RegisterReducer adds a factory for the Reducer used by reduce and reduce-right
+// stages with the given name. It panics if name is already registered as a
+// Reducer
+func (r *Registry) RegisterReducer(name string, f ReducerFactory) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.reducers[name]; ok {
+		panic(fmt.Sprintf("Reducer %s is already registered", name))
+	}
+
+	r.reducers[name] = f
+}
+
+// RegisterSink adds a factory for the func used by sink stages with the given
+// name. It panics if name is already registered as a Sink
+func (r *Registry) RegisterSink(name string, f SinkFactory) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.sinks[name]; ok {
+		panic(fmt.Sprintf("Sink %s is already registered", name))
+	}
+
+	r.sinks[name] = f
+}
+
+// mapper returns the factory registered as name. Factories are looked up with the
+// lock held, and called once it is released, so that they may use the registry
+func (r *Registry) mapper(name string) (MapperFactory, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	f, ok := r.mappers[name]
+	return f, ok
+}
+
+func (r *Registry) flatMapper(name string) (FlatMapperFactory, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	f, ok := r.flatMappers[name]
+	return f, ok
+}
+
+func (r *Registry) predicate(name string) (PredicateFactory, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	f, ok := r.predicates[name]
+	return f, ok
+}
+
+func (r *Registry) reducer(name string) (ReducerFactory, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	f, ok := r.reducers[name]
+	return f, ok
+}
+
+func (r *Registry) sink(name string) (SinkFactory, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	f, ok := r.sinks[name]
+	return f, ok
+}
+
+// Load parses a spec from data, and builds it. See ParseSpec and Build
+func (r *Registry) Load(data []byte) (Pipeline, error) {
+	spec, err := ParseSpec(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return r.Build(spec)
+}
+
+// LoadFile loads the spec in the file at path
+func (r *Registry) LoadFile(path string) (Pipeline, error) {
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return r.Load(data)
+}
+
+// Build creates a Pipeline from spec. Each map, flatmap, filter, reduce,
+// reduce-right and sink stage is created by the factory registered under its use
+// field, and any errors, such as names that are not registered or factories that
+// fail, are returned as SpecErrors. The name of the spec names the graph that
+// describes the pipeline
+func (r *Registry) Build(spec *Spec) (Pipeline, error) {
+	var errs SpecErrors
+
+	p := r.build(spec.Stages, "stages", &errs, nil)
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	if spec.Name != "" {
+		p = namePipeline(spec.Name, p)
+	}
+
+	return p, nil
+}
+
+// build creates a pipeline from stages. If swaps is not nil, map and filter
+// stages are made swappable, and added to swaps
+func (r *Registry) build(stages []StageSpec, path string, errs *SpecErrors, swaps *swapSet) Pipeline {
+	if len(stages) == 0 {
+		*errs = append(*errs, &SpecError{Path: path, Message: "A pipeline needs at least one stage"})
+		return nil
+	}
+
+	var p Pipeline
+
+	for i, s := range stages {
+		next := r.buildStage(s, fmt.Sprintf("%s[%d]", path, i), errs, swaps)
+
+		if next == nil {
+			continue
+		}
+
+		if s.Name != "" {
+			next = next.Named(s.Name)
+		}
+
+		if p == nil {
+			p = next
+		} else {
+			p = p.Compose(next)
+		}
+	}
+
+	return p
+}
+
+func (r *Registry) buildStage(s StageSpec, path string, errs *SpecErrors, swaps *swapSet) Pipeline {
+	fail := func(path, msg string) Pipeline {
+		*errs = append(*errs, &SpecError{s.Line, path, msg})
+		return nil
+	}
+
+	failed := func(err error) Pipeline {
+		return fail(path, fmt.Sprintf("Unable to create %s %q: %s", s.Type, s.Use, err.Error()))
+	}
+
+	missing := func(kind string) Pipeline {
+		return fail(path+".use", fmt.Sprintf("No %s registered as %q", kind, s.Use))
+	}
+
+	workers := s.Workers
+
+	if workers <= 0 {
+		workers = 1
+	}
+
+	switch s.Type {
+	case StageMap:
+		f, ok := r.mapper(s.Use)
+
+		if !ok {
+			return missing("Mapper")
+		}
+
+		m, err := f(s.Params)
+
+		if err != nil {
+			return failed(err)
+		}
+
+		if swaps != nil {
+			sw := NewSwappable(m, workers)
+			swaps.mappers[path] = sw
+			return sw.Pipeline()
+		}
+
+		if workers > 1 {
+			return PMap(m, workers)
+		}
+
+		return Map(m)
+
+	case StageFlatMap:
+		f, ok := r.flatMapper(s.Use)
+
+		if !ok {
+			return missing("FlatMapper")
+		}
+
+		m, err := f(s.Params)
+
+		if err != nil {
+			return failed(err)
+		}
+
+		if workers > 1 {
+			return PFlatMap(m, workers)
+		}
+
+		return FlatMap(m)
+
+	case StageFilter:
+		f, ok := r.predicate(s.Use)
+
+		if !ok {
+			return missing("Predicate")
+		}
+
+		p, err := f(s.Params)
+
+		if err != nil {
+			return failed(err)
+		}
+
+		if swaps != nil {
+			sp := NewSwappablePredicate(p)
+			swaps.predicates[path] = sp
+			return Filter(sp.Predicate())
+		}
+
+		return Filter(p)
+
+	case StageReduce, StageReduceRight:
+		f, ok := r.reducer(s.Use)
+
+		if !ok {
+			return missing("Reducer")
+		}
+
+		reducer, err := f(s.Params)
+
+		if err != nil {
+			return failed(err)
+		}
+
+		if s.Type == StageReduceRight {
+			return ReduceRight(reducer)
+		}
+
+		return ReduceLeft(reducer)
+
+	case StageSink:
+		f, ok := r.sink(s.Use)
+
+		if !ok {
+			return missing("Sink")
+		}
+
+		fn, err := f(s.Params)
+
+		if err != nil {
+			return failed(err)
+		}
+
+		return Sink(fn)
+
+	case StageLoop, StageTee, StageParallel:
+		inner := r.build(s.Stages, path+".stages", errs, swaps)
+
+		if inner == nil {
+			return nil
+		}
+
+		switch s.Type {
+		case StageLoop:
+			return Loop(inner)
+		case StageTee:
+			return Tee(inner)
+		default:
+			return Parallel(inner, workers)
+		}
+	}
+
+	return fail(path+".type", fmt.Sprintf("Unknown stage type %q", s.Type))
+}
+
+// RegisterMapper adds a factory to DefaultRegistry. See Registry.RegisterMapper
+func RegisterMapper(name string, f MapperFactory) {
+	DefaultRegistry.RegisterMapper(name, f)
+}
+
+// RegisterFlatMapper adds a factory to DefaultRegistry. See
+// Registry.RegisterFlatMapper
+func RegisterFlatMapper(name string, f FlatMapperFactory) {
+	DefaultRegistry.RegisterFlatMapper(name, f)
+}
+
+// RegisterPredicate adds a factory to DefaultRegistry. See
+// Registry.RegisterPredicate
+func RegisterPredicate(name string, f PredicateFactory) {
+	DefaultRegistry.RegisterPredicate(name, f)
+}
+
+// RegisterReducer adds a factory to DefaultRegistry. See Registry.RegisterReducer
+func RegisterReducer(name string, f ReducerFactory) {
+	DefaultRegistry.RegisterReducer(name, f)
+}
+
+// RegisterSink adds a factory to DefaultRegistry. See Registry.RegisterSink
+func RegisterSink(name string, f SinkFactory) {
+	DefaultRegistry.RegisterSink(name, f)
+}
+
+// Load loads a spec using DefaultRegistry. See Registry.Load
+func Load(data []byte) (Pipeline, error) {
+	return DefaultRegistry.Load(data)
+}
+
+// LoadFile loads a spec from a file using DefaultRegistry. See Registry.LoadFile
+func LoadFile(path string) (Pipeline, error) {
+	return DefaultRegistry.LoadFile(path)
+}
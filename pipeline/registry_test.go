@@ -0,0 +1,184 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func testRegistry() *Registry {
+	r := NewRegistry()
+
+	r.RegisterMapper("multiply", func(p Params) (Mapper, error) {
+		var cfg struct {
+			By int `json:"by"`
+		}
+
+		if err := p.Decode(&cfg); err != nil {
+			return nil, err
+		}
+
+		if cfg.By == 0 {
+			return nil, errors.New("by is required")
+		}
+
+		return IntMapper(func(x int) int { return x * cfg.By }), nil
+	})
+
+	r.RegisterFlatMapper("twice", func(Params) (FlatMapper, error) {
+		return FlatMapperFunc(func(ctx context.Context) ([]context.Context, error) {
+			return []context.Context{ctx, ctx}, nil
+		}), nil
+	})
+
+	r.RegisterPredicate("small", func(Params) (Predicate, error) {
+		return func(ctx context.Context) bool { return FromContext(ctx) < 20 }, nil
+	})
+
+	r.RegisterReducer("sum", func(Params) (Reducer, error) {
+		return ReducerFunc(func(ctx, acc context.Context) (context.Context, error) {
+			return NewContext(ctx, FromContext(ctx)+FromContext(acc)), nil
+		}), nil
+	})
+
+	return r
+}
+
+func TestRegistryLoad(t *testing.T) {
+	pl, err := testRegistry().Load([]byte(`{"name": "small-triples", "stages": [
+		{"type": "map", "use": "multiply", "workers": 2, "params": {"by": 3}},
+		{"type": "flatmap", "use": "twice"},
+		{"type": "filter", "use": "small", "name": "only-small"}
+	]}`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values, errs := runPipeline(pl, []context.Context{
+		NewContext(context.Background(), 1),
+		NewContext(context.Background(), 10),
+	})
+
+	var got []int
+
+	for _, v := range values {
+		got = append(got, FromContext(v))
+	}
+
+	if len(errs) > 0 || fmt.Sprint(got) != "[3 3]" {
+		t.Errorf("Want [3 3], got %v and %v", got, errs)
+	}
+
+	g := Describe(pl)
+
+	if len(g.Stages) != 3 || g.Stages[0].Type != "PMap" || g.Stages[0].Workers != 2 || g.Stages[2].Name != "only-small" {
+		t.Errorf("Unexpected graph\n%s", g)
+	}
+
+	if g.Name != "small-triples" || !strings.Contains(g.DOT(), `label="small-triples";`) {
+		t.Errorf("Want graph named small-triples, got %q", g.Name)
+	}
+}
+
+func TestRegistryWrappers(t *testing.T) {
+	pl, err := testRegistry().Load([]byte(`{"stages": [
+		{"type": "parallel", "workers": 3, "stages": [
+			{"type": "map", "use": "multiply", "params": {"by": 2}}
+		]},
+		{"type": "tee", "stages": [{"type": "reduce", "use": "sum"}]},
+		{"type": "reduce-right", "use": "sum"}
+	]}`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := Describe(pl)
+
+	if len(g.Stages) != 3 || g.Stages[0].Type != "Parallel" || len(g.Stages[0].Stages) != 1 || g.Stages[1].Type != "Tee" {
+		t.Errorf("Unexpected graph\n%s", g)
+	}
+
+	values, errs := runPipeline(pl, []context.Context{
+		NewContext(context.Background(), 1),
+		NewContext(context.Background(), 2),
+	})
+
+	var got []int
+
+	for _, v := range values {
+		got = append(got, FromContext(v))
+	}
+
+	sort.Ints(got)
+
+	if len(errs) > 0 || len(got) == 0 || got[len(got)-1] != 6 {
+		t.Errorf("Want a running total of 6, got %v and %v", got, errs)
+	}
+}
+
+func TestRegistryBuildErrors(t *testing.T) {
+	_, err := testRegistry().Load([]byte(`{"stages": [
+		{"type": "map", "use": "multiply"},
+		{"type": "loop", "stages": [
+			{"type": "sink", "use": "nowhere"}
+		]}
+	]}`))
+
+	want := "line 2: stages[0]: Unable to create map \"multiply\": by is required\n" +
+		"line 4: stages[1].stages[0].use: No Sink registered as \"nowhere\""
+
+	if err == nil || err.Error() != want {
+		t.Errorf("Want\n%s\ngot\n%v", want, err)
+	}
+}
+
+func TestRegistryDuplicate(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Want panic for a duplicate registration")
+		}
+	}()
+
+	r := testRegistry()
+	r.RegisterPredicate("small", nil)
+}
+
+func TestRegistryFactoryUsesRegistry(t *testing.T) {
+	r := NewRegistry()
+
+	// A factory that registers a helper the first time it is used
+	r.RegisterMapper("outer", func(p Params) (Mapper, error) {
+		r.RegisterMapper("helper", func(Params) (Mapper, error) {
+			return IntMapper(func(x int) int { return x }), nil
+		})
+
+		return IntMapper(func(x int) int { return x + 1 }), nil
+	})
+
+	done := make(chan error)
+
+	go func() {
+		_, err := r.Load([]byte(`{"stages": [{"type": "map", "use": "outer"}]}`))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out building a pipeline whose factory uses the registry")
+	}
+
+	if _, ok := r.mapper("helper"); !ok {
+		t.Error("Want helper to be registered")
+	}
+}
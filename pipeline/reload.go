@@ -0,0 +1,288 @@
+package pipeline
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// swapSet holds the swappable stages of a Reloadable pipeline, by path
+type swapSet struct {
+	mappers    map[string]*Swappable
+	predicates map[string]*SwappablePredicate
+}
+
+// Reloadable is a pipeline built from a spec file that can be reconfigured while
+// it is running, by changing the spec file and reloading it. Map stages can be
+// changed to use a different Mapper, params or number of workers, and filter
+// stages to use a different Predicate or params. See Swappable. Any other change
+// to the spec needs the pipeline to be restarted
+type Reloadable struct {
+	registry *Registry
+	path     string
+	pipeline Pipeline
+	swaps    *swapSet
+
+	mu      sync.Mutex
+	spec    *Spec
+	modTime time.Time
+}
+
+// LoadReloadable loads the spec in the file at path as a Reloadable pipeline
+func (r *Registry) LoadReloadable(path string) (*Reloadable, error) {
+	info, err := os.Stat(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	spec, err := ParseSpec(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		errs  SpecErrors
+		swaps = &swapSet{
+			mappers:    make(map[string]*Swappable),
+			predicates: make(map[string]*SwappablePredicate),
+		}
+	)
+
+	p := r.build(spec.Stages, "stages", &errs, swaps)
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	if spec.Name != "" {
+		p = namePipeline(spec.Name, p)
+	}
+
+	return &Reloadable{
+		registry: r,
+		path:     path,
+		pipeline: p,
+		swaps:    swaps,
+		spec:     spec,
+		modTime:  info.ModTime(),
+	}, nil
+}
+
+// Pipeline returns the pipeline built from the spec
+func (l *Reloadable) Pipeline() Pipeline {
+	return l.pipeline
+}
+
+// Reload reads the spec file again, and applies any changes to the running
+// pipeline. Either all of the changes are applied, or, if any of them can not be,
+// none are and the errors are returned
+func (l *Reloadable) Reload() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	info, err := os.Stat(l.path)
+
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(l.path)
+
+	if err != nil {
+		return err
+	}
+
+	spec, err := ParseSpec(data)
+
+	if err != nil {
+		return err
+	}
+
+	var (
+		errs    SpecErrors
+		changes []func()
+	)
+
+	l.diff(l.spec.Stages, spec.Stages, "stages", &errs, &changes)
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	for _, change := range changes {
+		change()
+	}
+
+	l.spec = spec
+	l.modTime = info.ModTime()
+
+	return nil
+}
+
+// diff compares the stages of the current and new specs, adding a func to
+// changes for each change that can be applied, and an error for each that can't
+func (l *Reloadable) diff(current, next []StageSpec, path string, errs *SpecErrors, changes *[]func()) {
+	if len(current) != len(next) {
+		*errs = append(*errs, &SpecError{Path: path, Message: "Stages can not be added or removed without restarting"})
+		return
+	}
+
+	for i := range next {
+		var (
+			c, n = current[i], next[i]
+			p    = fmt.Sprintf("%s[%d]", path, i)
+			fail = func(msg string) {
+				*errs = append(*errs, &SpecError{n.Line, p, msg})
+			}
+		)
+
+		if c.Type != n.Type {
+			fail(fmt.Sprintf("A %s stage can not be changed to a %s stage without restarting", c.Type, n.Type))
+			continue
+		}
+
+		if c.Name != n.Name {
+			fail("A stage can not be renamed without restarting")
+			continue
+		}
+
+		switch n.Type {
+		case StageMap:
+			sw := l.swaps.mappers[p]
+			workers := n.Workers
+
+			if workers <= 0 {
+				workers = 1
+			}
+
+			if c.Use == n.Use && reflect.DeepEqual(c.Params, n.Params) {
+				*changes = append(*changes, func() { sw.SetWorkers(workers) })
+				continue
+			}
+
+			f, ok := l.registry.mapper(n.Use)
+
+			if !ok {
+				fail(fmt.Sprintf("No Mapper registered as %q", n.Use))
+				continue
+			}
+
+			m, err := f(n.Params)
+
+			if err != nil {
+				fail(fmt.Sprintf("Unable to create map %q: %s", n.Use, err.Error()))
+				continue
+			}
+
+			*changes = append(*changes, func() {
+				sw.SwapMapper(m)
+				sw.SetWorkers(workers)
+			})
+
+		case StageFilter:
+			if c.Use == n.Use && reflect.DeepEqual(c.Params, n.Params) {
+				continue
+			}
+
+			f, ok := l.registry.predicate(n.Use)
+
+			if !ok {
+				fail(fmt.Sprintf("No Predicate registered as %q", n.Use))
+				continue
+			}
+
+			pred, err := f(n.Params)
+
+			if err != nil {
+				fail(fmt.Sprintf("Unable to create filter %q: %s", n.Use, err.Error()))
+				continue
+			}
+
+			sp := l.swaps.predicates[p]
+			*changes = append(*changes, func() { sp.Swap(pred) })
+
+		case StageLoop, StageTee, StageParallel:
+			if c.Workers != n.Workers {
+				fail(fmt.Sprintf("The workers of a %s stage can not be changed without restarting", n.Type))
+				continue
+			}
+
+			l.diff(c.Stages, n.Stages, p+".stages", errs, changes)
+
+		default:
+			if c.Use != n.Use || c.Workers != n.Workers || !reflect.DeepEqual(c.Params, n.Params) {
+				fail(fmt.Sprintf("A %s stage can not be changed without restarting", n.Type))
+			}
+		}
+	}
+}
+
+// Watch checks the spec file for changes every interval until ctx is done, and
+// reloads it when it changes. Errors are sent on the returned channel, which is
+// closed once ctx is done
+func (l *Reloadable) Watch(ctx context.Context, interval time.Duration) <-chan error {
+	errs := make(chan error)
+
+	go func() {
+		defer close(errs)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			info, err := os.Stat(l.path)
+
+			if err == nil {
+				l.mu.Lock()
+				changed := !info.ModTime().Equal(l.modTime)
+				l.mu.Unlock()
+
+				if !changed {
+					continue
+				}
+
+				if err = l.Reload(); err != nil {
+					// Don't retry a bad spec until it changes again
+					l.mu.Lock()
+					l.modTime = info.ModTime()
+					l.mu.Unlock()
+				}
+			}
+
+			if err != nil {
+				select {
+				case errs <- err:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return errs
+}
+
+// LoadReloadable loads a Reloadable pipeline using DefaultRegistry. See
+// Registry.LoadReloadable
+func LoadReloadable(path string) (*Reloadable, error) {
+	return DefaultRegistry.LoadReloadable(path)
+}
@@ -0,0 +1,126 @@
+package pipeline
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bernos/go-pipeline/pipeline/stream"
+	"golang.org/x/net/context"
+)
+
+func writeFile(t *testing.T, path, data string) {
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// roundTrip sends x through a running pipeline and returns the result
+func roundTrip(in, out stream.Stream, x int) int {
+	go in.Value(NewContext(context.Background(), x))
+	return FromContext(<-out.Values())
+}
+
+func TestReloadable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spec.json")
+
+	writeFile(t, path, `{"stages": [
+		{"type": "map", "use": "multiply", "params": {"by": 2}},
+		{"type": "filter", "use": "small"}
+	]}`)
+
+	l, err := testRegistry().LoadReloadable(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in, cls := stream.New()
+	out := l.Pipeline()(in)
+	defer cls()
+
+	if got := roundTrip(in, out, 3); got != 6 {
+		t.Errorf("Want 6, got %d", got)
+	}
+
+	writeFile(t, path, `{"stages": [
+		{"type": "map", "use": "multiply", "workers": 3, "params": {"by": 5}},
+		{"type": "filter", "use": "small"}
+	]}`)
+
+	if err := l.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := roundTrip(in, out, 3); got != 15 {
+		t.Errorf("Want 15 after reload, got %d", got)
+	}
+
+	if sw := l.swaps.mappers["stages[0]"]; sw.Workers() != 3 {
+		t.Errorf("Want 3 workers after reload, got %d", sw.Workers())
+	}
+
+	// Changes that need a restart are rejected, and nothing is applied
+	writeFile(t, path, `{"stages": [
+		{"type": "map", "use": "multiply", "params": {"by": 7}},
+		{"type": "flatmap", "use": "twice"}
+	]}`)
+
+	if err := l.Reload(); err == nil || err.Error() != "line 3: stages[1]: A filter stage can not be changed to a flatmap stage without restarting" {
+		t.Errorf("Want reload to fail, got %v", err)
+	}
+
+	if got := roundTrip(in, out, 3); got != 15 {
+		t.Errorf("Want 15 after failed reload, got %d", got)
+	}
+}
+
+func TestReloadableWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spec.json")
+	writeFile(t, path, `{"stages": [{"type": "map", "use": "multiply", "params": {"by": 2}}]}`)
+
+	l, err := testRegistry().LoadReloadable(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errs := l.Watch(ctx, time.Millisecond*5)
+
+	in, cls := stream.New()
+	out := l.Pipeline()(in)
+	defer cls()
+
+	writeFile(t, path, `{"stages": [{"type": "map", "use": "multiply", "params": {"by": 4}}]}`)
+
+	// Make sure the change is noticed on file systems with coarse timestamps
+	later := time.Now().Add(time.Second)
+	os.Chtimes(path, later, later)
+
+	deadline := time.Now().Add(time.Second)
+
+	for roundTrip(in, out, 1) != 4 {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for reload")
+		}
+
+		time.Sleep(time.Millisecond * 5)
+	}
+
+	writeFile(t, path, `{"stages": []}`)
+	os.Chtimes(path, later.Add(time.Second), later.Add(time.Second))
+
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Error("Want error from a bad spec")
+		}
+	case <-time.After(time.Second):
+		t.Error("Timed out waiting for error")
+	}
+}
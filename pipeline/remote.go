@@ -0,0 +1,694 @@
+package pipeline
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bernos/go-pipeline/pipeline/stream"
+	"golang.org/x/net/context"
+)
+
+const (
+	// DefaultRemoteWindow is the number of values a Remote stage sends before
+	// waiting for results if RemoteOptions.Window is not set
+	DefaultRemoteWindow = 100
+
+	// DefaultRemoteRetryDelay is how long a Remote stage waits before
+	// reconnecting if RemoteOptions.RetryDelay is not set
+	DefaultRemoteRetryDelay = time.Second
+
+	// DefaultRemoteMaxRetries is how many times in a row a Remote stage
+	// tries to reconnect before giving up if RemoteOptions.MaxRetries is not
+	// set
+	DefaultRemoteMaxRetries = 30
+
+	// maxRemoteNacked is the number of errors a server remembers from the
+	// values it has nacked, so as not to report them again as stream errors
+	maxRemoteNacked = 100
+)
+
+// Frames sent between a Remote stage and Serve. Each frame has a kind, the id of
+// the value it refers to, and data
+const (
+	// A value from the client, or a result from the server
+	frameValue byte = 'V'
+
+	// The value has been processed, and all of its results sent
+	frameAck byte = 'A'
+
+	// The value could not be processed. The data is the error message
+	frameNack byte = 'N'
+
+	// An error from the server's pipeline that is not the failure of a
+	// value. The data is the error message
+	frameError byte = 'E'
+
+	frameHeaderSize = 1 + 8 + 4
+	maxFrameSize    = 1 << 30
+)
+
+// RemoteError is an error received from the pipeline served by Serve
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return e.Message
+}
+
+// RemoteOptions configures a Remote stage
+type RemoteOptions struct {
+	// Marshaler marshals values sent to and received from the server. It
+	// must be compatible with the server's marshaler. The default is
+	// DefaultCodecs
+	Marshaler ContextMarshaler
+
+	// Dial connects to the server. The default dials addr over TCP
+	Dial func(addr string) (net.Conn, error)
+
+	// Window is the number of values that can be sent to the server before
+	// their results are received. A value that is waiting for room in the
+	// window is nacked if its context is done first. Zero means
+	// DefaultRemoteWindow
+	Window int
+
+	// RetryDelay is how long to wait before reconnecting after a connection
+	// fails. Zero means DefaultRemoteRetryDelay
+	RetryDelay time.Duration
+
+	// MaxRetries is how many times in a row to try reconnecting before giving
+	// up. Zero means DefaultRemoteMaxRetries, and a negative number means
+	// there is no limit
+	MaxRetries int
+}
+
+// Remote creates a Pipeline that processes values from its input stream with a
+// pipeline in another process, served by Serve at addr. Values are marshaled and
+// sent to the server, and the results of each value are unmarshaled on to its
+// context and sent on the output stream once the server has finished with it.
+// The values sent for a single input value are acked together. See WithAck.
+// Values that fail on the server are nacked, and their errors, along with any
+// other errors from the server's pipeline, are sent on the output stream as
+// *RemoteError.
+//
+// If the connection fails, Remote reconnects and sends every value that has not
+// finished again, so values may be processed more than once by the server. If
+// the server can't be reached after MaxRetries attempts in a row, Remote gives
+// up, nacking every value that has not finished and every value it receives
+// from then on
+func Remote(addr string, opts RemoteOptions) Pipeline {
+	if opts.Marshaler == nil {
+		opts.Marshaler = DefaultCodecs
+	}
+
+	if opts.Dial == nil {
+		opts.Dial = func(addr string) (net.Conn, error) {
+			return net.DialTimeout("tcp", addr, 10*time.Second)
+		}
+	}
+
+	if opts.Window <= 0 {
+		opts.Window = DefaultRemoteWindow
+	}
+
+	if opts.RetryDelay <= 0 {
+		opts.RetryDelay = DefaultRemoteRetryDelay
+	}
+
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = DefaultRemoteMaxRetries
+	}
+
+	return newStage("Remote", 1, nil, func(s *stage, in stream.Stream) stream.Stream {
+		out, cls := in.WithValues(make(chan context.Context))
+
+		c := &remoteClient{
+			addr:    addr,
+			opts:    opts,
+			out:     out,
+			window:  make(chan struct{}, opts.Window),
+			pending: make(map[uint64]*remoteValue),
+			done:    make(chan struct{}),
+		}
+
+		go c.send(in, s.info(0))
+
+		go func() {
+			defer cls()
+			c.connect()
+		}()
+
+		return out
+	})
+}
+
+// remoteValue is a value that has been sent to the server
+type remoteValue struct {
+	ctx     context.Context
+	data    []byte
+	results []context.Context
+	a       *activity
+
+	// The connection that the value was last sent on
+	gen int
+}
+
+// remoteClient is the connection of a Remote stage to the server
+type remoteClient struct {
+	addr   string
+	opts   RemoteOptions
+	out    stream.Stream
+	window chan struct{}
+
+	mu       sync.Mutex
+	conn     *frameConn
+	gen      int
+	nextID   uint64
+	pending  map[uint64]*remoteValue
+	finished bool
+	closing  bool
+
+	// Set once the client has given up connecting to the server
+	failed error
+
+	// Closed once the input stream is closed and every value has finished
+	done chan struct{}
+}
+
+// send marshals and sends each value from in
+func (c *remoteClient) send(in stream.Stream, info StageInfo) {
+	for ctx := range in.Values() {
+		ctx, a := begin(ctx, info)
+		data, err := c.opts.Marshaler.MarshalContext(ctx)
+
+		if err != nil {
+			a.processed(err)
+			Nack(ctx, err)
+			c.out.Error(err)
+			a.end()
+			continue
+		}
+
+		select {
+		case c.window <- struct{}{}:
+		case <-ctx.Done():
+			// The server may never catch up, so give up on a value that
+			// is no longer wanted
+			a.processed(ctx.Err())
+			Nack(ctx, ctx.Err())
+			a.end()
+			continue
+		}
+
+		c.mu.Lock()
+
+		if err := c.failed; err != nil {
+			c.mu.Unlock()
+			<-c.window
+			a.processed(err)
+			Nack(ctx, err)
+			a.end()
+			continue
+		}
+
+		c.nextID++
+		id := c.nextID
+		c.pending[id] = &remoteValue{ctx: ctx, data: data, a: a, gen: c.gen}
+		conn := c.conn
+		c.mu.Unlock()
+
+		if conn != nil {
+			// If the write fails, the value is sent again once reconnected
+			conn.write(frameValue, id, data)
+		}
+	}
+
+	c.mu.Lock()
+	c.finished = true
+	c.mu.Unlock()
+
+	c.finishIfDone()
+}
+
+// finishIfDone stops the client once the input stream is closed and every value
+// has finished
+func (c *remoteClient) finishIfDone() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.finished && len(c.pending) == 0 && !c.closing {
+		c.closing = true
+		close(c.done)
+
+		if c.conn != nil {
+			c.conn.Close()
+		}
+	}
+}
+
+// connect maintains the connection to the server until the client is done, or
+// until it gives up
+func (c *remoteClient) connect() {
+	failures := 0
+
+	for {
+		select {
+		case <-c.done:
+			return
+		default:
+		}
+
+		conn, err := c.opts.Dial(c.addr)
+
+		if err == nil {
+			failures = 0
+			err = c.serve(newFrameConn(conn))
+		}
+
+		select {
+		case <-c.done:
+			return
+		default:
+		}
+
+		c.out.Error(fmt.Errorf("Connection to %s failed: %s", c.addr, err.Error()))
+
+		if failures++; c.opts.MaxRetries > 0 && failures > c.opts.MaxRetries {
+			c.giveUp(fmt.Errorf("Gave up connecting to %s after %d attempts", c.addr, failures))
+			<-c.done
+			return
+		}
+
+		timer := time.NewTimer(c.opts.RetryDelay)
+
+		select {
+		case <-c.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// giveUp nacks every value that has not finished with err, along with every
+// value sent from then on
+func (c *remoteClient) giveUp(err error) {
+	c.mu.Lock()
+	c.failed = err
+	pending := c.pending
+	c.pending = make(map[uint64]*remoteValue)
+	c.mu.Unlock()
+
+	c.out.Error(err)
+
+	for _, v := range pending {
+		<-c.window
+		v.a.processed(err)
+		Nack(v.ctx, err)
+		v.a.end()
+	}
+
+	c.finishIfDone()
+}
+
+// serve sends any values that have not finished on conn, then handles frames
+// from the server until the connection fails
+func (c *remoteClient) serve(conn *frameConn) error {
+	defer conn.Close()
+
+	c.mu.Lock()
+
+	if c.closing {
+		c.mu.Unlock()
+		return nil
+	}
+
+	c.gen++
+	c.conn = conn
+
+	var resend []uint64
+
+	for id, v := range c.pending {
+		if v.gen != c.gen {
+			v.gen = c.gen
+			v.results = nil
+			resend = append(resend, id)
+		}
+	}
+
+	c.mu.Unlock()
+
+	sort.Sort(uint64s(resend))
+
+	for _, id := range resend {
+		c.mu.Lock()
+		v, ok := c.pending[id]
+		c.mu.Unlock()
+
+		if ok {
+			conn.write(frameValue, id, v.data)
+		}
+	}
+
+	for {
+		kind, id, data, err := conn.read()
+
+		if err != nil {
+			c.mu.Lock()
+			c.conn = nil
+			c.mu.Unlock()
+
+			return err
+		}
+
+		c.handle(kind, id, data)
+	}
+}
+
+// handle handles a frame from the server
+func (c *remoteClient) handle(kind byte, id uint64, data []byte) {
+	if kind == frameError {
+		c.out.Error(&RemoteError{string(data)})
+		return
+	}
+
+	c.mu.Lock()
+	v, ok := c.pending[id]
+
+	if ok && kind != frameValue {
+		delete(c.pending, id)
+	}
+
+	c.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	switch kind {
+	case frameValue:
+		ctx, err := c.opts.Marshaler.UnmarshalContext(v.ctx, data)
+
+		if err != nil {
+			c.out.Error(err)
+			return
+		}
+
+		// Results are only added and reset by the goroutine reading from
+		// the server, so need no lock
+		v.results = append(v.results, ctx)
+
+	case frameAck:
+		<-c.window
+		v.a.processed(nil)
+		v.a.handOff(len(v.results))
+
+		for _, ctx := range ackAll(v.ctx, v.results) {
+			c.out.Value(ctx)
+		}
+
+		v.a.end()
+		c.finishIfDone()
+
+	case frameNack:
+		<-c.window
+		err := &RemoteError{string(data)}
+		v.a.processed(err)
+		Nack(v.ctx, err)
+		c.out.Error(err)
+		v.a.end()
+		c.finishIfDone()
+	}
+}
+
+// Serve accepts connections from Remote stages on l, and processes the values
+// received on each connection with its own instance of p. Values are unmarshaled
+// onto an empty context using m. Output values must be derived from the input
+// value that produced them, so that they can be returned to the right client
+// value, and are acked once they have been sent. An input value is finished once
+// its ack callbacks are called, so several output values can only be returned
+// for an input if each has its own callbacks, as with FlatMap. Output values
+// that share callbacks, such as several values produced from one input by a
+// Loop, finish the input when the first of them is sent. Output values that
+// can't be matched to an unfinished input value are sent on the client's error
+// stream instead. Serve returns once l is closed, closing any open connections
+func Serve(l net.Listener, p Pipeline, m ContextMarshaler) error {
+	var (
+		mu    sync.Mutex
+		conns = make(map[*frameConn]bool)
+	)
+
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+
+		for conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	for {
+		c, err := l.Accept()
+
+		if err != nil {
+			return err
+		}
+
+		conn := newFrameConn(c)
+
+		mu.Lock()
+		conns[conn] = true
+		mu.Unlock()
+
+		go func() {
+			serveConn(conn, p, m)
+
+			mu.Lock()
+			delete(conns, conn)
+			mu.Unlock()
+		}()
+	}
+}
+
+type remoteKey int
+
+const remoteIDContextKey remoteKey = 0
+
+// serveConn runs p for the values received on conn
+func serveConn(conn *frameConn, p Pipeline, m ContextMarshaler) {
+	defer conn.Close()
+
+	var (
+		wg      sync.WaitGroup
+		in, cls = stream.New()
+		out     = p(in)
+
+		// Values that have been received and not yet finished
+		mu      sync.Mutex
+		pending = make(map[uint64]bool)
+
+		// Recent errors that values were nacked with
+		nacked []error
+	)
+
+	// finish writes the ack or nack frame for a value, unless it has already
+	// finished, reporting whether it did
+	finish := func(kind byte, id uint64, data []byte) bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if pending[id] {
+			delete(pending, id)
+			conn.write(kind, id, data)
+			return true
+		}
+
+		return false
+	}
+
+	// report writes an error frame for err, unless a value has been nacked
+	// with it, as stages that fail a value both nack it and send the error
+	// on their output stream
+	report := func(err error) {
+		mu.Lock()
+
+		for i, e := range nacked {
+			if sameError(e, err) {
+				nacked = append(nacked[:i], nacked[i+1:]...)
+				mu.Unlock()
+				return
+			}
+		}
+
+		mu.Unlock()
+
+		conn.write(frameError, 0, []byte(err.Error()))
+	}
+
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+
+		for ctx := range out.Values() {
+			id, _ := ctx.Value(remoteIDContextKey).(uint64)
+			data, err := m.MarshalContext(ctx)
+
+			if err != nil {
+				Nack(ctx, err)
+				report(err)
+				continue
+			}
+
+			// The result must reach the client before the value finishes
+			mu.Lock()
+			ok := pending[id]
+
+			if ok {
+				conn.write(frameValue, id, data)
+			}
+
+			mu.Unlock()
+
+			if !ok {
+				err := fmt.Errorf("Result could not be returned as value %d is not being processed", id)
+				Nack(ctx, err)
+				report(err)
+				continue
+			}
+
+			Ack(ctx)
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+
+		for err := range out.Errors() {
+			report(err)
+		}
+	}()
+
+	for {
+		kind, id, data, err := conn.read()
+
+		if err != nil {
+			break
+		}
+
+		if kind != frameValue {
+			continue
+		}
+
+		ctx, err := m.UnmarshalContext(context.Background(), data)
+
+		if err != nil {
+			conn.write(frameNack, id, []byte(err.Error()))
+			continue
+		}
+
+		mu.Lock()
+		pending[id] = true
+		mu.Unlock()
+
+		ctx = context.WithValue(ctx, remoteIDContextKey, id)
+		ctx = WithAck(ctx, func() {
+			finish(frameAck, id, nil)
+		}, func(err error) {
+			msg := "Value failed"
+
+			if err != nil {
+				msg = err.Error()
+			}
+
+			if finish(frameNack, id, []byte(msg)) && err != nil {
+				mu.Lock()
+				nacked = append(nacked, err)
+
+				if len(nacked) > maxRemoteNacked {
+					nacked = nacked[1:]
+				}
+
+				mu.Unlock()
+			}
+		})
+
+		in.Value(ctx)
+	}
+
+	cls()
+	wg.Wait()
+}
+
+// sameError reports whether a and b are the same error, without comparing errors
+// whose type can't be compared
+func sameError(a, b error) bool {
+	t := reflect.TypeOf(a)
+	return t == reflect.TypeOf(b) && t.Comparable() && a == b
+}
+
+// frameConn reads and writes frames on a connection. Writes may be made from
+// any goroutine, but reads only from one
+type frameConn struct {
+	net.Conn
+
+	r  *bufio.Reader
+	mu sync.Mutex
+}
+
+func newFrameConn(c net.Conn) *frameConn {
+	return &frameConn{
+		Conn: c,
+		r:    bufio.NewReader(c),
+	}
+}
+
+func (c *frameConn) write(kind byte, id uint64, data []byte) error {
+	buf := make([]byte, frameHeaderSize+len(data))
+	buf[0] = kind
+	binary.BigEndian.PutUint64(buf[1:9], id)
+	binary.BigEndian.PutUint32(buf[9:13], uint32(len(data)))
+	copy(buf[frameHeaderSize:], data)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, err := c.Conn.Write(buf)
+	return err
+}
+
+func (c *frameConn) read() (byte, uint64, []byte, error) {
+	header := make([]byte, frameHeaderSize)
+
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		return 0, 0, nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[9:13])
+
+	if length > maxFrameSize {
+		return 0, 0, nil, errors.New("Frame is too large")
+	}
+
+	data := make([]byte, length)
+
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return 0, 0, nil, err
+	}
+
+	return header[0], binary.BigEndian.Uint64(header[1:9]), data, nil
+}
+
+type uint64s []uint64
+
+func (s uint64s) Len() int           { return len(s) }
+func (s uint64s) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint64s) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
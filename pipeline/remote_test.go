@@ -0,0 +1,248 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bernos/go-pipeline/pipeline/stream"
+	"golang.org/x/net/context"
+)
+
+// serveRemote serves pl on a localhost port, returning the listener
+func serveRemote(t *testing.T, addr string, pl Pipeline) net.Listener {
+	l, err := net.Listen("tcp", addr)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go Serve(l, pl, intMarshaler{})
+
+	return l
+}
+
+func remoteOptions() RemoteOptions {
+	return RemoteOptions{
+		Marshaler:  intMarshaler{},
+		RetryDelay: time.Millisecond * 10,
+	}
+}
+
+func TestRemote(t *testing.T) {
+	double := MapperFunc(func(ctx context.Context) (context.Context, error) {
+		if FromContext(ctx) < 0 {
+			return nil, errors.New("Negative")
+		}
+		return NewContext(ctx, FromContext(ctx)*2), nil
+	})
+
+	pair := FlatMapperFunc(func(ctx context.Context) ([]context.Context, error) {
+		x := FromContext(ctx)
+		return []context.Context{NewContext(ctx, x), NewContext(ctx, x+1)}, nil
+	})
+
+	l := serveRemote(t, "127.0.0.1:0", Map(double).FlatMap(pair).Filter(func(ctx context.Context) bool {
+		return FromContext(ctx) != 5
+	}))
+
+	defer l.Close()
+
+	var (
+		r      ackRecorder
+		remote = Remote(l.Addr().String(), remoteOptions())
+	)
+
+	values, errs := runPipeline(remote, []context.Context{r.value(1), r.value(2), r.value(-1)})
+
+	var got []int
+
+	for _, ctx := range values {
+		got = append(got, FromContext(ctx))
+		Ack(ctx)
+	}
+
+	sort.Ints(got)
+
+	if fmt.Sprint(got) != "[2 3 4]" {
+		t.Errorf("Want [2 3 4], got %v", got)
+	}
+
+	if len(errs) != 1 || errs[0].Error() != "Negative" {
+		t.Errorf("Want remote error, got %v", errs)
+	}
+
+	if _, ok := errs[0].(*RemoteError); !ok {
+		t.Errorf("Want *RemoteError, got %T", errs[0])
+	}
+
+	if acked, nacked := r.counts(); acked != 2 || nacked != 1 {
+		t.Errorf("Want 2 acked and 1 nacked, got %d and %d", acked, nacked)
+	}
+}
+
+func TestRemoteReconnect(t *testing.T) {
+	// Find a free port, so that the server can be restarted on it
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := l.Addr().String()
+	l.Close()
+
+	var (
+		in, cls = stream.New()
+		out     = Remote(addr, remoteOptions())(in)
+		double  = Map(IntMapper(func(x int) int { return x * 2 }))
+	)
+
+	go func() {
+		for range out.Errors() {
+		}
+	}()
+
+	// The server isn't running yet, so the value is sent once connected
+	go in.Value(NewContext(context.Background(), 1))
+	time.Sleep(time.Millisecond * 30)
+
+	l = serveRemote(t, addr, double)
+
+	if got := FromContext(<-out.Values()); got != 2 {
+		t.Errorf("Want 2, got %d", got)
+	}
+
+	// Restart the server, dropping the connection
+	l.Close()
+	time.Sleep(time.Millisecond * 30)
+	l = serveRemote(t, addr, double)
+	defer l.Close()
+
+	go in.Value(NewContext(context.Background(), 2))
+
+	if got := FromContext(<-out.Values()); got != 4 {
+		t.Errorf("Want 4, got %d", got)
+	}
+
+	cls()
+
+	for range out.Values() {
+	}
+}
+
+func TestRemoteReportsUnmatchedResults(t *testing.T) {
+	// Each value is sent twice with the same ack callbacks, so the second
+	// can't be returned once the first has finished the value
+	l := serveRemote(t, "127.0.0.1:0", func(in stream.Stream) stream.Stream {
+		out, cls := in.WithValues(make(chan context.Context))
+
+		go func() {
+			defer cls()
+
+			for ctx := range in.Values() {
+				out.Value(ctx)
+				out.Value(ctx)
+			}
+		}()
+
+		return out
+	})
+
+	defer l.Close()
+
+	values, errs := runPipeline(Remote(l.Addr().String(), remoteOptions()), []context.Context{NewContext(context.Background(), 1)})
+
+	if len(values) != 1 || FromContext(values[0]) != 1 {
+		t.Errorf("Want one result, got %v", values)
+	}
+
+	if len(errs) != 1 {
+		t.Errorf("Want an error for the unmatched result, got %v", errs)
+	}
+}
+
+func TestRemoteGivesUpWaitingForWindow(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := l.Addr().String()
+	l.Close()
+
+	var (
+		r       ackRecorder
+		opts    = remoteOptions()
+		in, cls = stream.New()
+	)
+
+	// No server is running, so the first value fills the window
+	opts.Window = 1
+	out := Remote(addr, opts)(in)
+
+	go func() {
+		for range out.Errors() {
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(r.value(2))
+
+	in.Value(r.value(1))
+	cancel()
+	in.Value(ctx)
+
+	for i := 0; i < 100; i++ {
+		if _, nacked := r.counts(); nacked == 1 {
+			break
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	if acked, nacked := r.counts(); acked != 0 || nacked != 1 {
+		t.Errorf("Want 0 acked and 1 nacked, got %d and %d", acked, nacked)
+	}
+
+	cls()
+}
+
+func TestRemoteGivesUpConnecting(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := l.Addr().String()
+	l.Close()
+
+	var (
+		r    ackRecorder
+		opts = remoteOptions()
+	)
+
+	// No server is running, so both values are nacked once the client gives
+	// up, whether they were sent before or after
+	opts.MaxRetries = 2
+	opts.RetryDelay = time.Millisecond
+
+	values, errs := runPipeline(Remote(addr, opts), []context.Context{r.value(1), r.value(2)})
+
+	if len(values) != 0 {
+		t.Errorf("Want no values, got %v", values)
+	}
+
+	if len(errs) != 4 || !strings.HasPrefix(errs[3].Error(), "Gave up") {
+		t.Errorf("Want 3 connection errors and then giving up, got %v", errs)
+	}
+
+	if acked, nacked := r.counts(); acked != 0 || nacked != 2 {
+		t.Errorf("Want 0 acked and 2 nacked, got %d and %d", acked, nacked)
+	}
+}
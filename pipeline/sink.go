@@ -5,21 +5,36 @@ import (
 	"golang.org/x/net/context"
 )
 
-// Sink creates a Pipeline that sends all input to fn, and swallows its output
+// Sink creates a Pipeline that sends all input to fn, and swallows its output.
+// Values are acked once fn succeeds, or nacked if it fails. Any SinkMiddleware
+// is applied to fn
 func Sink(fn func(ctx context.Context) error) Pipeline {
-	return func(in stream.Stream) stream.Stream {
+	return newStage("Sink", 1, nil, func(s *stage, in stream.Stream) stream.Stream {
 		out, cls := stream.New()
 
 		go func() {
 			defer cls()
 
+			info := s.info(0)
+			fn := s.wrapSink(info, fn)
+
 			for ctx := range in.Values() {
-				if err := fn(ctx); err != nil {
+				ctx, a := begin(ctx, info)
+				err := fn(ctx)
+				a.processed(err)
+				a.handOff(0)
+
+				if err == nil {
+					Ack(ctx)
+				} else {
+					Nack(ctx, err)
 					out.Error(err)
 				}
+
+				a.end()
 			}
 		}()
 
 		return out
-	}
+	})
 }
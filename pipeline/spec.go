@@ -0,0 +1,636 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Stage types that can be used in a StageSpec
+const (
+	StageMap         = "map"
+	StageFlatMap     = "flatmap"
+	StageFilter      = "filter"
+	StageReduce      = "reduce"
+	StageReduceRight = "reduce-right"
+	StageSink        = "sink"
+	StageLoop        = "loop"
+	StageTee         = "tee"
+	StageParallel    = "parallel"
+)
+
+// Spec describes a pipeline declaratively, so that it can be loaded from a file
+// rather than built in code. A spec in JSON looks like
+//
+//	{
+//	  "name": "crawler",
+//	  "stages": [
+//	    {"type": "loop", "name": "crawl", "stages": [
+//	      {"type": "map", "use": "fetch", "workers": 10, "params": {"timeout": "5s"}},
+//	      {"type": "flatmap", "use": "find-urls"},
+//	      {"type": "filter", "use": "dedupe"}
+//	    ]},
+//	    {"type": "sink", "use": "print"}
+//	  ]
+//	}
+//
+// The same spec can be written in YAML. See Registry for how specs are turned in
+// to pipelines
+type Spec struct {
+	// Name names the pipeline built from the spec. See Graph.Name
+	Name   string      `json:"name,omitempty"`
+	Stages []StageSpec `json:"stages"`
+}
+
+// StageSpec describes a single stage of a Spec
+type StageSpec struct {
+	// Type is one of the Stage constants
+	Type string `json:"type"`
+
+	// Name names the stage. See Named
+	Name string `json:"name,omitempty"`
+
+	// Use is the registered name of the Mapper, FlatMapper, Predicate,
+	// Reducer or Sink used by map, flatmap, filter, reduce, reduce-right and
+	// sink stages
+	Use string `json:"use,omitempty"`
+
+	// Params are passed to the factory registered for Use
+	Params Params `json:"params,omitempty"`
+
+	// Workers is the number of concurrent workers of a map or flatmap stage,
+	// or the number of instances run by a parallel stage. Zero means 1
+	Workers int `json:"workers,omitempty"`
+
+	// Stages is the pipeline wrapped by a loop, tee or parallel stage
+	Stages []StageSpec `json:"stages,omitempty"`
+
+	// Line is the line of the spec file that the stage was read from, or zero
+	// if it is not known
+	Line int `json:"-"`
+}
+
+// Params are the parameters of a stage in a Spec
+type Params map[string]interface{}
+
+// Decode decodes the params in to v, which should be a pointer to a struct with
+// json tags
+func (p Params) Decode(v interface{}) error {
+	data, err := json.Marshal(p)
+
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// SpecError is an error in a Spec
+type SpecError struct {
+	// Line of the spec file, or zero if not known
+	Line int
+
+	// Path to the offending field, such as stages[1].workers
+	Path string
+
+	Message string
+}
+
+func (e *SpecError) Error() string {
+	var buf bytes.Buffer
+
+	if e.Line > 0 {
+		fmt.Fprintf(&buf, "line %d: ", e.Line)
+	}
+
+	if e.Path != "" {
+		fmt.Fprintf(&buf, "%s: ", e.Path)
+	}
+
+	buf.WriteString(e.Message)
+
+	return buf.String()
+}
+
+// SpecErrors is a list of errors found in a Spec
+type SpecErrors []*SpecError
+
+func (e SpecErrors) Error() string {
+	msgs := make([]string, len(e))
+
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+
+	return strings.Join(msgs, "\n")
+}
+
+// ParseSpec reads a Spec from data, which holds either JSON or YAML. The
+// structure of the spec is validated, and any errors are returned as SpecErrors,
+// with the line of the spec that each was found on. Names of registered stages
+// are checked when the spec is built by a Registry. YAML specs can use anchors,
+// aliases and << merge keys, but an alias can not refer to a node that contains
+// it
+func ParseSpec(data []byte) (*Spec, error) {
+	var (
+		root *specNode
+		err  error
+	)
+
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		root, err = parseJSONNode(data)
+	} else {
+		root, err = parseYAMLNode(data)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		spec Spec
+		errs SpecErrors
+	)
+
+	fields := root.object("", &errs)
+
+	for key, node := range fields {
+		switch key {
+		case "name":
+			spec.Name = node.string(key, &errs)
+		case "stages":
+			spec.Stages = parseStages(node, key, &errs)
+		default:
+			errs.add(node, key, "Unknown field")
+		}
+	}
+
+	if _, ok := fields["stages"]; !ok && root.isObject() {
+		errs.add(root, "", "A pipeline needs at least one stage")
+	}
+
+	if len(errs) > 0 {
+		sort.Sort(errs)
+		return nil, errs
+	}
+
+	return &spec, nil
+}
+
+func parseStages(node *specNode, path string, errs *SpecErrors) []StageSpec {
+	items := node.array(path, errs)
+
+	if node.isArray() && len(items) == 0 {
+		errs.add(node, path, "A pipeline needs at least one stage")
+	}
+
+	stages := make([]StageSpec, len(items))
+
+	for i, item := range items {
+		stages[i] = parseStage(item, fmt.Sprintf("%s[%d]", path, i), errs)
+	}
+
+	return stages
+}
+
+func parseStage(node *specNode, path string, errs *SpecErrors) StageSpec {
+	s := StageSpec{
+		Line: node.line,
+	}
+
+	fields := node.object(path, errs)
+
+	for key, n := range fields {
+		p := path + "." + key
+
+		switch key {
+		case "type":
+			s.Type = n.string(p, errs)
+		case "name":
+			s.Name = n.string(p, errs)
+		case "use":
+			s.Use = n.string(p, errs)
+		case "params":
+			if n.isObject() {
+				s.Params = n.plain().(map[string]interface{})
+			} else {
+				errs.add(n, p, "Want an object")
+			}
+		case "workers":
+			if s.Workers = n.int(p, errs); s.Workers < 0 {
+				errs.add(n, p, "Workers can not be negative")
+			}
+		case "stages":
+			s.Stages = parseStages(n, p, errs)
+		default:
+			errs.add(n, p, "Unknown field")
+		}
+	}
+
+	if !node.isObject() {
+		return s
+	}
+
+	switch s.Type {
+	case StageMap, StageFlatMap, StageFilter, StageReduce, StageReduceRight, StageSink:
+		if s.Use == "" {
+			errs.add(node, path, fmt.Sprintf("A %s stage needs a use field", s.Type))
+		}
+
+		if n, ok := fields["stages"]; ok {
+			errs.add(n, path+".stages", fmt.Sprintf("A %s stage can not wrap other stages", s.Type))
+		}
+
+		if n, ok := fields["workers"]; ok && s.Type != StageMap && s.Type != StageFlatMap {
+			errs.add(n, path+".workers", fmt.Sprintf("A %s stage has a single worker", s.Type))
+		}
+
+	case StageLoop, StageTee, StageParallel:
+		if _, ok := fields["stages"]; !ok {
+			errs.add(node, path, fmt.Sprintf("A %s stage needs stages to wrap", s.Type))
+		}
+
+		if n, ok := fields["use"]; ok {
+			errs.add(n, path+".use", fmt.Sprintf("A %s stage does not use a registered stage", s.Type))
+		}
+
+		if n, ok := fields["params"]; ok {
+			errs.add(n, path+".params", fmt.Sprintf("A %s stage does not take params", s.Type))
+		}
+
+		if n, ok := fields["workers"]; ok && s.Type != StageParallel {
+			errs.add(n, path+".workers", fmt.Sprintf("A %s stage has a single worker", s.Type))
+		}
+
+	default:
+		if _, ok := fields["type"]; !ok {
+			errs.add(node, path, "A stage needs a type")
+			break
+		}
+
+		errs.add(fields["type"], path+".type", fmt.Sprintf("Unknown stage type %q", s.Type))
+	}
+
+	return s
+}
+
+func (e *SpecErrors) add(node *specNode, path, msg string) {
+	*e = append(*e, &SpecError{node.line, path, msg})
+}
+
+func (e SpecErrors) Len() int      { return len(e) }
+func (e SpecErrors) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+
+func (e SpecErrors) Less(i, j int) bool {
+	if e[i].Line != e[j].Line {
+		return e[i].Line < e[j].Line
+	}
+
+	return e[i].Path < e[j].Path
+}
+
+// specNode is a value read from a spec, along with the line it was read from.
+// Its value is nil, a bool, a json.Number, a string, a []*specNode or a
+// map[string]*specNode
+type specNode struct {
+	line  int
+	value interface{}
+}
+
+// parseJSONNode reads a tree of nodes from JSON, recording the line of each
+func parseJSONNode(data []byte) (*specNode, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	p := &jsonNodeParser{data, dec}
+	root, err := p.parse()
+
+	if err != nil {
+		return nil, p.error(err)
+	}
+
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, &SpecError{Line: p.line(dec.InputOffset()), Message: "Unexpected data after the spec"}
+	}
+
+	return root, nil
+}
+
+type jsonNodeParser struct {
+	data []byte
+	dec  *json.Decoder
+}
+
+func (p *jsonNodeParser) parse() (*specNode, error) {
+	// The decoder's offset is at the end of the previous token, so skip
+	// ahead to the start of the next one
+	offset := p.dec.InputOffset()
+
+	for offset < int64(len(p.data)) && strings.IndexByte(" \t\r\n,:", p.data[offset]) >= 0 {
+		offset++
+	}
+
+	tok, err := p.dec.Token()
+
+	if err != nil {
+		return nil, err
+	}
+
+	node := &specNode{
+		line: p.line(offset),
+	}
+
+	switch tok {
+	case json.Delim('{'):
+		fields := make(map[string]*specNode)
+
+		for p.dec.More() {
+			key, err := p.dec.Token()
+
+			if err != nil {
+				return nil, err
+			}
+
+			if fields[key.(string)], err = p.parse(); err != nil {
+				return nil, err
+			}
+		}
+
+		node.value = fields
+
+	case json.Delim('['):
+		var items []*specNode
+
+		for p.dec.More() {
+			item, err := p.parse()
+
+			if err != nil {
+				return nil, err
+			}
+
+			items = append(items, item)
+		}
+
+		node.value = items
+
+	default:
+		node.value = tok
+		return node, nil
+	}
+
+	// Consume the closing delimiter
+	if _, err := p.dec.Token(); err != nil {
+		return nil, err
+	}
+
+	return node, nil
+}
+
+// line returns the line of the byte at offset
+func (p *jsonNodeParser) line(offset int64) int {
+	if offset > int64(len(p.data)) {
+		offset = int64(len(p.data))
+	}
+
+	return bytes.Count(p.data[:offset], []byte("\n")) + 1
+}
+
+func (p *jsonNodeParser) error(err error) error {
+	if se, ok := err.(*json.SyntaxError); ok {
+		return &SpecError{Line: p.line(se.Offset), Message: se.Error()}
+	}
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return &SpecError{Line: p.line(int64(len(p.data))), Message: "Unexpected end of spec"}
+	}
+
+	return &SpecError{Line: p.line(p.dec.InputOffset()), Message: err.Error()}
+}
+
+// parseYAMLNode reads a tree of nodes from YAML, recording the line of each
+func parseYAMLNode(data []byte) (*specNode, error) {
+	var doc yaml.Node
+
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		// Syntax errors are reported as "yaml: line N: message"
+		se := &SpecError{Message: err.Error()}
+
+		var msg string
+
+		if n, _ := fmt.Sscanf(err.Error(), "yaml: line %d: %s", &se.Line, &msg); n == 2 {
+			se.Message = strings.SplitN(err.Error(), ": ", 3)[2]
+		}
+
+		return nil, se
+	}
+
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 {
+		return nil, &SpecError{Line: 1, Message: "Spec is empty"}
+	}
+
+	c := &yamlConverter{expanding: make(map[*yaml.Node]bool)}
+	return c.node(doc.Content[0])
+}
+
+// yamlConverter converts YAML nodes to spec nodes, keeping track of the
+// aliases being expanded so that an alias that refers to itself is reported
+// rather than expanded forever
+type yamlConverter struct {
+	expanding map[*yaml.Node]bool
+}
+
+// node converts a YAML node to a tree of spec nodes
+func (c *yamlConverter) node(n *yaml.Node) (*specNode, error) {
+	node := &specNode{
+		line: n.Line,
+	}
+
+	switch n.Kind {
+	case yaml.AliasNode:
+		if c.expanding[n.Alias] {
+			return nil, &SpecError{Line: n.Line, Message: fmt.Sprintf("Recursive alias *%s", n.Value)}
+		}
+
+		c.expanding[n.Alias] = true
+		defer delete(c.expanding, n.Alias)
+
+		return c.node(n.Alias)
+
+	case yaml.MappingNode:
+		fields := make(map[string]*specNode)
+		merged := make(map[string]*specNode)
+
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			item, err := c.node(n.Content[i+1])
+
+			if err != nil {
+				return nil, err
+			}
+
+			if n.Content[i].Tag == "!!merge" {
+				if err := mergeYAMLNode(merged, item); err != nil {
+					return nil, err
+				}
+				continue
+			}
+
+			fields[n.Content[i].Value] = item
+		}
+
+		// Fields of the mapping override those merged in to it
+		for k, v := range merged {
+			if _, ok := fields[k]; !ok {
+				fields[k] = v
+			}
+		}
+
+		node.value = fields
+
+	case yaml.SequenceNode:
+		items := make([]*specNode, len(n.Content))
+
+		for i, child := range n.Content {
+			item, err := c.node(child)
+
+			if err != nil {
+				return nil, err
+			}
+
+			items[i] = item
+		}
+
+		node.value = items
+
+	case yaml.ScalarNode:
+		var v interface{}
+
+		if err := n.Decode(&v); err != nil {
+			return nil, &SpecError{Line: n.Line, Message: err.Error()}
+		}
+
+		switch t := v.(type) {
+		case int, int64, uint64, float64:
+			node.value = json.Number(fmt.Sprint(t))
+		default:
+			node.value = t
+		}
+
+	default:
+		return nil, &SpecError{Line: n.Line, Message: "Unexpected YAML node"}
+	}
+
+	return node, nil
+}
+
+// mergeYAMLNode adds the fields of the value of a << merge key to merged. The
+// value is a mapping, or a sequence of mappings where earlier mappings take
+// precedence
+func mergeYAMLNode(merged map[string]*specNode, value *specNode) error {
+	switch v := value.value.(type) {
+	case map[string]*specNode:
+		for k, f := range v {
+			if _, ok := merged[k]; !ok {
+				merged[k] = f
+			}
+		}
+
+		return nil
+
+	case []*specNode:
+		for _, item := range v {
+			if !item.isObject() {
+				return &SpecError{Line: item.line, Message: "Only mappings can be merged"}
+			}
+
+			mergeYAMLNode(merged, item)
+		}
+
+		return nil
+	}
+
+	return &SpecError{Line: value.line, Message: "Only mappings can be merged"}
+}
+
+func (n *specNode) isObject() bool {
+	_, ok := n.value.(map[string]*specNode)
+	return ok
+}
+
+func (n *specNode) isArray() bool {
+	_, ok := n.value.([]*specNode)
+	return ok
+}
+
+func (n *specNode) object(path string, errs *SpecErrors) map[string]*specNode {
+	fields, ok := n.value.(map[string]*specNode)
+
+	if !ok {
+		errs.add(n, path, "Want an object")
+	}
+
+	return fields
+}
+
+func (n *specNode) array(path string, errs *SpecErrors) []*specNode {
+	items, ok := n.value.([]*specNode)
+
+	if !ok {
+		errs.add(n, path, "Want a list")
+	}
+
+	return items
+}
+
+func (n *specNode) string(path string, errs *SpecErrors) string {
+	s, ok := n.value.(string)
+
+	if !ok {
+		errs.add(n, path, "Want a string")
+	}
+
+	return s
+}
+
+func (n *specNode) int(path string, errs *SpecErrors) int {
+	if num, ok := n.value.(json.Number); ok {
+		if i, err := num.Int64(); err == nil {
+			return int(i)
+		}
+	}
+
+	errs.add(n, path, "Want a whole number")
+
+	return 0
+}
+
+// plain converts the node back to a plain value, as decoded by encoding/json
+func (n *specNode) plain() interface{} {
+	switch t := n.value.(type) {
+	case json.Number:
+		f, _ := t.Float64()
+		return f
+	case []*specNode:
+		items := make([]interface{}, len(t))
+
+		for i, item := range t {
+			items[i] = item.plain()
+		}
+
+		return items
+	case map[string]*specNode:
+		fields := make(map[string]interface{})
+
+		for k, item := range t {
+			fields[k] = item.plain()
+		}
+
+		return fields
+	}
+
+	return n.value
+}
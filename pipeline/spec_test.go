@@ -0,0 +1,194 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSpec(t *testing.T) {
+	spec, err := ParseSpec([]byte(`{
+  "name": "test",
+  "stages": [
+    {"type": "map", "use": "multiply", "workers": 4, "params": {"by": 2}},
+    {"type": "loop", "name": "again", "stages": [
+      {"type": "filter", "use": "small"}
+    ]}
+  ]
+}`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &Spec{
+		Name: "test",
+		Stages: []StageSpec{
+			{Type: "map", Use: "multiply", Workers: 4, Params: Params{"by": 2.0}, Line: 4},
+			{Type: "loop", Name: "again", Line: 5, Stages: []StageSpec{
+				{Type: "filter", Use: "small", Line: 6},
+			}},
+		},
+	}
+
+	if !reflect.DeepEqual(spec, want) {
+		t.Errorf("Want %+v, got %+v", want, spec)
+	}
+}
+
+func TestParseSpecErrors(t *testing.T) {
+	_, err := ParseSpec([]byte(`{
+  "stages": [
+    {"type": "map"},
+    {"type": "map", "use": "x", "workers": "many"},
+    {"type": "loop"},
+    {"type": "sideways"},
+    {"use": "x", "color": "red"}
+  ]
+}`))
+
+	errs, ok := err.(SpecErrors)
+
+	if !ok {
+		t.Fatalf("Want SpecErrors, got %v", err)
+	}
+
+	want := []string{
+		"line 3: stages[0]: A map stage needs a use field",
+		"line 4: stages[1].workers: Want a whole number",
+		"line 5: stages[2]: A loop stage needs stages to wrap",
+		"line 6: stages[3].type: Unknown stage type \"sideways\"",
+		"line 7: stages[4]: A stage needs a type",
+		"line 7: stages[4].color: Unknown field",
+	}
+
+	var got []string
+
+	for _, e := range errs {
+		got = append(got, e.Error())
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Want\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestParseSpecSyntaxError(t *testing.T) {
+	_, err := ParseSpec([]byte("{\n  \"stages\": [\n    {\"type\": \"map\",}\n  ]\n}"))
+
+	if se, ok := err.(*SpecError); !ok || se.Line != 3 {
+		t.Errorf("Want error on line 3, got %v", err)
+	}
+}
+
+func TestParseSpecYAML(t *testing.T) {
+	spec, err := ParseSpec([]byte(`name: crawler
+stages:
+  - type: map
+    use: multiply
+    workers: 2
+    params:
+      by: 3
+  - type: tee
+`))
+
+	if err == nil || err.Error() != "line 8: stages[1]: A tee stage needs stages to wrap" {
+		t.Errorf("Want error on line 8, got %v", err)
+	}
+
+	spec, err = ParseSpec([]byte(`name: crawler
+stages:
+  - type: map
+    use: multiply
+    workers: 2
+    params:
+      by: 3
+`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if spec.Name != "crawler" || len(spec.Stages) != 1 {
+		t.Fatalf("Want crawler with one stage, got %+v", spec)
+	}
+
+	if s := spec.Stages[0]; s.Line != 3 || s.Workers != 2 || fmt.Sprint(s.Params["by"]) != "3" {
+		t.Errorf("Want map stage on line 3, got %+v", s)
+	}
+}
+
+func TestParseSpecYAMLSyntaxError(t *testing.T) {
+	_, err := ParseSpec([]byte("stages:\n  - type: map\n  use: [\n"))
+
+	if se, ok := err.(*SpecError); !ok || se.Line == 0 {
+		t.Errorf("Want error with a line number, got %v", err)
+	}
+}
+
+func TestParseSpecYAMLAliases(t *testing.T) {
+	spec, err := ParseSpec([]byte(`defaults: &defaults
+  type: map
+  use: multiply
+  workers: 2
+stages:
+  - <<: *defaults
+    params:
+      by: 3
+  - <<: *defaults
+    workers: 4
+`))
+
+	if err == nil || !strings.Contains(err.Error(), "defaults: Unknown field") {
+		t.Errorf("Want only the defaults field to be unknown, got %v", err)
+	}
+
+	spec, err = ParseSpec([]byte(`stages:
+  - &double
+    type: map
+    use: multiply
+    workers: 2
+  - <<: *double
+    workers: 4
+  - *double
+`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(spec.Stages) != 3 || spec.Stages[1].Use != "multiply" || spec.Stages[1].Workers != 4 || spec.Stages[2].Workers != 2 {
+		t.Errorf("Want merged and aliased stages, got %+v", spec.Stages)
+	}
+}
+
+func TestParseSpecYAMLRecursiveAlias(t *testing.T) {
+	_, err := ParseSpec([]byte("stages: &a\n  - type: loop\n    stages: *a\n"))
+
+	if se, ok := err.(*SpecError); !ok || se.Line != 3 || !strings.Contains(se.Message, "Recursive alias") {
+		t.Errorf("Want recursive alias error on line 3, got %v", err)
+	}
+}
+
+func TestParamsDecode(t *testing.T) {
+	var params Params
+
+	if err := json.Unmarshal([]byte(`{"by": 3, "name": "x"}`), &params); err != nil {
+		t.Fatal(err)
+	}
+
+	var cfg struct {
+		By   int    `json:"by"`
+		Name string `json:"name"`
+	}
+
+	if err := params.Decode(&cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.By != 3 || cfg.Name != "x" {
+		t.Errorf("Unexpected params %+v", cfg)
+	}
+}
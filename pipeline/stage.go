@@ -0,0 +1,159 @@
+package pipeline
+
+import (
+	"time"
+
+	"github.com/bernos/go-pipeline/pipeline/stream"
+	"golang.org/x/net/context"
+)
+
+// StageInfo describes a stage in a Pipeline, and the worker within that stage
+// that is processing a value
+type StageInfo struct {
+	Name   string
+	Type   string
+	Worker int
+
+	// stage identifies the built-in stage, as several stages may share a name
+	stage *stage
+}
+
+// stage is a single built-in stage of a pipeline
+type stage struct {
+	typ     string
+	name    string
+	workers int
+
+	// origin is the stage that s was copied from when it was named, or s
+	origin *stage
+
+	// Middleware in scope for the stage, innermost first
+	middleware []*Middlewares
+}
+
+// stageFunc implements a built-in stage, consuming values from in and returning
+// its output stream
+type stageFunc func(s *stage, in stream.Stream) stream.Stream
+
+// newStage creates a Pipeline for a built-in stage of type t, processing values
+// with the given number of workers. If the stage wraps another pipeline, inner
+// is used to describe it
+func newStage(t string, workers int, inner Pipeline, fn stageFunc) Pipeline {
+	s := &stage{
+		typ:     t,
+		name:    t,
+		workers: workers,
+	}
+	s.origin = s
+
+	return func(in stream.Stream) stream.Stream {
+		if d, ok := in.(*describer); ok {
+			d.add(s, inner)
+			return d
+		}
+
+		return fn(s.scoped(in), in)
+	}
+}
+
+// scoped returns s, or a copy of s carrying the name and middleware given to it
+// by the pipelines that in is the input of
+func (s *stage) scoped(in stream.Stream) *stage {
+	scoped := s.named(in)
+
+	if mw := middlewareOf(in); len(mw) > 0 {
+		c := *scoped
+		c.middleware = mw
+		scoped = &c
+	}
+
+	return scoped
+}
+
+// named returns s, or a copy of s with a new name if in is the input of a
+// pipeline that names it. When a stage is named more than once, the outermost
+// name is used
+func (s *stage) named(in stream.Stream) *stage {
+	named := s
+
+	for w := in; w != nil; w = unwrap(w) {
+		if n, ok := w.(*naming); ok && n.stage == s {
+			c := *s
+			c.name = n.name
+			named = &c
+		}
+	}
+
+	return named
+}
+
+// info describes worker i of the stage
+func (s *stage) info(i int) StageInfo {
+	return StageInfo{
+		Name:   s.name,
+		Type:   s.typ,
+		Worker: i,
+		stage:  s.origin,
+	}
+}
+
+// activity follows a single value as it is processed by a built-in stage,
+// reporting to any Metrics and Tracer carried by the value's context
+type activity struct {
+	ctx     context.Context
+	info    StageInfo
+	start   time.Time
+	metrics *Metrics
+	span    Span
+
+	// The number of values produced for later stages
+	outputs int
+}
+
+// begin is called by built-in stages before processing ctx. The returned context should be used in place of ctx from
+// then on, so that any span started for the stage is carried into its output
+func begin(ctx context.Context, info StageInfo) (context.Context, *activity) {
+	a := &activity{
+		info:    info,
+		outputs: 1,
+	}
+
+	a.metrics, _ = MetricsFromContext(ctx)
+
+	if t, ok := TracerFromContext(ctx); ok {
+		ctx, a.span = t.Start(ctx, info)
+	}
+
+	a.ctx, a.start = ctx, time.Now()
+
+	return ctx, a
+}
+
+// processed records the outcome of processing a value. A value that failed is
+// assumed to have produced no values
+func (a *activity) processed(err error) {
+	if a.metrics != nil {
+		a.metrics.Observe(a.info, time.Since(a.start), err)
+	}
+
+	if a.span != nil && err != nil {
+		a.span.SetError(err)
+		a.handOff(0)
+	}
+}
+
+// handOff records that processing the value produced n values for later stages,
+// where that is not the single value produced by most stages
+func (a *activity) handOff(n int) {
+	if a.span != nil && n != a.outputs {
+		handOff(a.ctx, n-a.outputs)
+		a.outputs = n
+	}
+}
+
+// end is called once the result of processing a value has been emitted
+func (a *activity) end() {
+	if a.span != nil {
+		a.span.End()
+	}
+}
@@ -0,0 +1,35 @@
+//go:build go1.18
+
+package stream
+
+import (
+	"golang.org/x/net/context"
+)
+
+// FromChan creates a stream of the values received from ch, wrapping each value
+// in a Context created by box. The stream is closed once ch is closed. Closing
+// the stream stops it receiving from ch, but does not close ch
+func FromChan[T any](ch <-chan T, box func(T) context.Context) (Stream, CloseFunc) {
+	output, closeOutput := newSource()
+
+	go func() {
+		defer closeOutput()
+
+		for {
+			select {
+			case <-output.done:
+				return
+			case v, ok := <-ch:
+				if !ok {
+					return
+				}
+
+				if !output.send(box(v), nil) {
+					return
+				}
+			}
+		}
+	}()
+
+	return output, closeOutput
+}
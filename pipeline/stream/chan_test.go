@@ -0,0 +1,53 @@
+//go:build go1.18
+
+package stream
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestFromChan(t *testing.T) {
+	ch := make(chan int)
+	out, cls := FromChan(ch, func(x int) context.Context {
+		return NewContext(context.Background(), x)
+	})
+
+	defer cls()
+
+	go func() {
+		defer close(ch)
+		ch <- 1
+		ch <- 2
+	}()
+
+	sum := 0
+
+	for ctx := range out.Values() {
+		sum += FromContext(ctx)
+	}
+
+	if sum != 3 {
+		t.Errorf("Want %d, got %d", 3, sum)
+	}
+}
+
+func TestFromChanStopsWhenClosed(t *testing.T) {
+	ch := make(chan int)
+	out, cls := FromChan(ch, func(x int) context.Context {
+		return NewContext(context.Background(), x)
+	})
+
+	cls()
+
+	for range out.Values() {
+	}
+
+	// The channel is no longer read once the stream is closed
+	select {
+	case ch <- 1:
+		t.Error("Expected channel not to be read")
+	default:
+	}
+}
@@ -0,0 +1,275 @@
+package stream
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed cron expression. See ParseCron
+type Schedule struct {
+	minute, hour, dom, month, dow bitset
+
+	// Whether the day of month and day of week fields were "*"
+	domAny, dowAny bool
+
+	location *time.Location
+}
+
+type bitset uint64
+
+func (b bitset) has(i int) bool {
+	return b&(1<<uint(i)) != 0
+}
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var monthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var dayNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+// ParseCron parses a standard five field cron expression
+//
+//	minute hour day-of-month month day-of-week
+//
+// Each field may be "*", a value, a range such as "1-5", or a comma separated
+// list of these, and values and ranges may be followed by a step such as "/15".
+// Months and days of the week may be given by their three letter English names,
+// and both 0 and 7 mean Sunday. As with standard cron, if both the day of month
+// and day of week are restricted, a day matching either of them is used. The
+// descriptors @yearly, @monthly, @weekly, @daily and @hourly are also accepted.
+//
+// Times are in the local time zone, unless the expression starts with
+// CRON_TZ= or TZ= and the name of a time zone, such as
+// "CRON_TZ=Europe/London 0 9 * * MON-FRI"
+func ParseCron(spec string) (*Schedule, error) {
+	s := &Schedule{
+		location: time.Local,
+	}
+
+	expr := strings.TrimSpace(spec)
+
+	if strings.HasPrefix(expr, "CRON_TZ=") || strings.HasPrefix(expr, "TZ=") {
+		i := strings.IndexAny(expr, " \t")
+
+		if i < 0 {
+			return nil, fmt.Errorf("Invalid cron spec %q: missing fields", spec)
+		}
+
+		loc, err := time.LoadLocation(expr[strings.Index(expr, "=")+1 : i])
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid cron spec %q: %s", spec, err.Error())
+		}
+
+		s.location = loc
+		expr = strings.TrimSpace(expr[i:])
+	}
+
+	if d, ok := cronDescriptors[strings.ToLower(expr)]; ok {
+		expr = d
+	}
+
+	fields := strings.Fields(expr)
+
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Invalid cron spec %q: want 5 fields, got %d", spec, len(fields))
+	}
+
+	var err error
+
+	parsers := []struct {
+		field    *bitset
+		min, max int
+		names    map[string]int
+	}{
+		{&s.minute, 0, 59, nil},
+		{&s.hour, 0, 23, nil},
+		{&s.dom, 1, 31, nil},
+		{&s.month, 1, 12, monthNames},
+		{&s.dow, 0, 7, dayNames},
+	}
+
+	for i, p := range parsers {
+		if *p.field, err = parseCronField(fields[i], p.min, p.max, p.names); err != nil {
+			return nil, fmt.Errorf("Invalid cron spec %q: %s", spec, err.Error())
+		}
+	}
+
+	// Sunday may be given as either 0 or 7
+	if s.dow.has(7) {
+		s.dow |= 1
+	}
+
+	s.domAny = fields[2] == "*"
+	s.dowAny = fields[4] == "*"
+
+	return s, nil
+}
+
+func parseCronField(field string, min, max int, names map[string]int) (bitset, error) {
+	var bits bitset
+
+	for _, part := range strings.Split(field, ",") {
+		var (
+			rng  = part
+			step = 1
+			err  error
+		)
+
+		if i := strings.Index(part, "/"); i >= 0 {
+			rng = part[:i]
+
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+		}
+
+		lo, hi := min, max
+
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+
+			if lo, err = parseCronValue(bounds[0], names); err != nil {
+				return 0, err
+			}
+
+			hi = lo
+
+			if len(bounds) == 2 {
+				if hi, err = parseCronValue(bounds[1], names); err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				// "5/15" means every 15 starting from 5
+				hi = max
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+
+		for i := lo; i <= hi; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+
+	return bits, nil
+}
+
+func parseCronValue(s string, names map[string]int) (int, error) {
+	if v, ok := names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+
+	v, err := strconv.Atoi(s)
+
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+
+	return v, nil
+}
+
+// Next returns the first time on the schedule after t, or the zero time if
+// there is none in the next five years
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = t.In(s.location).Truncate(time.Minute).Add(time.Minute)
+	limit := t.Year() + 5
+
+	for t.Year() <= limit {
+		switch {
+		case !s.month.has(int(t.Month())):
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, s.location)
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, s.location)
+		case !s.hour.has(t.Hour()):
+			t = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+		case !s.minute.has(t.Minute()):
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+func (s *Schedule) dayMatches(t time.Time) bool {
+	dom, dow := s.dom.has(t.Day()), s.dow.has(int(t.Weekday()))
+
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+
+	return dom || dow
+}
+
+// Cron creates a stream that sends a value at each time on the schedule given by
+// spec, which is parsed by ParseCron. The tick time carried by each value is the
+// scheduled time. If the stream is not read in time for one or more scheduled
+// times, for example because the pipeline was busy or the machine was asleep,
+// a single value is sent for the latest of them, rather than one for each. An
+// invalid spec is sent on the error stream, and the stream is closed. Otherwise
+// the stream is only closed by its CloseFunc
+func Cron(spec string) (Stream, CloseFunc) {
+	output, closeOutput := newSource()
+
+	go func() {
+		defer closeOutput()
+
+		s, err := ParseCron(spec)
+
+		if err != nil {
+			output.send(nil, err)
+			return
+		}
+
+		next := s.Next(time.Now())
+
+		for !next.IsZero() {
+			timer := time.NewTimer(next.Sub(time.Now()))
+
+			select {
+			case <-output.done:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			// Skip any times that were missed while waiting
+			for {
+				after := s.Next(next)
+
+				if after.IsZero() || after.After(time.Now()) {
+					break
+				}
+
+				next = after
+			}
+
+			if !output.send(newTick(next), nil) {
+				return
+			}
+
+			next = s.Next(next)
+		}
+	}()
+
+	return output, closeOutput
+}
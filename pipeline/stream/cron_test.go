@@ -0,0 +1,80 @@
+package stream
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	base := time.Date(2024, time.January, 31, 10, 17, 30, 0, time.UTC) // A Wednesday
+
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2024, 1, 31, 10, 18, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 1, 31, 10, 30, 0, 0, time.UTC)},
+		{"5/20 * * * *", time.Date(2024, 1, 31, 10, 25, 0, 0, time.UTC)},
+		{"0 9 * * MON-FRI", time.Date(2024, 2, 1, 9, 0, 0, 0, time.UTC)},
+		{"0 0 29 feb *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1,15 * 7", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"30 8 * * sun", time.Date(2024, 2, 4, 8, 30, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+
+	for _, test := range tests {
+		s, err := ParseCron("TZ=UTC " + test.spec)
+
+		if err != nil {
+			t.Errorf("%s: %s", test.spec, err)
+			continue
+		}
+
+		if got := s.Next(base); !got.Equal(test.want) {
+			t.Errorf("%s: want %s, got %s", test.spec, test.want, got)
+		}
+	}
+}
+
+func TestParseCronTimeZone(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+
+	if err != nil {
+		t.Skip("Time zone data is not available")
+	}
+
+	s, err := ParseCron("CRON_TZ=America/New_York 0 9 * * *")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := s.Next(time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC))
+
+	// 12:00 UTC is 07:00 in New York
+	if want := time.Date(2024, 1, 31, 9, 0, 0, 0, loc); !got.Equal(want) {
+		t.Errorf("Want %s, got %s", want, got)
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * * * mon-", "*/0 * * * *", "TZ=Nowhere/Land * * * * *", "5-1 * * * *"} {
+		if _, err := ParseCron(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
+
+func TestCronInvalidSpec(t *testing.T) {
+	out, cls := Cron("not a spec")
+	defer cls()
+
+	if err := <-out.Errors(); err == nil {
+		t.Error("Expected an error")
+	}
+
+	if _, ok := <-out.Values(); ok {
+		t.Error("Expected stream to be closed")
+	}
+}
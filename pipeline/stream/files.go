@@ -0,0 +1,397 @@
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+type fileKey int
+
+const (
+	fileContextKey fileKey = iota
+	lineContextKey
+)
+
+// File is a file found by FromFiles
+type File struct {
+	Path string
+	Info os.FileInfo
+}
+
+// FileFromContext retrieves a File from a context created by FromFiles
+func FileFromContext(ctx context.Context) (File, bool) {
+	f, ok := ctx.Value(fileContextKey).(File)
+	return f, ok
+}
+
+// Line is a line read by Tail
+type Line struct {
+	Path string
+	Text string
+}
+
+// LineFromContext retrieves a Line from a context created by Tail
+func LineFromContext(ctx context.Context) (Line, bool) {
+	l, ok := ctx.Value(lineContextKey).(Line)
+	return l, ok
+}
+
+// FromFiles creates a stream with a value for each regular file matching any of
+// globs. Patterns use the syntax of filepath.Match, along with "**", which
+// matches any number of directories, so "logs/**/*.log" matches every log file
+// under logs. Files are sent in lexical order for each pattern, and a file
+// matched by more than one pattern is only sent once. The File can be retrieved
+// from each value using FileFromContext. Malformed patterns and errors reading
+// directories are sent on the error stream. The stream is closed once all
+// patterns have been searched
+func FromFiles(globs ...string) (Stream, CloseFunc) {
+	return FromFilesWithOffsets(nil, "", globs...)
+}
+
+// FromFilesWithOffsets creates a stream in the same way as FromFiles, recording
+// the number of files sent in offsets under name. If offsets already holds a
+// position for name, that many files are skipped before any are sent, so that a
+// restarted source carries on from where it left off, provided the same files
+// are found
+func FromFilesWithOffsets(offsets Offsets, name string, globs ...string) (Stream, CloseFunc) {
+	output, closeOutput := newSource()
+	pos := position{offsets, name}
+
+	go func() {
+		defer closeOutput()
+
+		var (
+			seen = make(map[string]bool)
+			skip = pos.get()
+			n    int64
+		)
+
+		for _, glob := range globs {
+			files, errs := findFiles(glob)
+
+			for _, err := range errs {
+				if !output.send(nil, err) {
+					return
+				}
+			}
+
+			for _, f := range files {
+				if seen[f.Path] {
+					continue
+				}
+
+				seen[f.Path] = true
+				n++
+
+				if n <= skip {
+					continue
+				}
+
+				if !output.send(context.WithValue(context.Background(), fileContextKey, f), nil) {
+					return
+				}
+
+				pos.set(n)
+			}
+		}
+	}()
+
+	return output, closeOutput
+}
+
+// findFiles returns the regular files matching glob, sorted by path
+func findFiles(glob string) ([]File, []error) {
+	if !strings.Contains(glob, "**") {
+		paths, err := filepath.Glob(glob)
+
+		if err != nil {
+			return nil, []error{err}
+		}
+
+		var files []File
+
+		for _, path := range paths {
+			if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+				files = append(files, File{path, info})
+			}
+		}
+
+		return files, nil
+	}
+
+	// Walk from the longest leading part of the pattern with no wildcards
+	var (
+		segments = strings.Split(filepath.ToSlash(glob), "/")
+		root     []string
+	)
+
+	for len(segments) > 1 && !strings.ContainsAny(segments[0], `*?[\`) {
+		root = append(root, segments[0])
+		segments = segments[1:]
+	}
+
+	dir := filepath.FromSlash(strings.Join(root, "/"))
+
+	if dir == "" {
+		dir = "."
+	} else if len(root) == 1 && root[0] == "" {
+		dir = "/"
+	}
+
+	if _, err := filepath.Match(strings.Join(segments, "/"), ""); err != nil {
+		return nil, []error{err}
+	}
+
+	var (
+		files []File
+		errs  []error
+	)
+
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			errs = append(errs, err)
+			return nil
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+
+		if err == nil && matchSegments(segments, strings.Split(filepath.ToSlash(rel), "/")) {
+			files = append(files, File{path, info})
+		}
+
+		return nil
+	})
+
+	sort.Sort(byPath(files))
+
+	return files, errs
+}
+
+// matchSegments matches a path against a pattern, one path segment at a time
+func matchSegments(pattern, path []string) bool {
+	if len(pattern) == 0 {
+		return len(path) == 0
+	}
+
+	if pattern[0] == "**" {
+		for i := 0; i <= len(path); i++ {
+			if matchSegments(pattern[1:], path[i:]) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	if len(path) == 0 {
+		return false
+	}
+
+	if ok, _ := filepath.Match(pattern[0], path[0]); !ok {
+		return false
+	}
+
+	return matchSegments(pattern[1:], path[1:])
+}
+
+type byPath []File
+
+func (f byPath) Len() int           { return len(f) }
+func (f byPath) Less(i, j int) bool { return f[i].Path < f[j].Path }
+func (f byPath) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+
+// tailPollInterval is how often Tail checks a file for changes
+const tailPollInterval = time.Millisecond * 250
+
+// Tail creates a stream of the lines appended to the file at path, in the same
+// way as tail -F. Lines already in the file are skipped. If the file is
+// truncated, Tail reads it again from its start. If the file is renamed or
+// removed, for example by log rotation, the rest of the old file is read, and
+// Tail then follows the new file at path from its start once it appears. The
+// path does not need to exist when Tail is called. The Line can be retrieved from
+// each value using LineFromContext. The stream is only closed by its CloseFunc
+func Tail(path string) (Stream, CloseFunc) {
+	return TailWithOffsets(path, nil, "")
+}
+
+// TailWithOffsets creates a stream in the same way as Tail, recording the byte
+// offset of the end of the last line sent in offsets under name. If offsets
+// already holds a position for name, lines are read from there, rather than
+// from the end of the file, so that a restarted source carries on from where it
+// left off. If the file is now shorter than the offset, it is read from the
+// start
+func TailWithOffsets(path string, offsets Offsets, name string) (Stream, CloseFunc) {
+	return tailFile(path, offsets, name, tailPollInterval)
+}
+
+// tailFile creates the stream for Tail, checking the file for changes every
+// interval
+func tailFile(path string, offsets Offsets, name string, interval time.Duration) (Stream, CloseFunc) {
+	output, closeOutput := newSource()
+
+	go func() {
+		defer closeOutput()
+
+		t := &tail{
+			path:     path,
+			output:   output,
+			pos:      position{offsets, name},
+			interval: interval,
+		}
+
+		t.run()
+	}()
+
+	return output, closeOutput
+}
+
+// tail follows a single file for Tail
+type tail struct {
+	path    string
+	output  *stream
+	file    *os.File
+	info    os.FileInfo
+	reader  *bufio.Reader
+	offset  int64
+	partial []byte
+	pos     position
+
+	// How often the file is checked for changes
+	interval time.Duration
+}
+
+func (t *tail) run() {
+	defer t.close()
+
+	// Lines already in the file when Tail starts are skipped, unless there
+	// is a position to resume from, but a file that appears later is read
+	// from its start
+	if t.open() {
+		if resume := t.pos.get(); resume == 0 {
+			t.offset, _ = t.file.Seek(0, io.SeekEnd)
+		} else if resume <= t.info.Size() {
+			t.offset, _ = t.file.Seek(resume, io.SeekStart)
+		}
+
+		t.reader.Reset(t.file)
+	}
+
+	for {
+		if t.file == nil && !t.open() {
+			if !t.wait() {
+				return
+			}
+
+			continue
+		}
+
+		line, err := t.reader.ReadBytes('\n')
+		t.offset += int64(len(line))
+
+		if err == nil {
+			if !t.send(append(t.partial, line...)) {
+				return
+			}
+
+			t.partial = nil
+			continue
+		}
+
+		// Keep an incomplete line until the rest of it is written
+		t.partial = append(t.partial, line...)
+
+		if err != io.EOF {
+			if !t.output.send(nil, err) {
+				return
+			}
+		}
+
+		info, err := os.Stat(t.path)
+
+		switch {
+		case err != nil || !os.SameFile(info, t.info):
+			// The file has been rotated. Anything left in the old file
+			// has been read, so move on to the new one
+			if len(t.partial) > 0 && !t.send(t.partial) {
+				return
+			}
+
+			t.close()
+			continue
+
+		case info.Size() < t.offset:
+			// The file has been truncated
+			t.offset, _ = t.file.Seek(0, io.SeekStart)
+			t.reader.Reset(t.file)
+			t.partial = nil
+			continue
+		}
+
+		if !t.wait() {
+			return
+		}
+	}
+}
+
+// open opens the file at path, returning false if it does not exist
+func (t *tail) open() bool {
+	f, err := os.Open(t.path)
+
+	if err != nil {
+		return false
+	}
+
+	info, err := f.Stat()
+
+	if err != nil {
+		f.Close()
+		return false
+	}
+
+	t.file, t.info, t.offset, t.partial = f, info, 0, nil
+	t.reader = bufio.NewReader(f)
+
+	return true
+}
+
+func (t *tail) close() {
+	if t.file != nil {
+		t.file.Close()
+		t.file = nil
+	}
+}
+
+// wait for the next poll, returning false if the stream is closed first
+func (t *tail) wait() bool {
+	select {
+	case <-t.output.done:
+		return false
+	case <-time.After(t.interval):
+		return true
+	}
+}
+
+func (t *tail) send(line []byte) bool {
+	line = bytes.TrimRight(line, "\r\n")
+	ctx := context.WithValue(context.Background(), lineContextKey, Line{t.path, string(line)})
+
+	if !t.output.send(ctx, nil) {
+		return false
+	}
+
+	t.pos.set(t.offset)
+
+	return true
+}
@@ -0,0 +1,219 @@
+package stream
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFromFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "files")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"a.txt", "b.log", "sub/c.txt", "sub/deep/d.txt", "sub/deep/e.log"} {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+
+		if err := ioutil.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out, cls := FromFiles(filepath.Join(dir, "**", "*.txt"), filepath.Join(dir, "*"))
+	defer cls()
+
+	var got []string
+
+	for ctx := range out.Values() {
+		f, _ := FileFromContext(ctx)
+		rel, _ := filepath.Rel(dir, f.Path)
+		got = append(got, filepath.ToSlash(rel))
+
+		if f.Info.Size() != int64(len(filepath.ToSlash(rel))) {
+			t.Errorf("Want size of %s to be %d, got %d", rel, len(rel), f.Info.Size())
+		}
+	}
+
+	if want := "a.txt,sub/c.txt,sub/deep/d.txt,b.log"; strings.Join(got, ",") != want {
+		t.Errorf("Want %s, got %s", want, strings.Join(got, ","))
+	}
+}
+
+func TestFromFilesBadPattern(t *testing.T) {
+	out, cls := FromFiles("[")
+	defer cls()
+
+	if err := <-out.Errors(); err == nil {
+		t.Error("Expected an error for a malformed pattern")
+	}
+}
+
+func TestTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tail")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.log")
+	ioutil.WriteFile(path, []byte("old\n"), 0644)
+
+	out, cls := tailFile(path, nil, "", time.Millisecond)
+	defer cls()
+
+	next := func() string {
+		select {
+		case ctx := <-out.Values():
+			l, _ := LineFromContext(ctx)
+			return l.Text
+		case <-time.After(time.Second):
+			return "timed out"
+		}
+	}
+
+	appendTo := func(text string) {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f.WriteString(text)
+		f.Close()
+	}
+
+	// Give Tail a chance to skip the existing content
+	time.Sleep(time.Millisecond * 20)
+
+	appendTo("one\ntw")
+	appendTo("o\n")
+
+	if got := next(); got != "one" {
+		t.Errorf("Want %s, got %s", "one", got)
+	}
+
+	if got := next(); got != "two" {
+		t.Errorf("Want %s, got %s", "two", got)
+	}
+
+	// Truncation
+	ioutil.WriteFile(path, []byte{}, 0644)
+	time.Sleep(time.Millisecond * 20)
+	appendTo("three\n")
+
+	if got := next(); got != "three" {
+		t.Errorf("Want %s, got %s", "three", got)
+	}
+
+	// Rotation
+	os.Rename(path, path+".1")
+	appendTo("four\n")
+
+	if got := next(); got != "four" {
+		t.Errorf("Want %s, got %s", "four", got)
+	}
+}
+
+func TestFromFilesWithOffsets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "files")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	offsets := memoryOffsets{"files": 1}
+
+	out, cls := FromFilesWithOffsets(offsets, "files", filepath.Join(dir, "*.txt"))
+	defer cls()
+
+	var got []string
+
+	for ctx := range out.Values() {
+		f, _ := FileFromContext(ctx)
+		got = append(got, filepath.Base(f.Path))
+	}
+
+	if want := "b.txt,c.txt"; strings.Join(got, ",") != want {
+		t.Errorf("Want %s, got %s", want, strings.Join(got, ","))
+	}
+
+	if offsets["files"] != 3 {
+		t.Errorf("Want offset %d, got %d", 3, offsets["files"])
+	}
+}
+
+func TestTailWithOffsets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tail")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.log")
+	ioutil.WriteFile(path, []byte("one\ntwo\n"), 0644)
+
+	// The first line was sent before the source was restarted
+	out, cls := tailFile(path, memoryOffsets{"log": 4}, "log", time.Millisecond)
+	defer cls()
+
+	select {
+	case ctx := <-out.Values():
+		if l, _ := LineFromContext(ctx); l.Text != "two" {
+			t.Errorf("Want %s, got %s", "two", l.Text)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for line")
+	}
+}
+
+func TestTailTruncation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tail")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.log")
+	ioutil.WriteFile(path, []byte("a long line that is skipped\n"), 0644)
+
+	out, cls := tailFile(path, nil, "", time.Millisecond)
+	defer cls()
+
+	// Give Tail a chance to skip the existing content
+	time.Sleep(time.Millisecond * 20)
+
+	// Replace the content with something shorter, which is read from the
+	// start of the file
+	ioutil.WriteFile(path, []byte("new\n"), 0644)
+
+	select {
+	case ctx := <-out.Values():
+		if l, _ := LineFromContext(ctx); l.Text != "new" {
+			t.Errorf("Want %s, got %s", "new", l.Text)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for line")
+	}
+}
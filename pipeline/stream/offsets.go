@@ -0,0 +1,30 @@
+package stream
+
+// Offsets stores the positions of named sources, so that a source can resume
+// from where it left off when it is restarted. pipeline.Checkpointer implements
+// Offsets, saving the positions with each checkpoint
+type Offsets interface {
+	Offset(name string) int64
+	SetOffset(name string, n int64)
+}
+
+// position is the position of a single source in Offsets. A source without
+// Offsets starts from the beginning and does not record its position
+type position struct {
+	offsets Offsets
+	name    string
+}
+
+func (p position) get() int64 {
+	if p.offsets == nil {
+		return 0
+	}
+
+	return p.offsets.Offset(p.name)
+}
+
+func (p position) set(n int64) {
+	if p.offsets != nil {
+		p.offsets.SetOffset(p.name, n)
+	}
+}
@@ -0,0 +1,54 @@
+package stream
+
+import (
+	"bufio"
+	"io"
+)
+
+// FromReader creates a stream of the tokens read from r, wrapping each token in a
+// Context created by box. Tokens are passed to box as strings. The input is
+// split in to tokens by split, or in to lines if split is nil. Tokens are read
+// lazily as the stream is consumed, so r is never read in full. A read error is
+// sent on the error stream, after which the stream is closed. The stream is
+// closed once r has been read
+func FromReader(r io.Reader, split bufio.SplitFunc, box ContextFunc) (Stream, CloseFunc) {
+	return FromReaderWithOffsets(r, split, box, nil, "")
+}
+
+// FromReaderWithOffsets creates a stream in the same way as FromReader, recording
+// the number of tokens sent in offsets under name. If offsets already holds a
+// position for name, that many tokens are skipped before any are sent, so that
+// a restarted source carries on from where it left off
+func FromReaderWithOffsets(r io.Reader, split bufio.SplitFunc, box ContextFunc, offsets Offsets, name string) (Stream, CloseFunc) {
+	output, closeOutput := newSource()
+	pos := position{offsets, name}
+	scanner := bufio.NewScanner(r)
+
+	if split != nil {
+		scanner.Split(split)
+	}
+
+	go func() {
+		defer closeOutput()
+
+		skip := pos.get()
+
+		for n := int64(1); scanner.Scan(); n++ {
+			if n <= skip {
+				continue
+			}
+
+			if !output.send(box(scanner.Text()), nil) {
+				return
+			}
+
+			pos.set(n)
+		}
+
+		if err := scanner.Err(); err != nil {
+			output.send(nil, err)
+		}
+	}()
+
+	return output, closeOutput
+}
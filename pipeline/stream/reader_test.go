@@ -0,0 +1,120 @@
+package stream
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+type stringKey int
+
+const tokenKey stringKey = 0
+
+func boxString(value interface{}) context.Context {
+	return context.WithValue(context.Background(), tokenKey, value.(string))
+}
+
+func TestFromReader(t *testing.T) {
+	out, cls := FromReader(strings.NewReader("one\ntwo\nthree\n"), nil, boxString)
+	defer cls()
+
+	var got []string
+
+	for ctx := range out.Values() {
+		got = append(got, ctx.Value(tokenKey).(string))
+	}
+
+	if strings.Join(got, ",") != "one,two,three" {
+		t.Errorf("Want %s, got %v", "[one two three]", got)
+	}
+}
+
+func TestFromReaderSplit(t *testing.T) {
+	out, cls := FromReader(strings.NewReader("one two  three"), bufio.ScanWords, boxString)
+	defer cls()
+
+	count := 0
+
+	for range out.Values() {
+		count++
+	}
+
+	if count != 3 {
+		t.Errorf("Want %d, got %d", 3, count)
+	}
+}
+
+func TestFromReaderIsLazy(t *testing.T) {
+	r, w := io.Pipe()
+	out, cls := FromReader(r, nil, boxString)
+	defer cls()
+
+	go w.Write([]byte("one\n"))
+
+	if got := (<-out.Values()).Value(tokenKey); got != "one" {
+		t.Errorf("Want %s, got %v", "one", got)
+	}
+
+	w.Close()
+}
+
+func TestFromReaderError(t *testing.T) {
+	r, w := io.Pipe()
+	out, cls := FromReader(r, nil, boxString)
+	defer cls()
+
+	go func() {
+		w.Write([]byte("one\n"))
+		w.CloseWithError(errors.New("Broken"))
+	}()
+
+	<-out.Values()
+
+	if err := <-out.Errors(); err == nil || err.Error() != "Broken" {
+		t.Errorf("Want error %s, got %v", "Broken", err)
+	}
+
+	if _, ok := <-out.Values(); ok {
+		t.Error("Expected stream to be closed after error")
+	}
+}
+
+// memoryOffsets is an Offsets held in memory
+type memoryOffsets map[string]int64
+
+func (o memoryOffsets) Offset(name string) int64       { return o[name] }
+func (o memoryOffsets) SetOffset(name string, n int64) { o[name] = n }
+
+func TestFromReaderWithOffsets(t *testing.T) {
+	offsets := memoryOffsets{}
+
+	read := func(input string) []string {
+		out, cls := FromReaderWithOffsets(strings.NewReader(input), nil, boxString, offsets, "input")
+		defer cls()
+
+		var got []string
+
+		for ctx := range out.Values() {
+			got = append(got, ctx.Value(tokenKey).(string))
+		}
+
+		return got
+	}
+
+	if got := read("one\ntwo\n"); strings.Join(got, ",") != "one,two" {
+		t.Errorf("Want %s, got %v", "[one two]", got)
+	}
+
+	// Restart the source once more input is available
+	if got := read("one\ntwo\nthree\nfour\n"); strings.Join(got, ",") != "three,four" {
+		t.Errorf("Want %s, got %v", "[three four]", got)
+	}
+
+	if offsets["input"] != 4 {
+		t.Errorf("Want offset %d, got %d", 4, offsets["input"])
+	}
+}
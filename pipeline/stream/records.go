@@ -0,0 +1,206 @@
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"golang.org/x/net/context"
+)
+
+// RecordError is sent on the error stream of a record source when a record can
+// not be decoded. The source carries on with the next record
+type RecordError struct {
+	// Line on which the malformed record was found, starting from 1
+	Line int
+	Err  error
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("Line %d: %s", e.Line, e.Err.Error())
+}
+
+// FromJSONLines creates a stream of the JSON values read from r, which holds one
+// value per line. Each line is decoded in to the value returned by newValue,
+// which is then wrapped in a Context created by box. Blank lines are skipped.
+// Lines that can not be decoded are sent on the error stream as a RecordError.
+// A read error is sent on the error stream, after which the stream is closed
+func FromJSONLines(r io.Reader, newValue func() interface{}, box ContextFunc) (Stream, CloseFunc) {
+	return FromJSONLinesWithOffsets(r, newValue, box, nil, "")
+}
+
+// FromJSONLinesWithOffsets creates a stream in the same way as FromJSONLines,
+// recording the number of lines read in offsets under name. If offsets already
+// holds a position for name, that many lines are skipped before any are decoded,
+// so that a restarted source carries on from where it left off
+func FromJSONLinesWithOffsets(r io.Reader, newValue func() interface{}, box ContextFunc, offsets Offsets, name string) (Stream, CloseFunc) {
+	output, closeOutput := newSource()
+	reader := bufio.NewReader(r)
+	pos := position{offsets, name}
+
+	go func() {
+		defer closeOutput()
+
+		skip := pos.get()
+
+		for line := 1; ; line++ {
+			data, err := reader.ReadBytes('\n')
+
+			if int64(line) > skip && len(bytes.TrimSpace(data)) > 0 {
+				v := newValue()
+
+				if err := json.Unmarshal(data, v); err != nil {
+					if !output.send(nil, &RecordError{line, err}) {
+						return
+					}
+				} else if !output.send(box(v), nil) {
+					return
+				}
+			}
+
+			if int64(line) > skip && len(data) > 0 {
+				pos.set(int64(line))
+			}
+
+			if err == io.EOF {
+				return
+			}
+
+			if err != nil {
+				output.send(nil, err)
+				return
+			}
+		}
+	}()
+
+	return output, closeOutput
+}
+
+// CSVOptions configures FromCSV
+type CSVOptions struct {
+	// Field delimiter. Defaults to a comma
+	Comma rune
+
+	// Lines beginning with Comment are skipped. Zero disables comments
+	Comment rune
+
+	// If Header is true, the first record holds the names of the fields, and
+	// each following record is passed to box as a map[string]string of field
+	// names to values. Otherwise records are passed as a []string
+	Header bool
+
+	// Allow quotes to appear in unquoted fields, and unescaped quotes in
+	// quoted fields
+	LazyQuotes bool
+}
+
+// FromCSV creates a stream of the records read from r, wrapping each record in a
+// Context created by box. Records that can not be parsed, or that have a
+// different number of fields to the first record, are sent on the error stream
+// as a RecordError. A read error is sent on the error stream, after which the
+// stream is closed
+func FromCSV(r io.Reader, opts CSVOptions, box ContextFunc) (Stream, CloseFunc) {
+	output, closeOutput := newSource()
+	reader := csv.NewReader(r)
+	reader.Comment = opts.Comment
+	reader.LazyQuotes = opts.LazyQuotes
+
+	if opts.Comma != 0 {
+		reader.Comma = opts.Comma
+	}
+
+	go func() {
+		defer closeOutput()
+
+		var header []string
+
+		for {
+			record, err := reader.Read()
+
+			if err == io.EOF {
+				return
+			}
+
+			if pe, ok := err.(*csv.ParseError); ok {
+				if !output.send(nil, &RecordError{pe.Line, pe.Err}) {
+					return
+				}
+
+				continue
+			}
+
+			if err != nil {
+				output.send(nil, err)
+				return
+			}
+
+			var value interface{} = record
+
+			if opts.Header {
+				if header == nil {
+					header = record
+					continue
+				}
+
+				fields := make(map[string]string, len(header))
+
+				for i, name := range header {
+					fields[name] = record[i]
+				}
+
+				value = fields
+			}
+
+			if !output.send(box(value), nil) {
+				return
+			}
+		}
+	}()
+
+	return output, closeOutput
+}
+
+// newSource creates a stream for a source that sends both values and errors
+func newSource() (*stream, CloseFunc) {
+	s := &stream{
+		values: make(chan context.Context),
+		errors: make(chan error),
+		done:   make(chan struct{}),
+	}
+
+	return s, closeStream(s)
+}
+
+// send sends either a value or an error on the stream, returning false if the
+// stream was closed first. Values whose context is already done are dropped
+func (s *stream) send(ctx context.Context, err error) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.channelsClosed {
+		return false
+	}
+
+	if err != nil {
+		select {
+		case <-s.done:
+			return false
+		case s.errors <- err:
+			return true
+		}
+	}
+
+	if ctx.Err() != nil {
+		return true
+	}
+
+	select {
+	case <-s.done:
+		return false
+	case s.values <- ctx:
+		return true
+	}
+}
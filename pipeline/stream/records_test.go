@@ -0,0 +1,128 @@
+package stream
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+type recordKey int
+
+const valueKey recordKey = 0
+
+func boxValue(value interface{}) context.Context {
+	return context.WithValue(context.Background(), valueKey, value)
+}
+
+// collect returns the values and errors sent by a source
+func collect(out Stream) ([]interface{}, []error) {
+	var (
+		values []interface{}
+		errs   []error
+		done   = make(chan struct{})
+	)
+
+	go func() {
+		defer close(done)
+		for err := range out.Errors() {
+			errs = append(errs, err)
+		}
+	}()
+
+	for ctx := range out.Values() {
+		values = append(values, ctx.Value(valueKey))
+	}
+
+	<-done
+
+	return values, errs
+}
+
+type person struct {
+	Name string
+	Age  int
+}
+
+func TestFromJSONLines(t *testing.T) {
+	input := `{"Name": "Ann", "Age": 30}
+
+{"Name": "Bob", "Age": "old"}
+{"Name": "Cat", "Age": 40}`
+
+	out, cls := FromJSONLines(strings.NewReader(input), func() interface{} { return &person{} }, boxValue)
+	defer cls()
+
+	values, errs := collect(out)
+
+	if len(values) != 2 || values[0].(*person).Name != "Ann" || values[1].(*person).Age != 40 {
+		t.Errorf("Want Ann and Cat, got %v", values)
+	}
+
+	if len(errs) != 1 {
+		t.Fatalf("Want %d error, got %v", 1, errs)
+	}
+
+	if re, ok := errs[0].(*RecordError); !ok || re.Line != 3 {
+		t.Errorf("Want a RecordError on line %d, got %v", 3, errs[0])
+	}
+}
+
+func TestFromCSV(t *testing.T) {
+	input := "name;age\nAnn;30\nBob\n# comment\nCat;40\n"
+
+	out, cls := FromCSV(strings.NewReader(input), CSVOptions{Comma: ';', Comment: '#', Header: true}, boxValue)
+	defer cls()
+
+	values, errs := collect(out)
+
+	if want := fmt.Sprint([]interface{}{
+		map[string]string{"name": "Ann", "age": "30"},
+		map[string]string{"name": "Cat", "age": "40"},
+	}); fmt.Sprint(values) != want {
+		t.Errorf("Want %s, got %v", want, values)
+	}
+
+	if len(errs) != 1 {
+		t.Fatalf("Want %d error, got %v", 1, errs)
+	}
+
+	if re, ok := errs[0].(*RecordError); !ok || re.Line != 3 {
+		t.Errorf("Want a RecordError on line %d, got %v", 3, errs[0])
+	}
+}
+
+func TestFromCSVWithoutHeader(t *testing.T) {
+	out, cls := FromCSV(strings.NewReader("a,\"b,c\"\n"), CSVOptions{}, boxValue)
+	defer cls()
+
+	values, _ := collect(out)
+
+	if want := fmt.Sprint([]interface{}{[]string{"a", "b,c"}}); fmt.Sprint(values) != want {
+		t.Errorf("Want %s, got %v", want, values)
+	}
+}
+
+func TestFromJSONLinesWithOffsets(t *testing.T) {
+	input := `{"Name": "Ann", "Age": 30}
+
+{"Name": "Bob", "Age": 20}
+{"Name": "Cat", "Age": 40}`
+
+	// Ann and the blank line have been read
+	offsets := memoryOffsets{"people": 2}
+
+	out, cls := FromJSONLinesWithOffsets(strings.NewReader(input), func() interface{} { return &person{} }, boxValue, offsets, "people")
+	defer cls()
+
+	values, _ := collect(out)
+
+	if len(values) != 2 || values[0].(*person).Name != "Bob" || values[1].(*person).Name != "Cat" {
+		t.Errorf("Want Bob and Cat, got %v", values)
+	}
+
+	if offsets["people"] != 4 {
+		t.Errorf("Want offset %d, got %d", 4, offsets["people"])
+	}
+}
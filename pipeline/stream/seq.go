@@ -0,0 +1,47 @@
+//go:build go1.23
+
+package stream
+
+import (
+	"iter"
+
+	"golang.org/x/net/context"
+)
+
+// FromSeq creates a stream of the values yielded by seq, wrapping each value in a
+// Context created by box. Values are pulled from seq lazily as the stream is
+// consumed. If the stream is closed, seq is stopped. The stream is closed once
+// seq is exhausted
+func FromSeq[V any](seq iter.Seq[V], box func(V) context.Context) (Stream, CloseFunc) {
+	output, closeOutput := newSource()
+
+	go func() {
+		defer closeOutput()
+
+		for v := range seq {
+			if !output.send(box(v), nil) {
+				return
+			}
+		}
+	}()
+
+	return output, closeOutput
+}
+
+// FromSeq2 creates a stream of the pairs of values yielded by seq, wrapping each
+// pair in a Context created by box. See FromSeq
+func FromSeq2[K, V any](seq iter.Seq2[K, V], box func(K, V) context.Context) (Stream, CloseFunc) {
+	output, closeOutput := newSource()
+
+	go func() {
+		defer closeOutput()
+
+		for k, v := range seq {
+			if !output.send(box(k, v), nil) {
+				return
+			}
+		}
+	}()
+
+	return output, closeOutput
+}
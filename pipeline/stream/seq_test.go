@@ -0,0 +1,68 @@
+//go:build go1.23
+
+package stream
+
+import (
+	"slices"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestFromSeq(t *testing.T) {
+	out, cls := FromSeq(slices.Values([]int{1, 2, 3}), func(x int) context.Context {
+		return NewContext(context.Background(), x)
+	})
+
+	defer cls()
+
+	var got []int
+
+	for ctx := range out.Values() {
+		got = append(got, FromContext(ctx))
+	}
+
+	if !slices.Equal(got, []int{1, 2, 3}) {
+		t.Errorf("Want %v, got %v", []int{1, 2, 3}, got)
+	}
+}
+
+func TestFromSeq2(t *testing.T) {
+	out, cls := FromSeq2(slices.All([]int{10, 20}), func(i, x int) context.Context {
+		return NewContext(context.Background(), i+x)
+	})
+
+	defer cls()
+
+	var got []int
+
+	for ctx := range out.Values() {
+		got = append(got, FromContext(ctx))
+	}
+
+	if !slices.Equal(got, []int{10, 21}) {
+		t.Errorf("Want %v, got %v", []int{10, 21}, got)
+	}
+}
+
+func TestFromSeqStopsWhenClosed(t *testing.T) {
+	stopped := make(chan struct{})
+
+	naturals := func(yield func(int) bool) {
+		defer close(stopped)
+
+		for i := 0; ; i++ {
+			if !yield(i) {
+				return
+			}
+		}
+	}
+
+	out, cls := FromSeq(naturals, func(x int) context.Context {
+		return NewContext(context.Background(), x)
+	})
+
+	<-out.Values()
+	cls()
+	<-stopped
+}
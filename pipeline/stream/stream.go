@@ -4,6 +4,8 @@
 package stream
 
 import (
+	"sync"
+
 	"golang.org/x/net/context"
 )
 
@@ -40,7 +42,19 @@ type stream struct {
 	values chan context.Context
 	errors chan error
 	done   chan struct{}
-	closed bool
+	closed sync.Once
+
+	// parent, forwarded and abandon are set on streams created by
+	// (*stream).WithValues, and coordinate forwarding errors from the parent
+	// with closing this stream
+	parent    *stream
+	forwarded chan struct{}
+	abandon   chan struct{}
+
+	// mu is held while sending from within this package, so that the
+	// channels are not closed part way through a send
+	mu             sync.Mutex
+	channelsClosed bool
 }
 
 // New creates an initialized Stream
@@ -87,31 +101,66 @@ func (s *stream) Done() <-chan struct{} {
 // Stream s will be forwarded to the new stream
 func (s *stream) WithValues(values chan context.Context) (Stream, CloseFunc) {
 	newStream := &stream{
-		values: values,
-		errors: make(chan error),
-		done:   make(chan struct{}),
+		values:    values,
+		errors:    make(chan error),
+		done:      make(chan struct{}),
+		parent:    s,
+		forwarded: make(chan struct{}),
+		abandon:   make(chan struct{}),
 	}
 
 	go func() {
+		defer close(newStream.forwarded)
 		for err := range s.Errors() {
-			newStream.errors <- err
+			newStream.forward(err)
 		}
 	}()
 
 	return newStream, closeStream(newStream)
 }
 
+// forward sends an error from the parent stream, unless this stream has been
+// closed without waiting for its parent
+func (s *stream) forward(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.channelsClosed {
+		return
+	}
+
+	select {
+	case s.errors <- err:
+	case <-s.abandon:
+	}
+}
+
 func closeStream(s *stream) CloseFunc {
 	return func() {
-		if !s.closed {
+		s.closed.Do(func() {
 			go func() {
 				<-s.done
+
+				if s.parent != nil {
+					select {
+					case <-s.parent.done:
+						// The parent is closing too, so deliver the rest of its
+						// errors before closing ours
+						<-s.forwarded
+					default:
+						// Closed early, for instance by Take, so stop forwarding
+						close(s.abandon)
+					}
+				}
+
+				s.mu.Lock()
+				s.channelsClosed = true
 				close(s.errors)
 				close(s.values)
+				s.mu.Unlock()
 			}()
 
 			close(s.done)
-			s.closed = true
-		}
+		})
 	}
 }
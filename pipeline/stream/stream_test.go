@@ -63,3 +63,68 @@ func TestStreamWithValuesDoesNotForwardValues(t *testing.T) {
 		}
 	}
 }
+
+func TestStreamWithValuesClosedEarly(t *testing.T) {
+	var (
+		s1, cls1 = New()
+		s2, cls2 = s1.WithValues(make(chan context.Context))
+		sent     = make(chan struct{})
+	)
+
+	defer cls1()
+
+	// Errors sent on s1 after s2 is closed are not sent on the closed stream
+	cls2()
+
+	go func() {
+		s1.Error(fmt.Errorf("foo"))
+		close(sent)
+	}()
+
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out sending error")
+	}
+
+	// s2 is not read from, but its errors are still closed
+	for range s2.Errors() {
+	}
+
+	if _, ok := <-s2.Values(); ok {
+		t.Error("Want values of s2 closed")
+	}
+}
+
+func TestStreamWithValuesClosedWithParent(t *testing.T) {
+	var (
+		s1, cls1 = New()
+		s2, cls2 = s1.WithValues(make(chan context.Context))
+		errs     = make(chan []string)
+	)
+
+	// The error is taken from s1 but not yet read from s2 when both are
+	// closed, and is delivered before the errors of s2 are closed
+	s1.Error(fmt.Errorf("foo"))
+	cls1()
+	cls2()
+
+	go func() {
+		var got []string
+
+		for err := range s2.Errors() {
+			got = append(got, err.Error())
+		}
+
+		errs <- got
+	}()
+
+	select {
+	case got := <-errs:
+		if fmt.Sprint(got) != "[foo]" {
+			t.Errorf("Want [foo], got %v", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out")
+	}
+}
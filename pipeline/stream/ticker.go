@@ -0,0 +1,68 @@
+package stream
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+type tickKey int
+
+const tickContextKey tickKey = 0
+
+// TickFromContext retrieves the time of a tick from a context created by
+// Interval, Timer or Cron
+func TickFromContext(ctx context.Context) (time.Time, bool) {
+	t, ok := ctx.Value(tickContextKey).(time.Time)
+	return t, ok
+}
+
+func newTick(t time.Time) context.Context {
+	return context.WithValue(context.Background(), tickContextKey, t)
+}
+
+// Interval creates a stream that sends a value every d until the stream is
+// closed. Ticks are dropped if the stream is not read quickly enough to keep up
+func Interval(d time.Duration) (Stream, CloseFunc) {
+	output, closeOutput := newSource()
+
+	go func() {
+		defer closeOutput()
+
+		ticker := time.NewTicker(d)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-output.done:
+				return
+			case t := <-ticker.C:
+				if !output.send(newTick(t), nil) {
+					return
+				}
+			}
+		}
+	}()
+
+	return output, closeOutput
+}
+
+// Timer creates a stream that sends a single value after d, and is then closed
+func Timer(d time.Duration) (Stream, CloseFunc) {
+	output, closeOutput := newSource()
+
+	go func() {
+		defer closeOutput()
+
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+
+		select {
+		case <-output.done:
+		case t := <-timer.C:
+			output.send(newTick(t), nil)
+		}
+	}()
+
+	return output, closeOutput
+}
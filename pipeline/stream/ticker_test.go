@@ -0,0 +1,47 @@
+package stream
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInterval(t *testing.T) {
+	out, cls := Interval(time.Millisecond)
+
+	var last time.Time
+
+	for i := 0; i < 3; i++ {
+		tick, ok := TickFromContext(<-out.Values())
+
+		if !ok || !tick.After(last) {
+			t.Errorf("Want a tick after %s, got %s", last, tick)
+		}
+
+		last = tick
+	}
+
+	cls()
+
+	for range out.Values() {
+	}
+}
+
+func TestTimer(t *testing.T) {
+	start := time.Now()
+	out, cls := Timer(time.Millisecond * 10)
+	defer cls()
+
+	count := 0
+
+	for ctx := range out.Values() {
+		if tick, _ := TickFromContext(ctx); tick.Sub(start) < time.Millisecond*10 {
+			t.Errorf("Want tick at least %s after start, got %s", time.Millisecond*10, tick.Sub(start))
+		}
+
+		count++
+	}
+
+	if count != 1 {
+		t.Errorf("Want %d tick, got %d", 1, count)
+	}
+}
@@ -0,0 +1,264 @@
+package pipeline
+
+import (
+	"sync"
+
+	"github.com/bernos/go-pipeline/pipeline/stream"
+	"golang.org/x/net/context"
+)
+
+// Swappable is a handle to a map stage whose Mapper and number of workers can be
+// changed while the pipeline is running. Values that are being mapped when the
+// Mapper is swapped finish with the old Mapper, and values that follow use the
+// new one. Workers removed by SetWorkers finish the value they are mapping
+// before they stop, so no work is dropped
+type Swappable struct {
+	mu        sync.Mutex
+	mapper    Mapper
+	version   int
+	workers   int
+	instances map[*swapInstance]bool
+	stage     Pipeline
+}
+
+// NewSwappable creates a Swappable that maps values with m, using n workers
+func NewSwappable(m Mapper, n int) *Swappable {
+	if n < 1 {
+		n = 1
+	}
+
+	s := &Swappable{
+		mapper:    m,
+		workers:   n,
+		instances: make(map[*swapInstance]bool),
+	}
+
+	s.stage = newStage("Swappable", n, nil, func(st *stage, in stream.Stream) stream.Stream {
+		out, cls := in.WithValues(make(chan context.Context))
+
+		i := &swapInstance{
+			swappable: s,
+			stage:     st,
+			in:        in,
+			out:       out,
+			cls:       cls,
+		}
+
+		s.mu.Lock()
+		s.instances[i] = true
+		i.resize(s.workers)
+		s.mu.Unlock()
+
+		return out
+	})
+
+	return s
+}
+
+// Pipeline returns the map stage. The same stage may be used in several
+// pipelines, or run several times, and every instance of it is changed by
+// SwapMapper and SetWorkers
+func (s *Swappable) Pipeline() Pipeline {
+	return s.stage
+}
+
+// Mapper returns the current Mapper
+func (s *Swappable) Mapper() Mapper {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.mapper
+}
+
+// SwapMapper replaces the Mapper used by the stage
+func (s *Swappable) SwapMapper(m Mapper) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.mapper = m
+	s.version++
+}
+
+// Workers returns the number of workers used by each instance of the stage
+func (s *Swappable) Workers() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.workers
+}
+
+// SetWorkers changes the number of workers used by each instance of the stage.
+// There is always at least one worker
+func (s *Swappable) SetWorkers(n int) {
+	if n < 1 {
+		n = 1
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.workers = n
+
+	for i := range s.instances {
+		i.resize(n)
+	}
+}
+
+// current returns the Mapper along with its version. Versions change each time
+// the Mapper is swapped, so workers know when to apply middleware again
+func (s *Swappable) current() (Mapper, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.mapper, s.version
+}
+
+// swapInstance is a running instance of a Swappable stage. Its fields are
+// guarded by the lock of its Swappable
+type swapInstance struct {
+	swappable *Swappable
+	stage     *stage
+	in        stream.Stream
+	out       stream.Stream
+	cls       stream.CloseFunc
+
+	// Quit channels of the workers that have not been asked to stop
+	quits []chan struct{}
+
+	// Number of workers started so far, and the number still running,
+	// including any finishing a value after being asked to stop
+	started int
+	running int
+
+	// Set once the input stream is closed, after which no workers are
+	// started
+	closed bool
+}
+
+// resize starts or stops workers so that n are running. It is called with the
+// lock held
+func (i *swapInstance) resize(n int) {
+	if i.closed {
+		return
+	}
+
+	for len(i.quits) < n {
+		quit := make(chan struct{})
+		i.quits = append(i.quits, quit)
+		go i.work(i.stage.info(i.started), quit)
+		i.started++
+		i.running++
+	}
+
+	for len(i.quits) > n {
+		last := len(i.quits) - 1
+		close(i.quits[last])
+		i.quits = i.quits[:last]
+	}
+}
+
+func (i *swapInstance) work(info StageInfo, quit chan struct{}) {
+	var (
+		mapper  Mapper
+		version = -1
+	)
+
+	for {
+		// A select picks at random between ready cases, so check quit on
+		// its own first, so that a removed worker stops taking values
+		select {
+		case <-quit:
+			i.exit(quit, false)
+			return
+		default:
+		}
+
+		select {
+		case <-quit:
+			i.exit(quit, false)
+			return
+
+		case ctx, ok := <-i.in.Values():
+			if !ok {
+				i.exit(quit, true)
+				return
+			}
+
+			if m, v := i.swappable.current(); v != version {
+				mapper, version = i.stage.wrapMapper(info, m), v
+			}
+
+			ctx, a := begin(ctx, info)
+			value, err := mapper.Map(ctx)
+			a.processed(err)
+
+			if err == nil {
+				i.out.Value(inheritAck(ctx, value))
+			} else {
+				Nack(ctx, err)
+				i.out.Error(err)
+			}
+
+			a.end()
+		}
+	}
+}
+
+// exit is called by a worker as it stops. The output stream is closed once the
+// input stream is closed and the last worker has stopped
+func (i *swapInstance) exit(quit chan struct{}, closed bool) {
+	s := i.swappable
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i.running--
+
+	if closed {
+		i.closed = true
+	}
+
+	for j, q := range i.quits {
+		if q == quit {
+			i.quits = append(i.quits[:j], i.quits[j+1:]...)
+			break
+		}
+	}
+
+	if i.closed && i.running == 0 {
+		delete(s.instances, i)
+		i.cls()
+	}
+}
+
+// SwappablePredicate is a Predicate that can be replaced while a pipeline is
+// running
+type SwappablePredicate struct {
+	mu sync.RWMutex
+	p  Predicate
+}
+
+// NewSwappablePredicate creates a SwappablePredicate that tests values with p
+func NewSwappablePredicate(p Predicate) *SwappablePredicate {
+	return &SwappablePredicate{p: p}
+}
+
+// Swap replaces the Predicate
+func (s *SwappablePredicate) Swap(p Predicate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.p = p
+}
+
+// Predicate returns a Predicate, for use with Filter, that tests each value with
+// the current Predicate
+func (s *SwappablePredicate) Predicate() Predicate {
+	return func(ctx context.Context) bool {
+		s.mu.RLock()
+		p := s.p
+		s.mu.RUnlock()
+
+		return p(ctx)
+	}
+}
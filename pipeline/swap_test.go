@@ -0,0 +1,187 @@
+package pipeline
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bernos/go-pipeline/pipeline/stream"
+	"golang.org/x/net/context"
+)
+
+func TestSwappableSwapMapper(t *testing.T) {
+	var (
+		started = make(chan struct{})
+		release = make(chan struct{})
+		s       = NewSwappable(IntMapper(func(x int) int {
+			started <- struct{}{}
+			<-release
+			return x * 2
+		}), 1)
+		in, cls = stream.New()
+		out     = s.Pipeline()(in)
+	)
+
+	go in.Value(NewContext(context.Background(), 1))
+	<-started
+
+	// The value being mapped finishes with the old mapper
+	s.SwapMapper(IntMapper(func(x int) int { return x * 10 }))
+	close(release)
+
+	if got := FromContext(<-out.Values()); got != 2 {
+		t.Errorf("Want in-flight value mapped by the old mapper to 2, got %d", got)
+	}
+
+	go in.Value(NewContext(context.Background(), 1))
+
+	if got := FromContext(<-out.Values()); got != 10 {
+		t.Errorf("Want value mapped by the new mapper to 10, got %d", got)
+	}
+
+	cls()
+
+	if _, ok := <-out.Values(); ok {
+		t.Error("Want output to close")
+	}
+}
+
+func TestSwappableSetWorkers(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		current int
+		max     int
+	)
+
+	s := NewSwappable(IntMapper(func(x int) int {
+		mu.Lock()
+		current++
+		if current > max {
+			max = current
+		}
+		mu.Unlock()
+
+		time.Sleep(time.Millisecond * 5)
+
+		mu.Lock()
+		current--
+		mu.Unlock()
+
+		return x
+	}), 1)
+
+	run := func(n int) []context.Context {
+		input := make([]context.Context, n)
+
+		for i := range input {
+			input[i] = NewContext(context.Background(), i)
+		}
+
+		values, _ := runPipeline(s.Pipeline(), input)
+
+		return values
+	}
+
+	if got := len(run(10)); got != 10 || max != 1 {
+		t.Errorf("Want 10 values with 1 worker, got %d with %d", got, max)
+	}
+
+	s.SetWorkers(4)
+
+	if got := len(run(20)); got != 20 || max != 4 {
+		t.Errorf("Want 20 values with 4 workers, got %d with %d", got, max)
+	}
+
+	// Resize while running, making sure no values are dropped
+	var (
+		wg     sync.WaitGroup
+		values []context.Context
+	)
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+		values = run(50)
+	}()
+
+	for _, n := range []int{1, 3, 2, 5, 1} {
+		time.Sleep(time.Millisecond * 10)
+		s.SetWorkers(n)
+	}
+
+	wg.Wait()
+
+	if len(values) != 50 || s.Workers() != 1 {
+		t.Errorf("Want 50 values and 1 worker, got %d and %d", len(values), s.Workers())
+	}
+}
+
+func TestSwappableRemovedWorkersStop(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		current int
+		max     int
+	)
+
+	s := NewSwappable(IntMapper(func(x int) int {
+		mu.Lock()
+		current++
+		if current > max {
+			max = current
+		}
+		mu.Unlock()
+
+		time.Sleep(time.Millisecond * 5)
+
+		mu.Lock()
+		current--
+		mu.Unlock()
+
+		return x
+	}), 4)
+
+	input := make([]context.Context, 100)
+
+	for i := range input {
+		input[i] = NewContext(context.Background(), i)
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		runPipeline(s.Pipeline(), input)
+	}()
+
+	// Values are always waiting, so removed workers must not take another
+	// once they finish the one they are processing
+	time.Sleep(time.Millisecond * 20)
+	s.SetWorkers(1)
+	time.Sleep(time.Millisecond * 8)
+
+	mu.Lock()
+	max = 0
+	mu.Unlock()
+
+	<-done
+
+	if max != 1 {
+		t.Errorf("Want 1 worker once resized, got %d", max)
+	}
+}
+
+func TestSwappablePredicate(t *testing.T) {
+	sp := NewSwappablePredicate(func(ctx context.Context) bool { return true })
+	p := sp.Predicate()
+
+	if !p(context.Background()) {
+		t.Error("Want value to pass")
+	}
+
+	sp.Swap(func(ctx context.Context) bool { return false })
+
+	if p(context.Background()) {
+		t.Error("Want value to be filtered by the new predicate")
+	}
+}
@@ -8,7 +8,7 @@ import (
 // Take creates a pipeline that returns at most n items from the input stream,
 // and ignores all further values
 func Take(n int) Pipeline {
-	return func(in stream.Stream) stream.Stream {
+	return newStage("Take", 1, nil, func(s *stage, in stream.Stream) stream.Stream {
 		var (
 			out, cls = in.WithValues(make(chan context.Context))
 		)
@@ -29,14 +29,14 @@ func Take(n int) Pipeline {
 		}()
 
 		return out
-	}
+	})
 }
 
 // TakeUntil creates a pipeline that will forward values from its input stream
 // to its output stream up until a value from the input stream satisfies the
 // predicate
 func TakeUntil(predicate Predicate) Pipeline {
-	return func(in stream.Stream) stream.Stream {
+	return newStage("TakeUntil", 1, nil, func(s *stage, in stream.Stream) stream.Stream {
 		var (
 			out, cls = in.WithValues(make(chan context.Context))
 		)
@@ -44,23 +44,34 @@ func TakeUntil(predicate Predicate) Pipeline {
 		go func() {
 			defer cls()
 
+			info := s.info(0)
+			predicate := s.wrapPredicate(info, predicate)
+
 			for value := range in.Values() {
-				if predicate(value) {
+				value, a := begin(value, info)
+				ok := predicate(value)
+				a.processed(nil)
+
+				if ok {
+					a.handOff(0)
+					a.end()
 					return
 				} else {
 					out.Value(value)
 				}
+
+				a.end()
 			}
 		}()
 
 		return out
-	}
+	})
 }
 
 // TakeWhile creates a pipeline that will forward values from its input stream
 // to its output stream until a value that doesnt satify the predicate is found
 func TakeWhile(predicate Predicate) Pipeline {
-	return func(in stream.Stream) stream.Stream {
+	return newStage("TakeWhile", 1, nil, func(s *stage, in stream.Stream) stream.Stream {
 		var (
 			out, cls = in.WithValues(make(chan context.Context))
 		)
@@ -68,15 +79,26 @@ func TakeWhile(predicate Predicate) Pipeline {
 		go func() {
 			defer cls()
 
+			info := s.info(0)
+			predicate := s.wrapPredicate(info, predicate)
+
 			for value := range in.Values() {
-				if predicate(value) {
+				value, a := begin(value, info)
+				ok := predicate(value)
+				a.processed(nil)
+
+				if ok {
 					out.Value(value)
 				} else {
+					a.handOff(0)
+					a.end()
 					return
 				}
+
+				a.end()
 			}
 		}()
 
 		return out
-	}
+	})
 }
@@ -8,25 +8,44 @@ import (
 
 // Tee splits a pipeline in two. Inputs are sent to the secondary pipeline, as well as forwarded
 // on to the next stage in the main pipeline. Forwarding to the secondary pipeline happens in its
-// own go routine, so that the main pipeline is not blocked. The output of the secondary pipeline
-// is effectively swallowed
+// own go routine, so that the main pipeline is not blocked. Values output by the secondary
+// pipeline are swallowed, but its errors are sent on the output stream. Once the input stream
+// is closed, the output stream is closed after the secondary pipeline has finished
 func Tee(pipeline Pipeline) Pipeline {
-	return func(in stream.Stream) stream.Stream {
+	return newStage("Tee", 1, pipeline, func(s *stage, in stream.Stream) stream.Stream {
 		var (
 			wg                          sync.WaitGroup
+			secondary                   sync.WaitGroup
 			out, closeOut               = stream.New()
 			pipelineIn, closePipelineIn = in.WithValues(make(chan context.Context))
 		)
 
 		go func() {
-			pipeline(pipelineIn)
+			pipelineOut := pipeline(pipelineIn)
+
+			secondary.Add(2)
+
+			go func() {
+				defer secondary.Done()
+				for _ = range pipelineOut.Values() {
+				}
+			}()
+
+			go func() {
+				defer secondary.Done()
+				for err := range pipelineOut.Errors() {
+					out.Error(err)
+				}
+			}()
 
 			defer func() {
 				closePipelineIn()
+				secondary.Wait()
 				closeOut()
 			}()
 
 			for ctx := range in.Values() {
+				handOff(ctx, 1)
 				wg.Add(1)
 
 				go func(ctx context.Context) {
@@ -41,5 +60,5 @@ func Tee(pipeline Pipeline) Pipeline {
 		}()
 
 		return out
-	}
+	})
 }
@@ -0,0 +1,147 @@
+package pipeline
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+type tracerKey int
+
+const (
+	tracerContextKey tracerKey = iota
+	recordedSpanContextKey
+)
+
+// Tracer starts spans as values pass through the built-in stages of a pipeline.
+// Built-in stages start a span from the context of each value they receive, and
+// end it once the result has been emitted. The context returned by Start is passed
+// on to the stage in place of the original, so values produced by Map, FlatMap
+// and Loop carry the span to the next stage
+type Tracer interface {
+	Start(ctx context.Context, info StageInfo) (context.Context, Span)
+}
+
+// Span is a single stage processing a single value
+type Span interface {
+	// SetError records that the stage failed to process the value
+	SetError(error)
+
+	// End the span
+	End()
+}
+
+// WithTracer returns a copy of ctx carrying t
+func WithTracer(ctx context.Context, t Tracer) context.Context {
+	return context.WithValue(ctx, tracerContextKey, t)
+}
+
+// TracerFromContext retrieves a Tracer from ctx
+func TracerFromContext(ctx context.Context) (Tracer, bool) {
+	t, ok := ctx.Value(tracerContextKey).(Tracer)
+	return t, ok
+}
+
+// RecordedSpan is a span captured by a Recorder
+type RecordedSpan struct {
+	StageInfo
+
+	// ID of the span, unique within its Recorder
+	ID int
+
+	// ID of the parent span, or 0 if the span has no parent
+	Parent int
+
+	Start time.Time
+	End   time.Time
+	Err   error
+}
+
+// Ended reports whether the span has ended
+func (s RecordedSpan) Ended() bool {
+	return !s.End.IsZero()
+}
+
+// Recorder is a Tracer that keeps all spans in memory. It is intended for tests
+// and debugging
+type Recorder struct {
+	mu    sync.Mutex
+	spans []*RecordedSpan
+}
+
+// NewRecorder creates an empty Recorder
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+// Start satisfies the Tracer interface
+func (r *Recorder) Start(ctx context.Context, info StageInfo) (context.Context, Span) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := &RecordedSpan{
+		StageInfo: info,
+		ID:        len(r.spans) + 1,
+		Start:     time.Now(),
+	}
+
+	if parent, ok := ctx.Value(recordedSpanContextKey).(*RecordedSpan); ok {
+		s.Parent = parent.ID
+	}
+
+	r.spans = append(r.spans, s)
+
+	return context.WithValue(ctx, recordedSpanContextKey, s), &recorderSpan{r, s}
+}
+
+// Spans returns a copy of all spans recorded so far, in the order they were started
+func (r *Recorder) Spans() []RecordedSpan {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	spans := make([]RecordedSpan, len(r.spans))
+
+	for i := range r.spans {
+		spans[i] = *r.spans[i]
+	}
+
+	return spans
+}
+
+// Path returns the span with the given ID, preceded by all of its ancestors. This
+// is the full path taken through the pipeline by the value the span belongs to
+func (r *Recorder) Path(id int) []RecordedSpan {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var path []RecordedSpan
+
+	for id > 0 && id <= len(r.spans) {
+		s := *r.spans[id-1]
+		path = append([]RecordedSpan{s}, path...)
+		id = s.Parent
+	}
+
+	return path
+}
+
+type recorderSpan struct {
+	recorder *Recorder
+	span     *RecordedSpan
+}
+
+func (s *recorderSpan) SetError(err error) {
+	s.recorder.mu.Lock()
+	defer s.recorder.mu.Unlock()
+	s.span.Err = err
+}
+
+func (s *recorderSpan) End() {
+	s.recorder.mu.Lock()
+	defer s.recorder.mu.Unlock()
+
+	if s.span.End.IsZero() {
+		s.span.End = time.Now()
+	}
+}
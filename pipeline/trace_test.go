@@ -0,0 +1,124 @@
+package pipeline
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/bernos/go-pipeline/pipeline/stream"
+
+	"golang.org/x/net/context"
+)
+
+func TestTracerFollowsValueThroughStages(t *testing.T) {
+	recorder := NewRecorder()
+
+	double := MapperFunc(func(ctx context.Context) (context.Context, error) {
+		return NewContext(ctx, FromContext(ctx)*2), nil
+	})
+
+	split := FlatMapperFunc(func(ctx context.Context) ([]context.Context, error) {
+		return []context.Context{ctx, NewContext(ctx, FromContext(ctx)+1)}, nil
+	})
+
+	pl := Map(double).FlatMap(split).Filter(func(ctx context.Context) bool {
+		return FromContext(ctx)%2 == 1
+	})
+
+	input := []context.Context{NewContext(WithTracer(context.Background(), recorder), 1)}
+	values, _ := runPipeline(pl, input)
+
+	if len(values) != 1 {
+		t.Fatalf("Want %d values, got %d", 1, len(values))
+	}
+
+	spans := recorder.Spans()
+
+	if len(spans) != 4 {
+		t.Fatalf("Want %d spans, got %d", 4, len(spans))
+	}
+
+	for _, s := range spans {
+		if !s.Ended() {
+			t.Errorf("Expected span %d (%s) to have ended", s.ID, s.Name)
+		}
+	}
+
+	var last RecordedSpan
+
+	for _, s := range spans {
+		if s.Type == "Filter" && s.Parent != 0 && s.ID > last.ID {
+			last = s
+		}
+	}
+
+	path := recorder.Path(last.ID)
+	want := []string{"Map", "FlatMap", "Filter"}
+
+	if len(path) != len(want) {
+		t.Fatalf("Want path of length %d, got %d", len(want), len(path))
+	}
+
+	for i := range want {
+		if path[i].Type != want[i] {
+			t.Errorf("Want %s at position %d in path, got %s", want[i], i, path[i].Type)
+		}
+	}
+}
+
+func TestTracerRecordsErrors(t *testing.T) {
+	recorder := NewRecorder()
+
+	mapper := MapperFunc(func(ctx context.Context) (context.Context, error) {
+		return nil, fmt.Errorf("failed")
+	})
+
+	input := []context.Context{NewContext(WithTracer(context.Background(), recorder), 1)}
+	runPipeline(Map(mapper), input)
+
+	spans := recorder.Spans()
+
+	if len(spans) != 1 {
+		t.Fatalf("Want %d spans, got %d", 1, len(spans))
+	}
+
+	if spans[0].Err == nil {
+		t.Error("Expected span to have recorded an error")
+	}
+}
+
+func TestTracerFollowsLoopIterations(t *testing.T) {
+	recorder := NewRecorder()
+
+	inc := MapperFunc(func(ctx context.Context) (context.Context, error) {
+		return NewContext(ctx, FromContext(ctx)+1), nil
+	})
+
+	in, cls := stream.New()
+	out := Map(inc).Loop()(in)
+
+	defer cls()
+
+	go func() {
+		in.Value(NewContext(WithTracer(context.Background(), recorder), 0))
+	}()
+
+	var third context.Context
+
+	for i := 0; i < 3; i++ {
+		third = <-out.Values()
+	}
+
+	id := third.Value(recordedSpanContextKey).(*RecordedSpan).ID
+	path := recorder.Path(id)
+	want := []string{"Map", "Loop", "Map", "Loop", "Map", "Loop"}
+
+	if len(path) != len(want) {
+		t.Fatalf("Want path of length %d, got %d", len(want), len(path))
+	}
+
+	for i := range want {
+		if path[i].Type != want[i] {
+			t.Errorf("Want %s at position %d in path, got %s", want[i], i, path[i].Type)
+		}
+	}
+}
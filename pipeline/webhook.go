@@ -0,0 +1,365 @@
+package pipeline
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bernos/go-pipeline/pipeline/stream"
+	"golang.org/x/net/context"
+)
+
+// Defaults used by NewWebhook for fields of WebhookOptions that are not set
+const (
+	// DefaultWebhookQueue is the number of requests that can wait to enter
+	// the pipeline
+	DefaultWebhookQueue = 100
+
+	// DefaultWebhookMaxBody is the largest request body that is read, in
+	// bytes
+	DefaultWebhookMaxBody = 1 << 20
+)
+
+// WebhookOptions configures a Webhook
+type WebhookOptions struct {
+	// Decode converts a request in to a value for the pipeline, derived from
+	// parent. If Decode fails, the request is rejected with 400 Bad Request.
+	// The default is DecodeWebhookBody
+	Decode func(parent context.Context, r *http.Request) (context.Context, error)
+
+	// If Sync is true, each request waits for its value to be processed, and
+	// the result is sent as the response. See Webhook.Reply
+	Sync bool
+
+	// Encode writes the result of a synchronous request to w. If Encode is nil
+	// the response is 200 OK with no body
+	Encode func(w http.ResponseWriter, result context.Context) error
+
+	// Timeout is how long a synchronous request waits for its result before
+	// failing with 504 Gateway Timeout. Zero means no timeout
+	Timeout time.Duration
+
+	// Queue is the number of requests that can wait to enter the pipeline.
+	// Once the queue is full, asynchronous requests are rejected with 429 Too
+	// Many Requests, and synchronous requests wait
+	Queue int
+
+	// MaxBody is the largest request body, in bytes, that Decode can read.
+	// Reading more than MaxBody fails, so the request is rejected
+	MaxBody int64
+}
+
+// Webhook is an http.Handler that is also a stream. Each request it accepts is
+// decoded in to a value and sent on the stream, so a Webhook can be used as the
+// input of a pipeline
+//
+//	hook, cls := pipeline.NewWebhook(opts)
+//	out := p.Compose(hook.Reply())(hook)
+//	http.Handle("/hook", hook)
+//
+// Asynchronous requests are answered with 202 Accepted as soon as they are
+// queued. Synchronous requests are answered once their value reaches the Reply
+// stage, with 204 No Content if the value was acked without reaching it, for
+// example because it was filtered out, or with 500 Internal Server Error if the
+// value was nacked. Once the stream is closed, requests are rejected with 503
+// Service Unavailable, and requests still waiting to enter the pipeline are
+// nacked, with synchronous requests answered with 503 Service Unavailable
+type Webhook struct {
+	stream.Stream
+
+	opts  WebhookOptions
+	queue chan context.Context
+
+	// stop is closed by the CloseFunc. Requests hold mu for reading while
+	// they queue a value, so that once closed is set no more are queued
+	stop   chan struct{}
+	mu     sync.RWMutex
+	closed bool
+}
+
+// errWebhookClosed nacks the values of requests that were waiting to enter the
+// pipeline when the webhook was closed
+var errWebhookClosed = errors.New("Webhook is closed")
+
+type webhookKey int
+
+const (
+	webhookReplyContextKey webhookKey = iota
+	webhookBodyContextKey
+)
+
+// DecodeWebhookBody is the default WebhookOptions.Decode. It reads the body of
+// the request, which can be retrieved from the value using WebhookBodyFromContext.
+// The body is limited to WebhookOptions.MaxBody bytes
+func DecodeWebhookBody(parent context.Context, r *http.Request) (context.Context, error) {
+	body, err := ioutil.ReadAll(r.Body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return context.WithValue(parent, webhookBodyContextKey, body), nil
+}
+
+// WebhookBodyFromContext retrieves the request body from a context created by
+// DecodeWebhookBody
+func WebhookBodyFromContext(ctx context.Context) ([]byte, bool) {
+	body, ok := ctx.Value(webhookBodyContextKey).([]byte)
+	return body, ok
+}
+
+// webhookReply waits for the result of a synchronous request
+type webhookReply struct {
+	once   sync.Once
+	done   chan struct{}
+	result context.Context
+	err    error
+}
+
+func (r *webhookReply) finish(result context.Context, err error) {
+	r.once.Do(func() {
+		r.result, r.err = result, err
+		close(r.done)
+	})
+}
+
+// NewWebhook creates a Webhook. The webhook stops accepting requests once the
+// returned CloseFunc is called
+func NewWebhook(opts WebhookOptions) (*Webhook, stream.CloseFunc) {
+	if opts.Queue <= 0 {
+		opts.Queue = DefaultWebhookQueue
+	}
+
+	if opts.Decode == nil {
+		opts.Decode = DecodeWebhookBody
+	}
+
+	if opts.MaxBody <= 0 {
+		opts.MaxBody = DefaultWebhookMaxBody
+	}
+
+	var (
+		values = make(chan context.Context)
+		s, cls = stream.WithValues(values)
+		once   sync.Once
+		w      = &Webhook{
+			Stream: s,
+			opts:   opts,
+			queue:  make(chan context.Context, opts.Queue),
+			stop:   make(chan struct{}),
+		}
+	)
+
+	// The forwarder is the only thing that sends on values, so it closes the
+	// stream once it has stopped sending
+	go func() {
+		defer cls()
+
+		for {
+			select {
+			case <-w.stop:
+				w.drain()
+				return
+			case ctx := <-w.queue:
+				select {
+				case <-w.stop:
+					Nack(ctx, errWebhookClosed)
+					w.drain()
+					return
+				case values <- ctx:
+				}
+			}
+		}
+	}()
+
+	return w, func() {
+		once.Do(func() { close(w.stop) })
+	}
+}
+
+// drain stops requests from being queued, and nacks the values of those that
+// were
+func (w *Webhook) drain() {
+	w.mu.Lock()
+	w.closed = true
+	w.mu.Unlock()
+
+	for {
+		select {
+		case ctx := <-w.queue:
+			Nack(ctx, errWebhookClosed)
+		default:
+			return
+		}
+	}
+}
+
+// enqueue queues a value, waiting if wait is not nil until the queue has room
+// or wait is done. It returns false if the webhook is closed
+func (w *Webhook) enqueue(ctx context.Context, wait <-chan struct{}) (queued, ok bool) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if w.closed {
+		return false, false
+	}
+
+	if wait == nil {
+		select {
+		case w.queue <- ctx:
+			return true, true
+		default:
+			return false, true
+		}
+	}
+
+	select {
+	case w.queue <- ctx:
+		return true, true
+	case <-wait:
+		return false, true
+	case <-w.stop:
+		return false, false
+	}
+}
+
+// ServeHTTP satisfies the http.Handler interface
+func (w *Webhook) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	select {
+	case <-w.stop:
+		http.Error(rw, "Webhook is closed", http.StatusServiceUnavailable)
+		return
+	default:
+	}
+
+	r.Body = http.MaxBytesReader(rw, r.Body, w.opts.MaxBody)
+
+	if w.opts.Sync {
+		w.serveSync(rw, r)
+	} else {
+		w.serveAsync(rw, r)
+	}
+}
+
+func (w *Webhook) serveAsync(rw http.ResponseWriter, r *http.Request) {
+	// The value outlives the request, so is not derived from its context
+	ctx, err := w.opts.Decode(context.Background(), r)
+
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch queued, ok := w.enqueue(ctx, nil); {
+	case !ok:
+		Nack(ctx, errWebhookClosed)
+		http.Error(rw, "Webhook is closed", http.StatusServiceUnavailable)
+	case queued:
+		rw.WriteHeader(http.StatusAccepted)
+	default:
+		rw.Header().Set("Retry-After", "1")
+		http.Error(rw, "Too many requests", http.StatusTooManyRequests)
+	}
+}
+
+func (w *Webhook) serveSync(rw http.ResponseWriter, r *http.Request) {
+	parent := r.Context()
+
+	if w.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		parent, cancel = context.WithTimeout(parent, w.opts.Timeout)
+		defer cancel()
+	}
+
+	ctx, err := w.opts.Decode(parent, r)
+
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	reply := &webhookReply{
+		done: make(chan struct{}),
+	}
+
+	ctx = context.WithValue(ctx, webhookReplyContextKey, reply)
+	ctx = WithAck(ctx, func() {
+		reply.finish(nil, nil)
+	}, func(err error) {
+		reply.finish(nil, err)
+	})
+
+	switch queued, ok := w.enqueue(ctx, parent.Done()); {
+	case !ok:
+		http.Error(rw, "Webhook is closed", http.StatusServiceUnavailable)
+		return
+	case !queued:
+		http.Error(rw, "Timed out waiting to enter pipeline", http.StatusGatewayTimeout)
+		return
+	}
+
+	select {
+	case <-reply.done:
+	case <-parent.Done():
+		http.Error(rw, "Timed out waiting for result", http.StatusGatewayTimeout)
+		return
+	case <-w.Done():
+		// The stream is closed once queued values have been nacked, so
+		// only give up if the value was already in the pipeline
+		select {
+		case <-reply.done:
+		default:
+			http.Error(rw, "Webhook is closed", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	// Errors from the pipeline are not passed on to the client
+	switch {
+	case reply.err == errWebhookClosed:
+		http.Error(rw, "Webhook is closed", http.StatusServiceUnavailable)
+	case reply.err != nil:
+		http.Error(rw, "Value could not be processed", http.StatusInternalServerError)
+	case reply.result == nil:
+		rw.WriteHeader(http.StatusNoContent)
+	case w.opts.Encode != nil:
+		if err := w.opts.Encode(rw, reply.result); err != nil {
+			http.Error(rw, "Result could not be encoded", http.StatusInternalServerError)
+		}
+	default:
+		rw.WriteHeader(http.StatusOK)
+	}
+}
+
+// Reply creates a Pipeline that sends each value from its input stream as the
+// response to the synchronous request it was derived from, and then acks it.
+// Values from asynchronous requests are acked. The output stream carries no
+// values, and any errors from the input stream
+func (w *Webhook) Reply() Pipeline {
+	return newStage("Reply", 1, nil, func(s *stage, in stream.Stream) stream.Stream {
+		out, cls := in.WithValues(make(chan context.Context))
+
+		go func() {
+			defer cls()
+
+			info := s.info(0)
+
+			for ctx := range in.Values() {
+				ctx, a := begin(ctx, info)
+
+				if reply, ok := ctx.Value(webhookReplyContextKey).(*webhookReply); ok {
+					reply.finish(ctx, nil)
+				}
+
+				Ack(ctx)
+				a.processed(nil)
+				a.handOff(0)
+				a.end()
+			}
+		}()
+
+		return out
+	})
+}
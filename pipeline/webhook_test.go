@@ -0,0 +1,217 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func decodeInt(parent context.Context, r *http.Request) (context.Context, error) {
+	body, err := ioutil.ReadAll(r.Body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	x, err := strconv.Atoi(string(body))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return NewContext(parent, x), nil
+}
+
+func post(h http.Handler, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+	return rec
+}
+
+func TestWebhookAsync(t *testing.T) {
+	hook, cls := NewWebhook(WebhookOptions{Decode: decodeInt, Queue: 1})
+
+	if rec := post(hook, "1"); rec.Code != http.StatusAccepted {
+		t.Errorf("Want %d, got %d", http.StatusAccepted, rec.Code)
+	}
+
+	if got := FromContext(<-hook.Values()); got != 1 {
+		t.Errorf("Want %d, got %d", 1, got)
+	}
+
+	if rec := post(hook, "one"); rec.Code != http.StatusBadRequest {
+		t.Errorf("Want %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+
+	// Nothing is reading the stream, so once a value is waiting to be sent
+	// and the queue is full, requests are rejected
+	codes := make(map[int]int)
+
+	for i := 0; i < 3; i++ {
+		codes[post(hook, "2").Code]++
+	}
+
+	if codes[http.StatusTooManyRequests] == 0 {
+		t.Errorf("Want requests to be rejected when saturated, got %v", codes)
+	}
+
+	cls()
+
+	if rec := post(hook, "3"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Want %d, got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+}
+
+func TestWebhookDefaultDecode(t *testing.T) {
+	hook, cls := NewWebhook(WebhookOptions{})
+	defer cls()
+
+	if rec := post(hook, "hello"); rec.Code != http.StatusAccepted {
+		t.Errorf("Want %d, got %d", http.StatusAccepted, rec.Code)
+	}
+
+	if body, ok := WebhookBodyFromContext(<-hook.Values()); !ok || string(body) != "hello" {
+		t.Errorf("Want body %s, got %s", "hello", body)
+	}
+}
+
+func TestWebhookSync(t *testing.T) {
+	hook, cls := NewWebhook(WebhookOptions{
+		Decode: decodeInt,
+		Sync:   true,
+		Encode: func(w http.ResponseWriter, result context.Context) error {
+			_, err := fmt.Fprint(w, FromContext(result))
+			return err
+		},
+	})
+
+	defer cls()
+
+	double := MapperFunc(func(ctx context.Context) (context.Context, error) {
+		if FromContext(ctx) < 0 {
+			return nil, errors.New("Negative")
+		}
+		return NewContext(ctx, FromContext(ctx)*2), nil
+	})
+
+	small := func(ctx context.Context) bool {
+		return FromContext(ctx) < 100
+	}
+
+	out := Map(double).Filter(small).Compose(hook.Reply())(hook)
+
+	go func() {
+		for range out.Errors() {
+		}
+	}()
+
+	tests := []struct {
+		body string
+		code int
+		want string
+	}{
+		{"21", http.StatusOK, "42"},
+		{"500", http.StatusNoContent, ""},
+		{"-1", http.StatusInternalServerError, "Value could not be processed\n"},
+	}
+
+	for _, test := range tests {
+		rec := post(hook, test.body)
+
+		if rec.Code != test.code || rec.Body.String() != test.want {
+			t.Errorf("%s: want %d %q, got %d %q", test.body, test.code, test.want, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestWebhookCloseWithQueuedRequests(t *testing.T) {
+	hook, cls := NewWebhook(WebhookOptions{Decode: decodeInt, Sync: true, Queue: 5})
+
+	// Nothing reads the stream, so requests wait in the queue until the
+	// webhook is closed
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		codes = make(map[int]int)
+	)
+
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			code := post(hook, strconv.Itoa(i)).Code
+
+			mu.Lock()
+			codes[code]++
+			mu.Unlock()
+		}(i)
+	}
+
+	time.Sleep(time.Millisecond * 20)
+	cls()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for queued requests to be answered")
+	}
+
+	if codes[http.StatusServiceUnavailable] != 5 {
+		t.Errorf("Want 5 requests answered with %d, got %v", http.StatusServiceUnavailable, codes)
+	}
+}
+
+func TestWebhookCloseWhileSending(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		hook, cls := NewWebhook(WebhookOptions{Decode: decodeInt, Queue: 5})
+
+		go func() {
+			for range hook.Values() {
+			}
+		}()
+
+		var wg sync.WaitGroup
+
+		for j := 0; j < 5; j++ {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+				post(hook, "1")
+			}()
+		}
+
+		cls()
+		wg.Wait()
+	}
+}
+
+func TestWebhookMaxBody(t *testing.T) {
+	hook, cls := NewWebhook(WebhookOptions{MaxBody: 4})
+	defer cls()
+
+	if rec := post(hook, "hello"); rec.Code != http.StatusBadRequest {
+		t.Errorf("Want %d for a body over the limit, got %d", http.StatusBadRequest, rec.Code)
+	}
+
+	if rec := post(hook, "hey"); rec.Code != http.StatusAccepted {
+		t.Errorf("Want %d, got %d", http.StatusAccepted, rec.Code)
+	}
+}
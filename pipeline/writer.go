@@ -0,0 +1,102 @@
+package pipeline
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/bernos/go-pipeline/pipeline/stream"
+	"golang.org/x/net/context"
+)
+
+// Formatter formats a value to be written by ToWriter
+type Formatter func(context.Context) ([]byte, error)
+
+// ToWriter creates a Pipeline that writes each value from its input stream to w,
+// formatted by format. Formatted values are written as is, so a line oriented
+// Formatter should end each value with a newline. Writes are buffered, and the
+// buffer is flushed whenever the input stream has no value ready, and once the
+// input stream is closed. Values are acked once they have been flushed, or
+// nacked if they could not be formatted or written. Errors from the input stream
+// are forwarded to the output stream, which carries no values
+func ToWriter(w io.Writer, format Formatter) Pipeline {
+	return toWriter("ToWriter", w, format)
+}
+
+func toWriter(t string, w io.Writer, format Formatter) Pipeline {
+	return newStage(t, 1, nil, func(s *stage, in stream.Stream) stream.Stream {
+		out, cls := in.WithValues(make(chan context.Context))
+
+		go func() {
+			defer cls()
+
+			var (
+				info    = s.info(0)
+				buf     = bufio.NewWriter(w)
+				pending []context.Context
+			)
+
+			flush := func() {
+				if len(pending) == 0 {
+					return
+				}
+
+				err := buf.Flush()
+
+				for _, ctx := range pending {
+					if err == nil {
+						Ack(ctx)
+					} else {
+						Nack(ctx, err)
+					}
+				}
+
+				if err != nil {
+					out.Error(err)
+				}
+
+				pending = nil
+			}
+
+			defer flush()
+
+			for {
+				var (
+					ctx context.Context
+					ok  bool
+				)
+
+				select {
+				case ctx, ok = <-in.Values():
+				default:
+					flush()
+					ctx, ok = <-in.Values()
+				}
+
+				if !ok {
+					return
+				}
+
+				ctx, a := begin(ctx, info)
+				data, err := format(ctx)
+
+				if err == nil {
+					_, err = buf.Write(data)
+				}
+
+				a.processed(err)
+				a.handOff(0)
+
+				if err == nil {
+					pending = append(pending, ctx)
+				} else {
+					Nack(ctx, err)
+					out.Error(err)
+				}
+
+				a.end()
+			}
+		}()
+
+		return out
+	})
+}
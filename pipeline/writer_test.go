@@ -0,0 +1,51 @@
+package pipeline
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func formatInt(ctx context.Context) ([]byte, error) {
+	if FromContext(ctx) < 0 {
+		return nil, errors.New("Negative")
+	}
+
+	return []byte(fmt.Sprintf("%d\n", FromContext(ctx))), nil
+}
+
+func TestToWriter(t *testing.T) {
+	var (
+		buf bytes.Buffer
+		r   = &ackRecorder{}
+	)
+
+	runAck(ToWriter(&buf, formatInt), r.value(1), r.value(-1), r.value(2))
+
+	if got := buf.String(); got != "1\n2\n" {
+		t.Errorf("Want %q, got %q", "1\n2\n", got)
+	}
+
+	if acked, nacked := r.counts(); acked != 2 || nacked != 1 {
+		t.Errorf("Want 2 acks and 1 nack, got %d and %d", acked, nacked)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("Disk full")
+}
+
+func TestToWriterError(t *testing.T) {
+	r := &ackRecorder{}
+
+	runAck(ToWriter(failingWriter{}, formatInt), r.value(1))
+
+	if acked, nacked := r.counts(); acked != 0 || nacked != 1 {
+		t.Errorf("Want 0 acks and 1 nack, got %d and %d", acked, nacked)
+	}
+}